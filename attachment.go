@@ -0,0 +1,485 @@
+package boltplus
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// AttachmentChunkSize is the number of bytes of an attachment stored per key
+const AttachmentChunkSize = 256 << 10
+
+// attachmentBatchSize is the number of chunks DB.PutAttachment writes per transaction
+const attachmentBatchSize = 64
+
+// attachmentsBucket is the reserved sub-bucket of a doc bucket holding the attachments of its docs:
+// _attachments | doc key | attachment name | info and one sub-bucket of chunks per upload
+const attachmentsBucket = "_attachments"
+
+var attachmentInfoKey = []byte("info")
+
+// Attachment describes a blob stored next to a doc
+type Attachment struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size"`
+	// SHA256 is the hex encoded hash of the content
+	SHA256    string    `json:"sha256"`
+	Modified  time.Time `json:"modified"`
+	ChunkSize int       `json:"chunkSize"`
+	// Upload identifies the chunks of the current content
+	Upload uint64 `json:"upload"`
+}
+
+// PutAttachment stores the content of r as attachment of a doc, an attachment with the same name is replaced.
+// The doc has to exist. The whole content is written in this transaction, DB.PutAttachment commits large
+// contents in batches.
+func (tx *Transaction) PutAttachment(bucketPath, key, name, contentType string, r io.Reader) (info *Attachment, err error) {
+	defer tx.db.observe("putAttachment", time.Now(), &err)
+	u, err := tx.beginUpload(bucketPath, key, name, contentType)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = u.write(tx, r, 0); err != nil {
+		return nil, err
+	}
+	return tx.finishUpload(u)
+}
+
+// upload tracks the content of an attachment while it is written
+type upload struct {
+	info  *Attachment
+	index uint64
+	hash  hash.Hash
+	buf   []byte
+	// bucketPath and key locate the doc
+	bucketPath, key string
+}
+
+func (tx *Transaction) beginUpload(bucketPath, key, name, contentType string) (*upload, error) {
+	bucket, err := tx.attachmentBucket(bucketPath, key, name, true)
+	if err != nil {
+		return nil, err
+	}
+	id, err := bucket.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	info := &Attachment{Name: name, ContentType: contentType, ChunkSize: AttachmentChunkSize, Upload: id}
+	return &upload{info: info, hash: sha256.New(), buf: make([]byte, AttachmentChunkSize), bucketPath: bucketPath, key: key}, nil
+}
+
+// write stores up to max chunks read from r (all if max <= 0), done is true once r is drained
+func (u *upload) write(tx *Transaction, r io.Reader, max int) (done bool, err error) {
+	for n := 0; max <= 0 || n < max; n++ {
+		read, e := io.ReadFull(r, u.buf)
+		if read > 0 {
+			chunk := u.buf[:read]
+			if err = tx.putChunk(u.bucketPath, u.key, u.info.Name, u.info.Upload, u.index, chunk); err != nil {
+				return false, err
+			}
+			u.hash.Write(chunk)
+			u.info.Size += int64(read)
+			u.index++
+		}
+		if e == io.EOF || e == io.ErrUnexpectedEOF {
+			return true, nil
+		}
+		if e != nil {
+			return false, e
+		}
+	}
+	return false, nil
+}
+
+func (tx *Transaction) finishUpload(u *upload) (*Attachment, error) {
+	u.info.SHA256 = hex.EncodeToString(u.hash.Sum(nil))
+	u.info.Modified = time.Now().UTC()
+	if err := tx.putAttachmentInfo(u.bucketPath, u.key, u.info); err != nil {
+		return nil, err
+	}
+	return u.info, nil
+}
+
+// putChunk stores a chunk of an upload without validation
+func (tx *Transaction) putChunk(bucketPath, key, name string, id, index uint64, data []byte) error {
+	bucket, err := tx.attachmentBucket(bucketPath, key, name, true)
+	if err != nil {
+		return err
+	}
+	chunks, err := bucket.CreateBucketIfNotExists(encodeSeq(id))
+	if err != nil {
+		return err
+	}
+	bs, err := tx.seal(kindRaw, data)
+	if err != nil {
+		return err
+	}
+	if err = chunks.Put(encodeSeq(index), bs); err != nil {
+		return err
+	}
+	ref := map[string]interface{}{"name": name, "upload": id, "index": index}
+	return tx.appendLog(&LogEntry{Op: OpPutAttachmentChunk, Bucket: bucketPath, Key: key, Value: ref, Data: data})
+}
+
+// putAttachmentInfo makes an upload the content of an attachment and removes the chunks of all other uploads
+func (tx *Transaction) putAttachmentInfo(bucketPath, key string, info *Attachment) error {
+	bucket, err := tx.attachmentBucket(bucketPath, key, info.Name, true)
+	if err != nil {
+		return err
+	}
+	bs, err := tx.dataToBytes(info)
+	if err != nil {
+		return err
+	}
+	if err = bucket.Put(attachmentInfoKey, bs); err != nil {
+		return err
+	}
+	// the chunks of replaced contents and of failed uploads
+	var stale [][]byte
+	bucket.ForEach(func(k, v []byte) error {
+		if v == nil && !bytes.Equal(k, encodeSeq(info.Upload)) {
+			stale = append(stale, append([]byte{}, k...))
+		}
+		return nil
+	})
+	for _, k := range stale {
+		if err = bucket.DeleteBucket(k); err != nil {
+			return err
+		}
+	}
+	value, err := attachmentToMap(info)
+	if err != nil {
+		return err
+	}
+	return tx.appendLog(&LogEntry{Op: OpPutAttachment, Bucket: bucketPath, Key: key, Value: value})
+}
+
+// attachmentBucket returns the bucket of an attachment, nil if it does not exist.
+// With create it is created if the doc exists.
+func (tx *Transaction) attachmentBucket(bucketPath, key, name string, create bool) (backendBucket, error) {
+	if name == "" {
+		return nil, errors.New("empty attachment name")
+	}
+	docs, err := tx.attachmentDocsBucket(bucketPath, create)
+	if err != nil || docs == nil {
+		return nil, err
+	}
+	if !create {
+		if bucket := docs.Bucket([]byte(key)); bucket != nil {
+			return bucket.Bucket([]byte(name)), nil
+		}
+		return nil, nil
+	}
+	parent, _ := tx.getBucket(bucketPath)
+	if v := parent.Get([]byte(key)); v == nil {
+		return nil, fmt.Errorf("no such doc %v", key)
+	}
+	bucket, err := docs.CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	return bucket.CreateBucketIfNotExists([]byte(name))
+}
+
+// attachmentDocsBucket returns the attachments sub-bucket of a doc bucket, nil if it does not exist
+func (tx *Transaction) attachmentDocsBucket(bucketPath string, create bool) (backendBucket, error) {
+	bucket, err := tx.getBucket(bucketPath)
+	if err != nil {
+		if create {
+			return nil, err
+		}
+		return nil, nil
+	}
+	if !create {
+		return bucket.Bucket([]byte(attachmentsBucket)), nil
+	}
+	return bucket.CreateBucketIfNotExists([]byte(attachmentsBucket))
+}
+
+// Attachment returns the description of an attachment
+func (tx *Transaction) Attachment(bucketPath, key, name string) (*Attachment, error) {
+	bucket, err := tx.attachmentBucket(bucketPath, key, name, false)
+	if err != nil {
+		return nil, err
+	}
+	if bucket == nil || bucket.Get(attachmentInfoKey) == nil {
+		return nil, fmt.Errorf("no such attachment %v", name)
+	}
+	info := &Attachment{}
+	if err = tx.decodeBytes(bucket.Get(attachmentInfoKey), info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Attachments lists the attachments of a doc ordered by name
+func (tx *Transaction) Attachments(bucketPath, key string) ([]*Attachment, error) {
+	docs, err := tx.attachmentDocsBucket(bucketPath, false)
+	if err != nil || docs == nil || docs.Bucket([]byte(key)) == nil {
+		return []*Attachment{}, err
+	}
+	res := []*Attachment{}
+	err = docs.Bucket([]byte(key)).ForEach(func(k, v []byte) error {
+		info, e := tx.Attachment(bucketPath, key, string(k))
+		if e != nil {
+			// an upload which never finished
+			return nil
+		}
+		res = append(res, info)
+		return nil
+	})
+	return res, err
+}
+
+// GetAttachment writes the content of an attachment to w and verifies its hash
+func (tx *Transaction) GetAttachment(bucketPath, key, name string, w io.Writer) (info *Attachment, err error) {
+	defer tx.db.observe("getAttachment", time.Now(), &err)
+	r, err := tx.OpenAttachment(bucketPath, key, name)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(w, h), r); err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != r.Info.SHA256 {
+		return nil, fmt.Errorf("attachment %v is corrupt", name)
+	}
+	return r.Info, nil
+}
+
+// OpenAttachment returns a reader of the content of an attachment, it is valid until the transaction is closed
+func (tx *Transaction) OpenAttachment(bucketPath, key, name string) (*AttachmentReader, error) {
+	info, err := tx.Attachment(bucketPath, key, name)
+	if err != nil {
+		return nil, err
+	}
+	bucket, _ := tx.attachmentBucket(bucketPath, key, name, false)
+	return &AttachmentReader{Info: info, tx: tx, chunks: bucket.Bucket(encodeSeq(info.Upload)), chunk: -1}, nil
+}
+
+// DeleteAttachment removes an attachment of a doc
+func (tx *Transaction) DeleteAttachment(bucketPath, key, name string) (err error) {
+	defer tx.db.observe("deleteAttachment", time.Now(), &err)
+	if _, err = tx.Attachment(bucketPath, key, name); err != nil {
+		return err
+	}
+	return tx.deleteAttachment(bucketPath, key, name)
+}
+
+func (tx *Transaction) deleteAttachment(bucketPath, key, name string) error {
+	docs, err := tx.attachmentDocsBucket(bucketPath, false)
+	if err != nil || docs == nil || docs.Bucket([]byte(key)) == nil {
+		return err
+	}
+	if err = docs.Bucket([]byte(key)).DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	ref := map[string]interface{}{"name": name}
+	return tx.appendLog(&LogEntry{Op: OpDeleteAttachment, Bucket: bucketPath, Key: key, Value: ref})
+}
+
+// deleteAttachments removes all attachments of a doc, it is part of deleting the doc and not logged itself
+func (tx *Transaction) deleteAttachments(bucketPath, key string) error {
+	docs, err := tx.attachmentDocsBucket(bucketPath, false)
+	if err != nil || docs == nil {
+		return err
+	}
+	if err = docs.DeleteBucket([]byte(key)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	return nil
+}
+
+func attachmentToMap(info *Attachment) (map[string]interface{}, error) {
+	bs, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	var value map[string]interface{}
+	err = json.Unmarshal(bs, &value)
+	return value, err
+}
+
+func attachmentFromMap(value map[string]interface{}) (*Attachment, error) {
+	bs, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	info := &Attachment{}
+	err = json.Unmarshal(bs, info)
+	return info, err
+}
+
+// AttachmentReader reads the content of an attachment chunk by chunk, it implements io.ReadSeeker
+type AttachmentReader struct {
+	Info   *Attachment
+	tx     *Transaction
+	chunks backendBucket
+	offset int64
+	// data is the decoded chunk with the index chunk
+	chunk int64
+	data  []byte
+	// closeTx is set if the reader owns its transaction
+	closeTx bool
+}
+
+// Read reads the content at the current offset
+func (r *AttachmentReader) Read(p []byte) (int, error) {
+	if r.offset >= r.Info.Size {
+		return 0, io.EOF
+	}
+	index := r.offset / int64(r.Info.ChunkSize)
+	if index != r.chunk {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.data[r.offset-index*int64(r.Info.ChunkSize):])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *AttachmentReader) load(index int64) error {
+	var stored []byte
+	if r.chunks != nil {
+		stored = r.chunks.Get(encodeSeq(uint64(index)))
+	}
+	if stored == nil {
+		return fmt.Errorf("attachment %v: chunk %v missing", r.Info.Name, index)
+	}
+	_, data, err := openValue(r.tx.db.keys, stored)
+	if err != nil {
+		return err
+	}
+	r.chunk, r.data = index, data
+	return nil
+}
+
+// Seek sets the offset of the next Read
+func (r *AttachmentReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.Info.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close releases the transaction of readers opened by DB.OpenAttachment
+func (r *AttachmentReader) Close() error {
+	if r.closeTx {
+		return r.tx.Close()
+	}
+	return nil
+}
+
+// PutAttachment stores the content of r as attachment of a doc. Large contents are committed in batches
+// of chunks, readers see the previous content until the last batch is committed. The chunks of a failed
+// upload are removed by the next upload of the attachment.
+func (db *DB) PutAttachment(bucketPath, key, name, contentType string, r io.Reader) (info *Attachment, err error) {
+	defer db.observe("putAttachment", time.Now(), &err)
+	var u *upload
+	for {
+		var tx *Transaction
+		if tx, err = db.Tx(true); err != nil {
+			return nil, err
+		}
+		if u == nil {
+			u, err = tx.beginUpload(bucketPath, key, name, contentType)
+		}
+		done := false
+		if err == nil {
+			done, err = u.write(tx, r, attachmentBatchSize)
+		}
+		if err == nil && done {
+			info, err = tx.finishUpload(u)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		tx.Close()
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return info, nil
+		}
+	}
+}
+
+// Attachment returns the description of an attachment
+func (db *DB) Attachment(bucketPath, key, name string) (*Attachment, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	return tx.Attachment(bucketPath, key, name)
+}
+
+// Attachments lists the attachments of a doc
+func (db *DB) Attachments(bucketPath, key string) ([]*Attachment, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	return tx.Attachments(bucketPath, key)
+}
+
+// GetAttachment writes the content of an attachment to w and verifies its hash
+func (db *DB) GetAttachment(bucketPath, key, name string, w io.Writer) (*Attachment, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	return tx.GetAttachment(bucketPath, key, name, w)
+}
+
+// OpenAttachment returns a reader of the content of an attachment, it has to be closed
+// since it keeps a read transaction open
+func (db *DB) OpenAttachment(bucketPath, key, name string) (*AttachmentReader, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	r, err := tx.OpenAttachment(bucketPath, key, name)
+	if err != nil {
+		tx.Close()
+		return nil, err
+	}
+	r.closeTx = true
+	return r, nil
+}
+
+// DeleteAttachment removes an attachment of a doc
+func (db *DB) DeleteAttachment(bucketPath, key, name string) error {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	if err = tx.DeleteAttachment(bucketPath, key, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
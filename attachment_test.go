@@ -0,0 +1,169 @@
+package boltplus
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func randomContent(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func TestPutGetAttachment(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.Put("files", "doc", Object{"title": "report"})
+	content := randomContent(3*AttachmentChunkSize + 100)
+	info, err := db.PutAttachment("files", "doc", "report.pdf", "application/pdf", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(content)
+	if info.Size != int64(len(content)) || info.SHA256 != hex.EncodeToString(hash[:]) || info.ContentType != "application/pdf" {
+		t.Errorf("unexpected attachment %+v", info)
+	}
+	var buf bytes.Buffer
+	if _, err = db.GetAttachment("files", "doc", "report.pdf", &buf); err != nil || !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("content differs (%v)", err)
+	}
+	// attachments are no docs
+	if keys := collectKeys(mustQuery(t, db, &Query{Bucket: "files"})); !reflect.DeepEqual(keys, []string{"doc"}) {
+		t.Errorf("wanted only the doc got %v", keys)
+	}
+	if buckets, _ := db.Buckets(); !reflect.DeepEqual(buckets, []string{"files"}) {
+		t.Errorf("wanted the attachments to be hidden got %v", buckets)
+	}
+	if _, err = db.PutAttachment("files", "missing", "a", "", bytes.NewReader(content)); err == nil {
+		t.Error("wanted an error for a missing doc")
+	}
+	if _, err = db.GetAttachment("files", "doc", "missing", &buf); err == nil {
+		t.Error("wanted an error for a missing attachment")
+	}
+}
+
+func TestAttachmentBatches(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.Put("files", "doc", Object{})
+	content := randomContent(attachmentBatchSize*AttachmentChunkSize + 1)
+	if _, err := db.PutAttachment("files", "doc", "big", "", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := db.GetAttachment("files", "doc", "big", &buf); err != nil || !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("content differs (%v)", err)
+	}
+}
+
+func TestAttachmentReaderSeek(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.Put("files", "doc", Object{})
+	content := randomContent(2*AttachmentChunkSize + 10)
+	db.PutAttachment("files", "doc", "blob", "", bytes.NewReader(content))
+	r, err := db.OpenAttachment("files", "doc", "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// a range across a chunk boundary
+	offset := int64(AttachmentChunkSize - 5)
+	if _, err = r.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	part := make([]byte, 20)
+	if _, err = io.ReadFull(r, part); err != nil || !bytes.Equal(part, content[offset:offset+20]) {
+		t.Errorf("wanted the range %v-%v (%v)", offset, offset+20, err)
+	}
+	r.Seek(-4, io.SeekEnd)
+	if rest, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(rest, content[len(content)-4:]) {
+		t.Errorf("wanted the last 4 bytes got %v (%v)", rest, err)
+	}
+}
+
+func TestReplaceDeleteAttachment(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.Put("files", "doc", Object{})
+	db.PutAttachment("files", "doc", "a", "text/plain", bytes.NewReader(randomContent(2*AttachmentChunkSize)))
+	db.PutAttachment("files", "doc", "a", "text/plain", bytes.NewReader([]byte("short")))
+	db.PutAttachment("files", "doc", "b", "", bytes.NewReader(nil))
+	var buf bytes.Buffer
+	if _, err := db.GetAttachment("files", "doc", "a", &buf); err != nil || buf.String() != "short" {
+		t.Errorf("wanted the replaced content got %q (%v)", buf.String(), err)
+	}
+	tx, _ := db.Tx(false)
+	bucket, _ := tx.attachmentBucket("files", "doc", "a", false)
+	if stats := bucket.Stats(); stats.BucketN != 2 {
+		t.Errorf("wanted the chunks of the old content to be removed, %v buckets left", stats.BucketN)
+	}
+	tx.Close()
+	attachments, err := db.Attachments("files", "doc")
+	if err != nil || len(attachments) != 2 || attachments[0].Name != "a" || attachments[1].Size != 0 {
+		t.Errorf("unexpected attachments %v (%v)", attachments, err)
+	}
+	if err = db.DeleteAttachment("files", "doc", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if attachments, _ = db.Attachments("files", "doc"); len(attachments) != 1 {
+		t.Errorf("wanted one attachment left got %v", attachments)
+	}
+	db.Delete("files", "doc")
+	db.Put("files", "doc", Object{})
+	if attachments, _ = db.Attachments("files", "doc"); len(attachments) != 0 {
+		t.Errorf("wanted the attachments to be deleted with the doc got %v", attachments)
+	}
+}
+
+func TestEncryptedAttachment(t *testing.T) {
+	skipInMemory(t)
+	db, err := setupEncryptedDB(StaticKeys{testKey("k1", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("files", "doc", Object{})
+	content := bytes.Repeat([]byte("secret "), 100)
+	db.PutAttachment("files", "doc", "a", "", bytes.NewReader(content))
+	db.Close()
+	raw, _ := ioutil.ReadFile("./test.db")
+	if bytes.Contains(raw, []byte("secret secret")) {
+		t.Error("attachment is stored in plain text")
+	}
+	db, _ = NewWithOptions("./test.db", testOptions(&Options{Keys: StaticKeys{testKey("k1", 1)}}))
+	var buf bytes.Buffer
+	if _, err = db.GetAttachment("files", "doc", "a", &buf); err != nil || !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("content differs (%v)", err)
+	}
+}
+
+func TestReplicateAttachment(t *testing.T) {
+	primary, replica := setupLoggedDB(t)
+	defer primary.Close()
+	defer replica.Close()
+	defer os.Remove("./replica.db")
+	primary.Put("files", "doc", Object{})
+	content := randomContent(AttachmentChunkSize + 1)
+	primary.PutAttachment("files", "doc", "a", "", bytes.NewReader(content))
+	primary.PutAttachment("files", "doc", "b", "", bytes.NewReader(content))
+	primary.DeleteAttachment("files", "doc", "b")
+	if _, err := replica.ApplyLog(readLog(t, primary, 0)); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := replica.GetAttachment("files", "doc", "a", &buf); err != nil || !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("content differs (%v)", err)
+	}
+	if _, err := replica.Attachment("files", "doc", "b"); err == nil {
+		t.Error("wanted the deleted attachment to be missing")
+	}
+}
@@ -0,0 +1,212 @@
+package boltplus
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Backend selects the storage engine of a database
+type Backend string
+
+// Supported backends
+const (
+	// BackendBolt stores the database in a bolt file using bbolt, it is the default. Files written by
+	// github.com/boltdb/bolt have the same format and are opened as they are.
+	BackendBolt Backend = "bolt"
+	// BackendMemory keeps the database in memory with the transactional semantics of bolt: one writer at
+	// a time, readers see the state of the last commit before they started and rollbacks discard all changes.
+	// Nothing is written to the file, it is lost on Close. Backups are bolt files nevertheless.
+	BackendMemory Backend = "memory"
+)
+
+// BoltOptions tunes the bolt backend, the zero value are the defaults of bbolt
+type BoltOptions struct {
+	// FreelistType is FreelistArray or FreelistMap, the map is faster for large files with many free pages
+	FreelistType FreelistType
+	// NoFreelistSync does not write the freelist, writes are faster but opening the file scans all pages
+	NoFreelistSync bool
+	// PreLoadFreelist reads the freelist when opening instead of on the first write
+	PreLoadFreelist bool
+	// NoSync skips fsync on commit, a crash can lose the last commits
+	NoSync bool
+	// NoGrowSync skips syncing the file size when it grows
+	NoGrowSync bool
+	// InitialMmapSize avoids remapping, which waits for the read transactions, until the file reaches it
+	InitialMmapSize int
+	// PageSize of new files, 0 is the page size of the OS
+	PageSize int
+	// Mlock locks the file in memory
+	Mlock bool
+	// Timeout limits the wait for the file lock, 0 waits forever
+	Timeout time.Duration
+}
+
+// FreelistType is the data structure bolt keeps the free pages in
+type FreelistType string
+
+// Supported freelist types
+const (
+	FreelistArray FreelistType = FreelistType(bolt.FreelistArrayType)
+	FreelistMap   FreelistType = FreelistType(bolt.FreelistMapType)
+)
+
+func (o *BoltOptions) bolt() *bolt.Options {
+	if o == nil {
+		return nil
+	}
+	return &bolt.Options{
+		FreelistType:    bolt.FreelistType(o.FreelistType),
+		NoFreelistSync:  o.NoFreelistSync,
+		PreLoadFreelist: o.PreLoadFreelist,
+		NoSync:          o.NoSync,
+		NoGrowSync:      o.NoGrowSync,
+		InitialMmapSize: o.InitialMmapSize,
+		PageSize:        o.PageSize,
+		Mlock:           o.Mlock,
+		Timeout:         o.Timeout,
+	}
+}
+
+// backend is the storage engine of a database, it follows the bolt API
+type backend interface {
+	Begin(writable bool) (backendTx, error)
+	Close() error
+}
+
+// backendTx is a transaction of a backend, its top level buckets can not hold values
+type backendTx interface {
+	Bucket(name []byte) backendBucket
+	CreateBucketIfNotExists(name []byte) (backendBucket, error)
+	DeleteBucket(name []byte) error
+	ForEach(fn func(name []byte, bucket backendBucket) error) error
+	Writable() bool
+	// Size is the size of the database
+	Size() int64
+	// WriteTo writes the database as bolt file
+	WriteTo(w io.Writer) (int64, error)
+	Commit() error
+	Rollback() error
+}
+
+// backendBucket is a bucket of key value pairs and sub-buckets ordered by key. Sub-buckets have a nil value.
+type backendBucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	Bucket(name []byte) backendBucket
+	CreateBucketIfNotExists(name []byte) (backendBucket, error)
+	DeleteBucket(name []byte) error
+	ForEach(fn func(k, v []byte) error) error
+	Cursor() backendCursor
+	Sequence() uint64
+	SetSequence(v uint64) error
+	NextSequence() (uint64, error)
+	Stats() bucketStats
+}
+
+// backendCursor iterates over a bucket, a nil key marks the end
+type backendCursor interface {
+	First() (key, value []byte)
+	Last() (key, value []byte)
+	Next() (key, value []byte)
+	Prev() (key, value []byte)
+	Seek(seek []byte) (key, value []byte)
+	Delete() error
+}
+
+// bucketStats counts the keys and buckets of a bucket including its sub-buckets and itself
+type bucketStats struct {
+	KeyN    int
+	BucketN int
+}
+
+func openBackend(kind Backend, filename string, opts *BoltOptions) (backend, error) {
+	switch kind {
+	case "", BackendBolt:
+		db, err := bolt.Open(filename, 0600, opts.bolt())
+		if err != nil {
+			return nil, err
+		}
+		return &boltBackend{db}, nil
+	case BackendMemory:
+		return newMemoryBackend(), nil
+	}
+	return nil, fmt.Errorf("unknown backend %v", kind)
+}
+
+type boltBackend struct {
+	db *bolt.DB
+}
+
+func (b *boltBackend) Begin(writable bool) (backendTx, error) {
+	tx, err := b.db.Begin(writable)
+	if err != nil {
+		return nil, err
+	}
+	return &boltTx{tx}, nil
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
+
+type boltTx struct {
+	*bolt.Tx
+}
+
+func (t *boltTx) Bucket(name []byte) backendBucket {
+	return wrapBoltBucket(t.Tx.Bucket(name))
+}
+
+func (t *boltTx) CreateBucketIfNotExists(name []byte) (backendBucket, error) {
+	bucket, err := t.Tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return &boltBucket{bucket}, nil
+}
+
+func (t *boltTx) ForEach(fn func(name []byte, bucket backendBucket) error) error {
+	return t.Tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+		return fn(name, &boltBucket{bucket})
+	})
+}
+
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+// wrapBoltBucket keeps missing buckets nil interfaces
+func wrapBoltBucket(bucket *bolt.Bucket) backendBucket {
+	if bucket == nil {
+		return nil
+	}
+	return &boltBucket{bucket}
+}
+
+func (b *boltBucket) Get(key []byte) []byte                    { return b.b.Get(key) }
+func (b *boltBucket) Put(key, value []byte) error              { return b.b.Put(key, value) }
+func (b *boltBucket) Delete(key []byte) error                  { return b.b.Delete(key) }
+func (b *boltBucket) Bucket(name []byte) backendBucket         { return wrapBoltBucket(b.b.Bucket(name)) }
+func (b *boltBucket) DeleteBucket(name []byte) error           { return b.b.DeleteBucket(name) }
+func (b *boltBucket) ForEach(fn func(k, v []byte) error) error { return b.b.ForEach(fn) }
+func (b *boltBucket) Cursor() backendCursor                    { return b.b.Cursor() }
+func (b *boltBucket) Sequence() uint64                         { return b.b.Sequence() }
+func (b *boltBucket) SetSequence(v uint64) error               { return b.b.SetSequence(v) }
+func (b *boltBucket) NextSequence() (uint64, error)            { return b.b.NextSequence() }
+
+func (b *boltBucket) CreateBucketIfNotExists(name []byte) (backendBucket, error) {
+	bucket, err := b.b.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return &boltBucket{bucket}, nil
+}
+
+func (b *boltBucket) Stats() bucketStats {
+	stats := b.b.Stats()
+	return bucketStats{stats.KeyN, stats.BucketN}
+}
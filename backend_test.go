@@ -0,0 +1,195 @@
+package boltplus
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func forEachBackend(t *testing.T, fn func(t *testing.T, db *DB)) {
+	for _, backend := range []Backend{BackendBolt, BackendMemory} {
+		t.Run(string(backend), func(t *testing.T) {
+			os.Remove("./test.db")
+			db, err := NewWithOptions("./test.db", &Options{Backend: backend})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			fn(t, db)
+		})
+	}
+}
+
+func TestBackendRollback(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.Put("a", "1", Object{"n": 1.})
+		tx, _ := db.Tx(true)
+		tx.Put("a", "1", Object{"n": 2.})
+		tx.Put("a", "2", Object{"n": 2.})
+		tx.Put("b", "1", Object{})
+		tx.Delete("a", "1")
+		tx.Rollback()
+		if doc, err := db.Get("a", "1"); err != nil || doc["n"] != 1. {
+			t.Errorf("wanted the committed doc got %v (%v)", doc, err)
+		}
+		if _, err := db.Get("b", "1"); err == nil {
+			t.Error("wanted the new bucket to be discarded")
+		}
+	})
+}
+
+func TestBackendSnapshotIsolation(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		putN(db, 10)
+		reader, _ := db.Tx(false)
+		defer reader.Close()
+		writer, _ := db.Tx(true)
+		writer.Put("test.bucket", "0", Object{"key": "changed"})
+		writer.Delete("test.bucket", "1")
+		if doc, _ := reader.Get("test.bucket", "0"); doc["key"] != 0. {
+			t.Errorf("uncommitted change is visible: %v", doc)
+		}
+		writer.Commit()
+		if doc, _ := reader.Get("test.bucket", "0"); doc["key"] != 0. {
+			t.Errorf("change committed after the read began is visible: %v", doc)
+		}
+		if n, _ := reader.Count("test.bucket"); n != 10 {
+			t.Errorf("wanted 10 docs in the snapshot got %v", n)
+		}
+		if n, _ := db.Count("test.bucket"); n != 9 {
+			t.Errorf("wanted 9 docs after the commit got %v", n)
+		}
+	})
+}
+
+func TestBackendBuckets(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		tx, _ := db.Tx(true)
+		defer tx.Close()
+		root, _ := tx.tx.CreateBucketIfNotExists([]byte("root"))
+		sub, _ := root.CreateBucketIfNotExists([]byte("sub"))
+		for _, k := range []string{"c", "a", "b"} {
+			if err := root.Put([]byte(k), []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sub.Put([]byte("x"), []byte{})
+		if err := root.Put([]byte("sub"), []byte("v")); err == nil {
+			t.Error("wanted an error for a value replacing a bucket")
+		}
+		if v := sub.Get([]byte("x")); v == nil || len(v) != 0 {
+			t.Errorf("wanted an empty value got %v", v)
+		}
+		var keys []string
+		c := root.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if v == nil {
+				k = append([]byte("/"), k...)
+			}
+			keys = append(keys, string(k))
+		}
+		if expect := []string{"/sub", "c", "b", "a"}; !reflect.DeepEqual(keys, expect) {
+			t.Errorf("wanted %v got %v", expect, keys)
+		}
+		if k, _ := c.Seek([]byte("bb")); !bytes.Equal(k, []byte("c")) {
+			t.Errorf("wanted seek to stop at c got %s", k)
+		}
+		if seq, _ := sub.NextSequence(); seq != 1 {
+			t.Errorf("wanted sequence 1 got %v", seq)
+		}
+		if err := root.DeleteBucket([]byte("sub")); err != nil {
+			t.Fatal(err)
+		}
+		if root.Bucket([]byte("sub")) != nil {
+			t.Error("wanted the bucket to be deleted")
+		}
+	})
+}
+
+func TestBackendReadOnly(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		putN(db, 1)
+		tx, _ := db.Tx(false)
+		defer tx.Close()
+		if err := tx.Put("test.bucket", "1", Object{}); err == nil {
+			t.Error("wanted an error writing in a read transaction")
+		}
+	})
+}
+
+// parallel query workers share the buckets of a read transaction, run with -race
+func TestBackendParallelReads(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		putN(db, 10)
+		tx, _ := db.Tx(false)
+		defer tx.Close()
+		bucket, err := tx.getBucket("test.bucket")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if bucket.Get([]byte("1")) == nil {
+					t.Error("wanted doc 1")
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestMemoryBackendBackup(t *testing.T) {
+	db, _ := NewWithOptions("./test.db", &Options{Backend: BackendMemory})
+	defer db.Close()
+	defer os.Remove("./backup.db")
+	putN(db, 100)
+	f, _ := os.Create("./backup.db")
+	if err := db.Backup(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	backup, err := New("./backup.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := backup.Get("test.bucket", "99"); err != nil || doc["key"] != 99. {
+		t.Errorf("wanted doc 99 in the bolt file got %v (%v)", doc, err)
+	}
+	backup.Close()
+	db.Delete("test.bucket", "99")
+	f, _ = os.Open("./backup.db")
+	defer f.Close()
+	if err = db.Restore(f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Get("test.bucket", "99"); err != nil {
+		t.Errorf("wanted the restored doc (%v)", err)
+	}
+}
+
+func TestBoltOptions(t *testing.T) {
+	os.Remove("./test.db")
+	opts := &Options{Bolt: &BoltOptions{FreelistType: FreelistMap, NoFreelistSync: true, PageSize: 8192}}
+	db, err := NewWithOptions("./test.db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putN(db, 100)
+	db.Close()
+	db, err = NewWithOptions("./test.db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n, err := db.Count("test.bucket"); err != nil || n != 100 {
+		t.Errorf("wanted 100 docs got %v (%v)", n, err)
+	}
+	if size := db.db.(*boltBackend).db.Info().PageSize; size != 8192 {
+		t.Errorf("wanted page size 8192 got %v", size)
+	}
+}
@@ -52,3 +52,31 @@ func BenchmarkPut100Tx(b *testing.B)    { benchmarkPutNTx(100, b) }
 func BenchmarkPut1000Tx(b *testing.B)   { benchmarkPutNTx(1000, b) }
 func BenchmarkPut10000Tx(b *testing.B)  { benchmarkPutNTx(10000, b) }
 func BenchmarkPut100000Tx(b *testing.B) { benchmarkPutNTx(100000, b) }
+
+func benchmarkFind(num, workers int, b *testing.B) {
+	db, err := setupCleanDB()
+	if err != nil {
+		b.Error(err)
+	}
+	defer db.Close()
+	tx, _ := db.Tx(true)
+	for i := 0; i < num; i++ {
+		tx.Put("foo", strconv.Itoa(i), Object{"a": i, "b": "some text to decode"})
+	}
+	if err = tx.Commit(); err != nil {
+		b.Error(err)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ch, err := db.Query(&Query{Bucket: "foo", Filter: ".a >= 5000", Workers: workers})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for range ch {
+		}
+	}
+}
+
+func BenchmarkFind10000(b *testing.B)          { benchmarkFind(10000, 1, b) }
+func BenchmarkFind10000Parallel4(b *testing.B) { benchmarkFind(10000, 4, b) }
+func BenchmarkFind10000Parallel8(b *testing.B) { benchmarkFind(10000, 8, b) }
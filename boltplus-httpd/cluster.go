@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/trusch/boltplus"
+)
+
+// clusterBucket keeps the members of the cluster, it is replicated like any other bucket
+const clusterBucket = "_cluster"
+
+// forwardedHeader marks requests forwarded to the leader, they are never forwarded twice
+const forwardedHeader = "X-Boltplus-Forwarded"
+
+const applyTimeout = 10 * time.Second
+
+// command is a write proposed through the raft log. It carries the log entries recorded on the leader,
+// so hooks and validation run once there and every node applies the same docs.
+type command struct {
+	Entries []*boltplus.LogEntry `json:"entries"`
+}
+
+// member is a node of the cluster as stored in the cluster bucket
+type member struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raftAddr"`
+	HTTPAddr string `json:"httpAddr"`
+}
+
+// cluster runs a raft node whose fsm is the db. Writes are proposed on the leader, followers forward
+// them there. Reads are served from the local db and may be slightly stale on followers.
+// Hooks run once on the leader when a write is proposed.
+type cluster struct {
+	raft *raft.Raft
+	self member
+	// proposeMu serializes proposals, so every write is recorded on the state the previous one left
+	proposeMu sync.Mutex
+}
+
+func newCluster(id, raftAddr, httpAddr, dir string) (*cluster, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(id)
+	tcpAddr, err := net.ResolveTCPAddr("tcp", raftAddr)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(raftAddr, tcpAddr, 3, applyTimeout, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+	r, err := raft.NewRaft(conf, &fsm{}, store, store, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+	return &cluster{raft: r, self: member{id, raftAddr, httpAddr}}, nil
+}
+
+// bootstrap starts a new cluster consisting of this node
+func (c *cluster) bootstrap() error {
+	err := c.raft.BootstrapCluster(raft.Configuration{Servers: []raft.Server{
+		{ID: raft.ServerID(c.self.ID), Address: raft.ServerAddress(c.self.RaftAddr)},
+	}}).Error()
+	if err != nil && err != raft.ErrCantBootstrap {
+		return err
+	}
+	go func() {
+		for c.raft.State() != raft.Leader {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err := c.addMember(&c.self); err != nil {
+			log.Print("registering bootstrap node: ", err)
+		}
+	}()
+	return nil
+}
+
+// join asks a node of an existing cluster to add this node, retrying until it succeeds
+func (c *cluster) join(nodeURL string) {
+	body, _ := json.Marshal(c.self)
+	for {
+		req, _ := http.NewRequest(http.MethodPost, strings.TrimRight(nodeURL, "/")+"/cluster/join", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+*adminToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			msg, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				log.Printf("joined cluster via %v", nodeURL)
+				return
+			}
+			err = fmt.Errorf("%v: %s", resp.Status, bytes.TrimSpace(msg))
+		}
+		log.Print("joining cluster: ", err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (c *cluster) addMember(m *member) error {
+	if err := c.raft.AddVoter(raft.ServerID(m.ID), raft.ServerAddress(m.RaftAddr), 0, applyTimeout).Error(); err != nil {
+		return err
+	}
+	value := map[string]interface{}{"id": m.ID, "raftAddr": m.RaftAddr, "httpAddr": m.HTTPAddr}
+	return c.propose(func(tx *boltplus.Transaction) error {
+		return tx.Put(clusterBucket, m.ID, value)
+	})
+}
+
+func (c *cluster) removeMember(id string) error {
+	if err := c.raft.RemoveServer(raft.ServerID(id), 0, applyTimeout).Error(); err != nil {
+		return err
+	}
+	return c.propose(func(tx *boltplus.Transaction) error {
+		return tx.Delete(clusterBucket, id)
+	})
+}
+
+// propose records the writes of fn, running the hooks, and waits until the leader applied them.
+// The next proposal is recorded only then, otherwise hooks reading docs would miss the pending writes.
+func (c *cluster) propose(fn func(tx *boltplus.Transaction) error) error {
+	c.proposeMu.Lock()
+	defer c.proposeMu.Unlock()
+	entries, err := db.Record(fn)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	bs, err := json.Marshal(&command{entries})
+	if err != nil {
+		return err
+	}
+	future := c.raft.Apply(bs, applyTimeout)
+	if err = future.Error(); err != nil {
+		return err
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (c *cluster) isLeader() bool {
+	return c.raft.State() == raft.Leader
+}
+
+// forward proxies a request to the leader
+func (c *cluster) forward(w http.ResponseWriter, req *http.Request) {
+	_, leaderID := c.raft.LeaderWithID()
+	if leaderID == "" || req.Header.Get(forwardedHeader) != "" {
+		http.Error(w, "no leader available", http.StatusServiceUnavailable)
+		return
+	}
+	doc, err := db.Get(clusterBucket, string(leaderID))
+	httpAddr, _ := doc["httpAddr"].(string)
+	if err != nil || httpAddr == "" {
+		http.Error(w, "leader address unknown", http.StatusServiceUnavailable)
+		return
+	}
+	target, err := url.Parse(httpAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set(forwardedHeader, c.self.ID)
+	httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, req)
+}
+
+// fsm applies the commands of the raft log to the db
+type fsm struct{}
+
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	cmd := &command{}
+	if err := json.Unmarshal(l.Data, cmd); err != nil {
+		return err
+	}
+	// the entries were recorded with hooks on the leader, applying them is deterministic
+	if err := db.ApplyEntries(cmd.Entries); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Snapshot opens a read transaction right away, so the snapshot matches the applied log index
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	return &fsmSnapshot{tx}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	return db.Restore(rc)
+}
+
+type fsmSnapshot struct {
+	tx *boltplus.Transaction
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.tx.Backup(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {
+	s.tx.Close()
+}
+
+// clusterStatus is reported by GET /cluster
+type clusterStatus struct {
+	ID      string    `json:"id"`
+	State   string    `json:"state"`
+	Leader  string    `json:"leader"`
+	Members []*member `json:"members"`
+}
+
+func handleCluster(action string, req *http.Request, w http.ResponseWriter) {
+	if node == nil {
+		http.Error(w, "not running in cluster mode, start with -raft-addr", http.StatusNotFound)
+		return
+	}
+	if action == "" {
+		handleClusterStatus(w)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(req) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if !node.isLeader() {
+		node.forward(w, req)
+		return
+	}
+	m := &member{}
+	if err := json.NewDecoder(req.Body).Decode(m); err != nil || m.ID == "" {
+		http.Error(w, "malformed member", http.StatusBadRequest)
+		return
+	}
+	var err error
+	switch action {
+	case "join":
+		if m.RaftAddr == "" || m.HTTPAddr == "" {
+			err = errors.New("raftAddr and httpAddr are required")
+		} else {
+			err = node.addMember(m)
+		}
+	case "leave":
+		err = node.removeMember(m.ID)
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleClusterStatus(w http.ResponseWriter) {
+	_, leader := node.raft.LeaderWithID()
+	status := &clusterStatus{ID: node.self.ID, State: node.raft.State().String(), Leader: string(leader), Members: []*member{}}
+	if ch, err := db.GetAll(clusterBucket); err == nil {
+		for pair := range ch {
+			bs, _ := json.Marshal(pair.Value)
+			m := &member{}
+			json.Unmarshal(bs, m)
+			status.Members = append(status.Members, m)
+		}
+	}
+	bs, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
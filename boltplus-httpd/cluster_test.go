@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/trusch/boltplus"
+)
+
+// the flags are parsed and the db is opened in init, the test flags have to be registered before
+var testDBPath = func() string {
+	testing.Init()
+	*dbPath = filepath.Join(os.TempDir(), "boltplus-httpd-test.db")
+	return *dbPath
+}()
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	db.Close()
+	os.Remove(testDBPath)
+	os.Exit(code)
+}
+
+func newTestCluster(t *testing.T) *cluster {
+	conf := raft.DefaultConfig()
+	conf.LocalID = "test"
+	conf.LogOutput = ioutil.Discard
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	store := raft.NewInmemStore()
+	addr, transport := raft.NewInmemTransport("")
+	r, err := raft.NewRaft(conf, &fsm{}, store, store, raft.NewInmemSnapshotStore(), transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.BootstrapCluster(raft.Configuration{Servers: []raft.Server{{ID: conf.LocalID, Address: addr}}}).Error()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); r.State() != raft.Leader; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader elected")
+		}
+	}
+	return &cluster{raft: r, self: member{ID: "test", RaftAddr: string(addr)}}
+}
+
+func TestConcurrentProposals(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "boltplus-httpd")
+	defer os.RemoveAll(dir)
+	d, err := boltplus.New(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	initial := db
+	db = d
+	defer func() { db = initial }()
+	// the hook counts the writes by reading the stored doc, it loses updates if proposals overlap
+	db.BeforePut("counter", func(tx *boltplus.Transaction, bucketPath, key string, doc map[string]interface{}) error {
+		prev, _ := tx.Get(bucketPath, key)
+		n, _ := prev["n"].(float64)
+		doc["n"] = n + 1
+		return nil
+	})
+	c := newTestCluster(t)
+	defer c.raft.Shutdown()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := c.propose(func(tx *boltplus.Transaction) error {
+				return tx.Put("counter", "c", map[string]interface{}{})
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if doc, err := db.Get("counter", "c"); err != nil || doc["n"] != 20. {
+		t.Errorf("wanted n = 20 got %v (%v)", doc, err)
+	}
+}
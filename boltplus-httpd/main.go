@@ -1,33 +1,71 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/trusch/boltplus"
+	"github.com/trusch/boltplus/celfilter"
+	"github.com/trusch/boltplus/jqtransform"
 )
 
 var addr = flag.String("addr", ":8080", "address to bind to")
+var adminToken = flag.String("admin-token", "", "bearer token required for admin endpoints like /restore (they are disabled without it)")
 var dbPath = flag.String("db", "default.db", "db to use")
+var keysFile = flag.String("keys-file", "", "file with encryption keys, one '<id> <base64 key>' per line, the first one is used for writing")
+var keysEnv = flag.String("keys-env", "", "environment variable with encryption keys formatted as '<id>:<base64 key>,...', the first one is used for writing")
+var oplog = flag.Bool("oplog", false, "keep an operation log, required for serving replicas")
+var replicaOf = flag.String("replica-of", "", "run as read-only replica of the boltplus-httpd primary at this URL, e.g. http://primary:8080")
+var replicaInterval = flag.Duration("replica-interval", time.Second, "how often a caught up replica polls the primary")
+var raftAddr = flag.String("raft-addr", "", "address for raft traffic, enables the clustered mode, e.g. 127.0.0.1:7000")
+var raftDir = flag.String("raft-dir", "raft", "directory for the raft log and snapshots")
+var nodeID = flag.String("node-id", "", "unique id of this node in the cluster (default the raft address)")
+var advertise = flag.String("advertise", "", "http URL other cluster nodes use to reach this node (default http://localhost<addr>)")
+var bootstrap = flag.Bool("bootstrap", false, "bootstrap a new cluster with this node as the only member")
+var join = flag.String("join", "", "http URL of a node of the cluster to join, requires -admin-token")
+var celCostLimit = flag.Uint64("cel-cost-limit", celfilter.DefaultCostLimit, "maximum evaluation cost of a cel filter per doc")
+var jqTimeout = flag.Duration("jq-timeout", jqtransform.DefaultTimeout, "maximum evaluation time of a jq transform per doc")
+var maxRestoreSize = flag.Int64("max-restore-size", 1<<30, "maximum size in bytes of a backup uploaded to /restore")
+var stampUpdated = flag.String("stamp-updated", "", "comma separated bucket patterns (e.g. users.*) whose docs get an updatedAt timestamp on every write")
 
 var db *boltplus.DB
+var metrics = boltplus.NewPrometheusMetrics()
+var replica *replicator
+var node *cluster
 
 func init() {
 	flag.Parse()
-	d, err := boltplus.New(*dbPath)
+	d, err := boltplus.NewWithOptions(*dbPath, dbOptions())
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err = boltplus.RegisterStandardHooks(d, *stampUpdated); err != nil {
+		log.Fatal(err)
+	}
 	db = d
 }
 
 // URL schema:
 // PUT GET DELETE /foo/bar/baz
 //   -> use doc with key baz in bucket foo.bar for single doc manipulation
+//      docs violating the schema of the bucket are rejected with 422 and a list of violations,
+//      any JSON value is accepted and bodies with Content-Type application/octet-stream are stored raw
+// PUT GET DELETE /foo/bar/baz/_attachments/name
+//   -> store, download (with Range support) or delete the attachment name of doc baz in bucket foo.bar,
+//      uploads keep their Content-Type
+// GET /foo/bar/baz/_attachments
+//   -> the attachments of doc baz as JSON array
 // GET /prefix?bucket=foo.bar&prefix=baz
 //   -> get all docs with key prefix baz in bucket foo.bar
 // GET /range?bucket=foo.bar&start=baz&end=qux
@@ -38,48 +76,154 @@ func init() {
 //   -> get all docs with key a equal foo in bucket foo.bar
 // GET /findRange?bucket=foo.bar&filter=".a == 'foo'"&start=baz&end=qux
 //   -> get all docs with key a equal foo in bucket foo.bar
+// GET /find?bucket=orders&lookup=customer:customers&filter=".customer.city == 'Berlin'"
+//   -> replace the key in the field customer of each order with the doc of bucket customers,
+//      lookup=localField:fromBucket[:as] may be repeated and works with findPrefix and findRange as well
+// POST /find?bucket=foo.bar {"age": {"$gt": 30}, "$or": [{"tags": "a"}, {"address.city": "Berlin"}]}
+//   -> get all docs matching a MongoDB style query document, also on findPrefix and findRange
+// GET /find?bucket=foo.bar&cel=doc.age+>+30+%26%26+key.startsWith("user-")
+//   -> get all docs matching a CEL expression, also on findPrefix and findRange
+// GET /all?bucket=foo.bar&transform={name,+id:+$key}
+//   -> reshape every returned doc with a jq expression, works with all queries above
+// GET /keys?bucket=foo.bar&prefix=baz&limit=10&reverse=true
+//   -> the keys of the docs in bucket foo.bar as JSON array, optionally with a prefix or start and end
+// GET /count?bucket=foo.bar&prefix=baz
+//   -> {"count": 42}, takes prefix or start and end, filter, cel or a query document like find
+// GET /search?bucket=foo.bar&q=some+words&limit=10
+//   -> full-text search the docs in bucket foo.bar, best matches first
+// GET /near?bucket=foo.bar&lat=52.52&lon=13.4&radius=1000
+//   -> get all docs in bucket foo.bar within 1000 meters of the point, nearest first (needs a geo index)
+// GET /within?bucket=foo.bar&bbox=52,13,53,14
+//   -> get all docs in bucket foo.bar inside the box minLat,minLon,maxLat,maxLon, nearest to its center first
+// GET /export?bucket=foo.bar&format=ndjson
+//   -> export all docs of bucket foo.bar and its sub-buckets (formats: ndjson, json, csv)
+// POST /import?bucket=foo.bar&format=ndjson
+//   -> import the docs in the request body into bucket foo.bar
+// GET /backup
+//   -> download a hot backup of the database
+// POST /restore (requires "Authorization: Bearer <admin-token>")
+//   -> verify the backup in the request body (at most -max-restore-size bytes) and replace the database with it
+// GET /metrics
+//   -> database and request metrics in the Prometheus text format
+// GET /log?from=42&limit=1000
+//   -> the operation log entries after sequence number 42 as NDJSON (requires -oplog)
+// GET /replication
+//   -> the replication state, on replicas including the lag behind the primary
+//
+// GET /cluster
+//   -> the raft state of this node, the leader and the members of the cluster
+// POST /cluster/join {"id": "n2", "raftAddr": "127.0.0.1:7001", "httpAddr": "http://localhost:8081"}
+// POST /cluster/leave {"id": "n2"}
+//   -> add or remove a cluster member (requires the admin token)
+//
+// Replicas (-replica-of) reject all requests except GET, HEAD and find queries.
+// In the clustered mode (-raft-addr) followers forward writes to the leader.
 func defaultHandler(w http.ResponseWriter, req *http.Request) {
 	if req.URL.String() == "/favicon.ico" {
 		http.NotFound(w, req)
 		return
 	}
+	if replica != nil && isWrite(req) {
+		http.Error(w, "read-only replica, write to "+replica.primary, http.StatusForbidden)
+		return
+	}
 	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
 	query := req.URL.Query()
+	if node != nil && isWrite(req) && parts[0] != "cluster" && !node.isLeader() {
+		node.forward(w, req)
+		return
+	}
 	switch parts[0] {
 	case "all":
 		{
-			handleAll(query.Get("bucket"), w)
+			handleQuery(&boltplus.Query{Bucket: query.Get("bucket")}, req, w)
 		}
 	case "prefix":
 		{
-			handlePrefix(query.Get("bucket"), query.Get("prefix"), w)
+			handleQuery(&boltplus.Query{Bucket: query.Get("bucket"), Prefix: query.Get("prefix")}, req, w)
 		}
 	case "range":
 		{
-			handleRange(query.Get("bucket"), query.Get("start"), query.Get("end"), w)
+			handleQuery(&boltplus.Query{Bucket: query.Get("bucket"), Start: query.Get("start"), End: query.Get("end")}, req, w)
 		}
 	case "find":
 		{
-			handleFind(query.Get("bucket"), query.Get("filter"), w)
+			handleQuery(&boltplus.Query{Bucket: query.Get("bucket"), Filter: query.Get("filter")}, req, w)
 		}
 	case "findPrefix":
 		{
-			handleFindPrefix(query.Get("bucket"), query.Get("prefix"), query.Get("filter"), w)
+			handleQuery(&boltplus.Query{Bucket: query.Get("bucket"), Prefix: query.Get("prefix"), Filter: query.Get("filter")}, req, w)
 		}
 	case "findRange":
 		{
-			handleFindRange(query.Get("bucket"), query.Get("start"), query.Get("end"), query.Get("filter"), w)
+			handleQuery(&boltplus.Query{Bucket: query.Get("bucket"), Start: query.Get("start"), End: query.Get("end"), Filter: query.Get("filter")}, req, w)
+		}
+	case "keys":
+		{
+			handleKeys(query, w)
+		}
+	case "count":
+		{
+			handleCount(&boltplus.Query{Bucket: query.Get("bucket"), Prefix: query.Get("prefix"), Start: query.Get("start"), End: query.Get("end"), Filter: query.Get("filter")}, req, w)
+		}
+	case "search":
+		{
+			handleSearch(query.Get("bucket"), query.Get("q"), query.Get("limit"), w)
+		}
+	case "near":
+		{
+			handleNear(query.Get("bucket"), query.Get("lat"), query.Get("lon"), query.Get("radius"), w)
+		}
+	case "within":
+		{
+			handleWithin(query.Get("bucket"), query.Get("bbox"), w)
+		}
+	case "export":
+		{
+			handleExport(query.Get("bucket"), query.Get("format"), w)
+		}
+	case "import":
+		{
+			handleImport(query.Get("bucket"), query.Get("format"), req, w)
 		}
 	case "backup":
 		{
 			handleBackup(w)
 		}
+	case "restore":
+		{
+			handleRestore(req, w)
+		}
+	case "metrics":
+		{
+			handleMetrics(w)
+		}
+	case "log":
+		{
+			handleLog(query.Get("from"), query.Get("limit"), w)
+		}
+	case "replication":
+		{
+			handleReplication(w)
+		}
+	case "cluster":
+		{
+			handleCluster(strings.Join(parts[1:], "/"), req, w)
+		}
 	default:
 		{
 			if len(parts) < 2 {
 				http.Error(w, "malformed request", http.StatusBadRequest)
 				return
 			}
+			if n := len(parts); n >= 3 && parts[n-1] == "_attachments" {
+				handleAttachments(strings.Join(parts[0:n-2], "."), parts[n-2], w)
+				return
+			}
+			if n := len(parts); n >= 4 && parts[n-2] == "_attachments" {
+				handleAttachment(strings.Join(parts[0:n-3], "."), parts[n-3], parts[n-1], req, w)
+				return
+			}
 			handleDefaultRequest(strings.Join(parts[0:len(parts)-1], "."), parts[len(parts)-1], req, w)
 		}
 	}
@@ -89,18 +233,23 @@ func handleDefaultRequest(bucket, key string, req *http.Request, w http.Response
 	switch req.Method {
 	case http.MethodGet:
 		{
-			doc, err := db.Get(bucket, key)
+			value, err := db.GetValue(bucket, key)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusNotFound)
 				return
 			}
-			bs, _ := json.Marshal(doc)
+			if data, ok := value.([]byte); ok {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Write(data)
+				return
+			}
+			bs, _ := json.Marshal(value)
 			w.Header().Set("Content-Type", "application/json")
 			w.Write(bs)
 		}
 	case http.MethodDelete:
 		{
-			err := db.Delete(bucket, key)
+			err := deleteDoc(bucket, key)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
@@ -113,14 +262,14 @@ func handleDefaultRequest(bucket, key string, req *http.Request, w http.Response
 		fallthrough
 	case http.MethodPut:
 		{
-			var doc map[string]interface{}
-			decoder := json.NewDecoder(req.Body)
-			err := decoder.Decode(&doc)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+			err := putBody(bucket, key, req)
+			if validationErr, ok := err.(*boltplus.ValidationError); ok {
+				bs, _ := json.Marshal(validationErr)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write(bs)
 				return
 			}
-			err = db.Put(bucket, key, doc)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
@@ -130,53 +279,176 @@ func handleDefaultRequest(bucket, key string, req *http.Request, w http.Response
 	}
 }
 
-func handlePrefix(bucket, prefix string, w http.ResponseWriter) {
-	ch, err := db.GetPrefix(bucket, prefix)
+// handleAttachments lists the attachments of a doc
+func handleAttachments(bucket, key string, w http.ResponseWriter) {
+	attachments, err := db.Attachments(bucket, key)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	res := make([]*boltplus.Pair, 0, 64)
-	for pair := range ch {
-		res = append(res, pair)
-	}
-	bs, _ := json.Marshal(res)
+	bs, _ := json.Marshal(attachments)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(bs)
 }
 
-func handleRange(bucket, start, end string, w http.ResponseWriter) {
-	ch, err := db.GetRange(bucket, start, end)
+// handleAttachment streams an attachment with support for Range requests, uploads one or deletes it
+func handleAttachment(bucket, key, name string, req *http.Request, w http.ResponseWriter) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		r, err := db.OpenAttachment(bucket, key, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer r.Close()
+		if r.Info.ContentType != "" {
+			w.Header().Set("Content-Type", r.Info.ContentType)
+		}
+		w.Header().Set("ETag", `"`+r.Info.SHA256+`"`)
+		http.ServeContent(w, req, name, r.Info.Modified, r)
+	case http.MethodPut:
+		// the content is not proposed through the raft log, it may be hundreds of megabytes
+		if node != nil {
+			http.Error(w, "attachments are not supported in the clustered mode", http.StatusNotImplemented)
+			return
+		}
+		info, err := db.PutAttachment(bucket, key, name, req.Header.Get("Content-Type"), req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bs, _ := json.Marshal(info)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bs)
+	case http.MethodDelete:
+		if node != nil {
+			http.Error(w, "attachments are not supported in the clustered mode", http.StatusNotImplemented)
+			return
+		}
+		if err := db.DeleteAttachment(bucket, key, name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleQuery runs a query with the lookups, cel filter, query document and transform of the request
+func handleQuery(q *boltplus.Query, req *http.Request, w http.ResponseWriter) {
+	// prepared through the filter cache of the db, so repeated filters are compiled once
+	p, err := prepareQuery(q, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ch, err := db.ExecuteValues(p)
+	writeValues(ch, err, w)
+}
+
+// handleKeys lists the keys of a bucket, with a prefix or in a range
+func handleKeys(query url.Values, w http.ResponseWriter) {
+	opts := &boltplus.ScanOptions{Reverse: query.Get("reverse") == "true"}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		opts.Limit = n
+	}
+	bucket := query.Get("bucket")
+	var ch chan string
+	var err error
+	switch {
+	case query.Get("prefix") != "":
+		ch, err = db.KeysPrefix(bucket, query.Get("prefix"), opts)
+	case query.Get("start") != "" || query.Get("end") != "":
+		ch, err = db.KeysRange(bucket, query.Get("start"), query.Get("end"), opts)
+	default:
+		ch, err = db.Keys(bucket, opts)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	res := make([]*boltplus.Pair, 0, 64)
-	for pair := range ch {
-		res = append(res, pair)
+	res := make([]string, 0, 64)
+	for k := range ch {
+		res = append(res, k)
 	}
 	bs, _ := json.Marshal(res)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(bs)
 }
 
-func handleAll(bucket string, w http.ResponseWriter) {
-	ch, err := db.GetAll(bucket)
+// handleCount counts the docs a query would return
+func handleCount(q *boltplus.Query, req *http.Request, w http.ResponseWriter) {
+	if _, err := prepareQuery(q, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := db.CountQuery(q)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	res := make([]*boltplus.Pair, 0, 64)
-	for pair := range ch {
-		res = append(res, pair)
-	}
-	bs, _ := json.Marshal(res)
+	bs, _ := json.Marshal(map[string]int{"count": n})
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(bs)
 }
 
-func handleFind(bucket, filter string, w http.ResponseWriter) {
-	ch, err := db.Find(bucket, filter)
+// prepareQuery adds the lookups, cel filter, query document and transform of the request to a query
+func prepareQuery(q *boltplus.Query, req *http.Request) (*boltplus.PreparedQuery, error) {
+	params := req.URL.Query()
+	cel := params.Get("cel")
+	if cel != "" && req.Method == http.MethodPost {
+		return nil, errors.New("use either a cel filter or a query document")
+	}
+	if cel != "" {
+		f, err := celfilter.CompileWithOptions(cel, &celfilter.Options{CostLimit: *celCostLimit})
+		if err != nil {
+			return nil, err
+		}
+		q.Where = f
+	}
+	if req.Method == http.MethodPost {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		if q.Where, err = boltplus.ParseWhere(body); err != nil {
+			return nil, err
+		}
+	}
+	if transform := params.Get("transform"); transform != "" {
+		t, err := jqtransform.CompileWithOptions(transform, &jqtransform.Options{Timeout: *jqTimeout})
+		if err != nil {
+			return nil, err
+		}
+		q.Transform = t
+	}
+	for _, spec := range params["lookup"] {
+		l, err := boltplus.ParseLookup(spec)
+		if err != nil {
+			return nil, err
+		}
+		q.Lookups = append(q.Lookups, l)
+	}
+	return db.Prepare(q)
+}
+
+func handleSearch(bucket, q, limit string, w http.ResponseWriter) {
+	n := 0
+	if limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n = l
+	}
+	ch, err := db.Search(bucket, q, n)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -190,8 +462,27 @@ func handleFind(bucket, filter string, w http.ResponseWriter) {
 	w.Write(bs)
 }
 
-func handleFindRange(bucket, start, end, filter string, w http.ResponseWriter) {
-	ch, err := db.FindRange(bucket, start, end, filter)
+func handleNear(bucket, lat, lon, radius string, w http.ResponseWriter) {
+	values, err := parseFloats([]string{lat, lon, radius})
+	if err != nil {
+		http.Error(w, "lat, lon and radius must be numbers", http.StatusBadRequest)
+		return
+	}
+	ch, err := db.FindNear(bucket, values[0], values[1], values[2])
+	writePairs(ch, err, w)
+}
+
+func handleWithin(bucket, bbox string, w http.ResponseWriter) {
+	values, err := parseFloats(strings.Split(bbox, ","))
+	if err != nil || len(values) != 4 {
+		http.Error(w, "bbox must be minLat,minLon,maxLat,maxLon", http.StatusBadRequest)
+		return
+	}
+	ch, err := db.FindWithin(bucket, boltplus.BBox{MinLat: values[0], MinLon: values[1], MaxLat: values[2], MaxLon: values[3]})
+	writePairs(ch, err, w)
+}
+
+func writePairs(ch chan *boltplus.Pair, err error, w http.ResponseWriter) {
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -205,13 +496,13 @@ func handleFindRange(bucket, start, end, filter string, w http.ResponseWriter) {
 	w.Write(bs)
 }
 
-func handleFindPrefix(bucket, prefix, filter string, w http.ResponseWriter) {
-	ch, err := db.FindPrefix(bucket, prefix, filter)
+// writeValues writes the results of a query, they include values which are no objects
+func writeValues(ch chan *boltplus.ValuePair, err error, w http.ResponseWriter) {
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	res := make([]*boltplus.Pair, 0, 64)
+	res := make([]*boltplus.ValuePair, 0, 64)
 	for pair := range ch {
 		res = append(res, pair)
 	}
@@ -220,6 +511,57 @@ func handleFindPrefix(bucket, prefix, filter string, w http.ResponseWriter) {
 	w.Write(bs)
 }
 
+func parseFloats(strs []string) ([]float64, error) {
+	res := make([]float64, len(strs))
+	for i, str := range strs {
+		f, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = f
+	}
+	return res, nil
+}
+
+var exportContentTypes = map[boltplus.Format]string{
+	boltplus.FormatNDJSON: "application/x-ndjson",
+	boltplus.FormatJSON:   "application/json",
+	boltplus.FormatCSV:    "text/csv",
+}
+
+func handleExport(bucket, format string, w http.ResponseWriter) {
+	if format == "" {
+		format = string(boltplus.FormatNDJSON)
+	}
+	contentType, ok := exportContentTypes[boltplus.Format(format)]
+	if !ok {
+		http.Error(w, "unknown format", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if err := db.Export(bucket, w, boltplus.Format(format)); err != nil {
+		log.Print(err)
+	}
+}
+
+func handleImport(bucket, format string, req *http.Request, w http.ResponseWriter) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if format == "" {
+		format = string(boltplus.FormatNDJSON)
+	}
+	n, err := importDocs(bucket, req.Body, boltplus.Format(format))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("imported %v docs before failing: %v", n, err), http.StatusBadRequest)
+		return
+	}
+	bs, _ := json.Marshal(map[string]int{"imported": n})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
+
 func handleBackup(w http.ResponseWriter) {
 	size, err := db.Size()
 	if err != nil {
@@ -232,7 +574,200 @@ func handleBackup(w http.ResponseWriter) {
 	db.Backup(w)
 }
 
+func startCluster() {
+	id, httpAddr := *nodeID, *advertise
+	if id == "" {
+		id = *raftAddr
+	}
+	if httpAddr == "" {
+		httpAddr = "http://localhost" + *addr
+		if !strings.HasPrefix(*addr, ":") {
+			httpAddr = "http://" + *addr
+		}
+	}
+	c, err := newCluster(id, *raftAddr, httpAddr, *raftDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	node = c
+	if *bootstrap {
+		if err = node.bootstrap(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *join != "" {
+		go node.join(*join)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WriteTo(w)
+}
+
+// statusRecorder remembers the status code of a response for the request metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func instrument(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{w, http.StatusOK}
+		handler(rec, req)
+		labels := boltplus.Labels{"method": req.Method, "code": strconv.Itoa(rec.status)}
+		metrics.Add("boltplus_http_requests_total", labels, 1)
+		metrics.Observe("boltplus_http_request_duration_seconds", boltplus.Labels{"method": req.Method}, time.Since(start).Seconds())
+	}
+}
+
+func dbOptions() *boltplus.Options {
+	opts, err := boltplus.OptionsFromKeyFile(*keysFile, *keysEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.Metrics, opts.OpLog = metrics, *oplog
+	return opts
+}
+
+func handleRestore(req *http.Request, w http.ResponseWriter) {
+	if !isAdmin(req) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if node != nil {
+		http.Error(w, "restore is not supported in the clustered mode", http.StatusBadRequest)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := db.Restore(http.MaxBytesReader(w, req.Body, *maxRestoreSize)); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err == boltplus.ErrSwapTimeout {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// isWrite reports whether a request changes the db, find requests may POST their query document
+func isWrite(req *http.Request) bool {
+	if req.Method == http.MethodPost {
+		switch strings.Trim(req.URL.Path, "/") {
+		case "find", "findPrefix", "findRange", "count":
+			return false
+		}
+	}
+	return req.Method != http.MethodGet && req.Method != http.MethodHead
+}
+
+// putDoc writes a doc directly or through the raft log in the clustered mode
+func putDoc(bucket, key string, doc map[string]interface{}) error {
+	if node != nil {
+		return node.propose(func(tx *boltplus.Transaction) error {
+			return tx.Put(bucket, key, doc)
+		})
+	}
+	return db.Put(bucket, key, doc)
+}
+
+// putBody writes the JSON value of a request, application/octet-stream bodies are stored as raw values
+func putBody(bucket, key string, req *http.Request) error {
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/octet-stream") {
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		return putRaw(bucket, key, data)
+	}
+	var value interface{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	if doc, ok := value.(map[string]interface{}); ok {
+		return putDoc(bucket, key, doc)
+	}
+	return putValue(bucket, key, value)
+}
+
+// putValue writes a JSON value which is no object
+func putValue(bucket, key string, value interface{}) error {
+	if node != nil {
+		return node.propose(func(tx *boltplus.Transaction) error {
+			return tx.PutValue(bucket, key, value)
+		})
+	}
+	return db.PutValue(bucket, key, value)
+}
+
+func putRaw(bucket, key string, data []byte) error {
+	if node != nil {
+		return node.propose(func(tx *boltplus.Transaction) error {
+			return tx.PutRaw(bucket, key, data)
+		})
+	}
+	return db.PutRaw(bucket, key, data)
+}
+
+func deleteDoc(bucket, key string) error {
+	if node != nil {
+		return node.propose(func(tx *boltplus.Transaction) error {
+			return tx.Delete(bucket, key)
+		})
+	}
+	return db.Delete(bucket, key)
+}
+
+func importDocs(bucket string, r io.Reader, format boltplus.Format) (int, error) {
+	if node != nil {
+		n := 0
+		err := node.propose(func(tx *boltplus.Transaction) (err error) {
+			n, err = tx.Import(bucket, r, format)
+			return err
+		})
+		return n, err
+	}
+	return db.Import(bucket, r, format)
+}
+
+func isAdmin(req *http.Request) bool {
+	if *adminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) == 1
+}
+
 func main() {
-	http.HandleFunc("/", defaultHandler)
+	if *replicaOf != "" && *raftAddr != "" {
+		log.Fatal("-replica-of and -raft-addr can not be combined")
+	}
+	if *replicaOf != "" {
+		replica = newReplicator(*replicaOf)
+		go replica.run(*replicaInterval)
+	}
+	if *join != "" && *adminToken == "" {
+		log.Fatal("-join requires the -admin-token of the cluster")
+	}
+	if *raftAddr != "" {
+		startCluster()
+	}
+	http.HandleFunc("/", instrument(defaultHandler))
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
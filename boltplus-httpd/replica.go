@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trusch/boltplus"
+)
+
+// replicaBatchSize is the number of log entries a replica pulls and applies at once
+const replicaBatchSize = 1000
+
+// sequenceHeader carries the latest sequence number of the primary in /log responses
+const sequenceHeader = "X-Boltplus-Sequence"
+
+// replicationStatus is reported by /replication
+type replicationStatus struct {
+	Primary         string     `json:"primary,omitempty"`
+	Sequence        uint64     `json:"sequence"`
+	PrimarySequence uint64     `json:"primarySequence,omitempty"`
+	Lag             uint64     `json:"lag"`
+	LastContact     *time.Time `json:"lastContact,omitempty"`
+	Error           string     `json:"error,omitempty"`
+}
+
+// replicator pulls the log of a primary and applies it to the local database
+type replicator struct {
+	primary string
+	client  *http.Client
+	mu      sync.Mutex
+	status  replicationStatus
+}
+
+func newReplicator(primary string) *replicator {
+	primary = strings.TrimRight(primary, "/")
+	return &replicator{
+		primary: primary,
+		client:  &http.Client{Timeout: time.Minute},
+		status:  replicationStatus{Primary: primary},
+	}
+}
+
+// run pulls forever, it waits for the interval whenever the replica caught up or pulling failed
+func (r *replicator) run(interval time.Duration) {
+	if seq, err := db.LastSequence(); err == nil && seq == 0 {
+		r.report(r.bootstrap())
+	}
+	for {
+		n, err := r.pull()
+		r.report(err)
+		if n == 0 || err != nil {
+			time.Sleep(interval)
+		}
+	}
+}
+
+// bootstrap replaces the local database with a backup of the primary
+func (r *replicator) bootstrap() error {
+	log.Printf("restoring backup of %v", r.primary)
+	resp, err := r.client.Get(r.primary + "/backup")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching backup: %v", resp.Status)
+	}
+	return db.Restore(resp.Body)
+}
+
+// pull fetches and applies the next batch of log entries
+func (r *replicator) pull() (int, error) {
+	seq, err := db.LastSequence()
+	if err != nil {
+		return 0, err
+	}
+	resp, err := r.client.Get(fmt.Sprintf("%v/log?from=%v&limit=%v", r.primary, seq, replicaBatchSize))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return 0, r.bootstrap()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("fetching log: %v", resp.Status)
+	}
+	primarySeq, _ := strconv.ParseUint(resp.Header.Get(sequenceHeader), 10, 64)
+	r.mu.Lock()
+	r.status.PrimarySequence = primarySeq
+	r.mu.Unlock()
+	var entries []*boltplus.LogEntry
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		entry := &boltplus.LogEntry{}
+		if err = decoder.Decode(entry); err != nil {
+			return 0, err
+		}
+		entries = append(entries, entry)
+	}
+	n, err := db.ApplyLog(entries)
+	if err == boltplus.ErrLogTruncated {
+		// the primary restored a backup
+		return 0, r.bootstrap()
+	}
+	return n, err
+}
+
+func (r *replicator) report(err error) {
+	seq, _ := db.LastSequence()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.Sequence = seq
+	r.status.Lag = 0
+	if r.status.PrimarySequence > seq {
+		r.status.Lag = r.status.PrimarySequence - seq
+	}
+	r.status.Error = ""
+	if err != nil {
+		log.Print("replication: ", err)
+		r.status.Error = err.Error()
+	} else {
+		now := time.Now()
+		r.status.LastContact = &now
+	}
+	metrics.Set("boltplus_replication_lag", nil, float64(r.status.Lag))
+}
+
+func (r *replicator) currentStatus() replicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+func handleLog(from, limit string, w http.ResponseWriter) {
+	if !*oplog {
+		http.Error(w, "the operation log is disabled, start with -oplog", http.StatusNotFound)
+		return
+	}
+	fromSeq, err := strconv.ParseUint(from, 10, 64)
+	if from != "" && err != nil {
+		http.Error(w, "bad from", http.StatusBadRequest)
+		return
+	}
+	n, err := strconv.Atoi(limit)
+	if limit != "" && err != nil {
+		http.Error(w, "bad limit", http.StatusBadRequest)
+		return
+	}
+	seq, err := db.LastSequence()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ch, err := db.ReadLog(fromSeq, n)
+	if err == boltplus.ErrLogTruncated {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set(sequenceHeader, strconv.FormatUint(seq, 10))
+	encoder := json.NewEncoder(w)
+	for entry := range ch {
+		encoder.Encode(entry)
+	}
+}
+
+func handleReplication(w http.ResponseWriter) {
+	var status replicationStatus
+	if replica != nil {
+		status = replica.currentStatus()
+	} else {
+		seq, err := db.LastSequence()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status.Sequence = seq
+	}
+	bs, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
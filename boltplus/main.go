@@ -2,21 +2,28 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 
 	"github.com/trusch/boltplus"
+	"github.com/trusch/boltplus/celfilter"
+	"github.com/trusch/boltplus/jqtransform"
 )
 
 var dbPath = flag.String("db", "default.db", "db to use")
+var keysFile = flag.String("keys-file", "", "file with encryption keys, one '<id> <base64 key>' per line, the first one is used for writing")
+var keysEnv = flag.String("keys-env", "", "environment variable with encryption keys formatted as '<id>:<base64 key>,...', the first one is used for writing")
 var bucketPath = flag.String("bucket", "", "bucket to use. You can use dot-notation for nested buckets!")
 var key = flag.String("key", "", "key to use")
-var doc = flag.String("doc", "", "json doc to save")
+var doc = flag.String("doc", "", "json doc to save, any json value is accepted")
+var raw = flag.String("raw", "", "file with bytes to save as raw value ('-' for stdin)")
 
 var put = flag.Bool("put", false, "save")
 var get = flag.Bool("get", false, "retrieve")
@@ -28,8 +35,37 @@ var start = flag.String("start", "", "start to search")
 var end = flag.String("end", "", "end to search")
 
 var filter = flag.String("filter", "", "filter returned docs with gojee")
+var where = flag.String("where", "", "filter returned docs with a json query document like '{\"age\": {\"$gt\": 30}}'")
+var celFilter = flag.String("cel", "", "filter returned docs with a CEL expression over doc and key, e.g. 'doc.age > 30'")
+var jq = flag.String("jq", "", "reshape returned docs with a jq expression, the key is available as $key")
+var lookup = flag.String("lookup", "", "embed referenced docs, comma separated localField:fromBucket[:as] specs")
 var backup = flag.String("backup", "", "backup the database to this file")
+var restore = flag.String("restore", "", "replace the database with this backup file")
+var compact = flag.String("compact", "", "compact the database into this new file")
+var compactSwap = flag.Bool("compact-swap", false, "replace the database with the compacted file")
+var compactReencode = flag.Bool("compact-reencode", false, "re-encode all docs while compacting, e.g. to encrypt them")
+var verify = flag.String("verify", "", "verify that this backup file is consistent and decodable")
 var buckets = flag.Bool("buckets", false, "list all buckets")
+var export = flag.String("export", "", "export the bucket and its sub-buckets to this file ('-' for stdout)")
+var importFile = flag.String("import", "", "import docs from this file ('-' for stdin) into the bucket")
+var ioFormat = flag.String("io-format", "ndjson", "import/export format (ndjson,json,csv)")
+var migrate = flag.String("migrate", "", "show the migration status (status) or apply pending migrations (up)")
+var rekey = flag.Bool("rekey", false, "re-encrypt all docs with the current encryption key")
+
+var search = flag.String("search", "", "full-text search the bucket")
+var limit = flag.Int("limit", 0, "maximum number of results (0 means no limit)")
+var keysOnly = flag.Bool("keys", false, "list only the keys of the bucket, with -prefix or -start and -end")
+var reverse = flag.Bool("reverse", false, "list the keys in descending order")
+var searchIndex = flag.String("search-index", "", "create a full-text index over these comma separated fields of the bucket")
+var searchLanguage = flag.String("search-language", "en", "language of the full-text index (en,de)")
+
+var geoIndex = flag.String("geo-index", "", "create a geo index over the comma separated latitude and longitude fields of the bucket, e.g. lat,lon")
+var near = flag.String("near", "", "find docs within a radius around a point given as lat,lon,meters")
+var within = flag.String("within", "", "find docs inside a bounding box given as minLat,minLon,maxLat,maxLon")
+
+var setSchema = flag.String("set-schema", "", "json schema to attach to the bucket ('null' removes it)")
+var getSchema = flag.Bool("get-schema", false, "print the json schema of the bucket")
+var validate = flag.Bool("validate", false, "validate all docs of the bucket against its schema")
 
 var outputFormat = flag.String("format", "json", "output format (json,json-pretty,yaml)")
 
@@ -60,44 +96,66 @@ func print(data interface{}) {
 func init() {
 	flag.Parse()
 	if !*all && !*put && !*get && !*delete && *prefix == "" && *start == "" && *end == "" {
-		if *bucketPath != "" && *key != "" && *doc != "" {
+		if *bucketPath != "" && *key != "" && (*doc != "" || *raw != "") {
 			*put = true
 		} else if *bucketPath != "" && *key != "" {
 			*get = true
 		} else if *bucketPath != "" {
 			*all = true
-		} else if (*backup == "") && !*buckets {
+		} else if *backup == "" && *restore == "" && *verify == "" && *compact == "" && *migrate == "" && !*buckets && *search == "" && !*rekey && *near == "" && *within == "" {
 			log.Fatal("please specify what to do")
 		}
 	}
 }
 
 func putCmd(db *boltplus.DB) {
-	if *bucketPath == "" || *key == "" || *doc == "" {
-		log.Fatal("specify bucket, key and doc")
+	if *bucketPath == "" || *key == "" || (*doc == "") == (*raw == "") {
+		log.Fatal("specify bucket, key and either doc or raw")
 	}
-	docObj := make(map[string]interface{})
-	err := json.Unmarshal([]byte(*doc), &docObj)
+	if *raw != "" {
+		putRawCmd(db)
+		return
+	}
+	var value interface{}
+	err := json.Unmarshal([]byte(*doc), &value)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = db.Put(*bucketPath, *key, docObj)
+	err = db.PutValue(*bucketPath, *key, value)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func putRawCmd(db *boltplus.DB) {
+	var data []byte
+	var err error
+	if *raw == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*raw)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err = db.PutRaw(*bucketPath, *key, data); err != nil {
+		log.Fatal(err)
+	}
 }
 
+// getCmd prints the value of a key, raw values are written to stdout as they are
 func getCmd(db *boltplus.DB) {
 	if *bucketPath == "" || *key == "" {
 		log.Fatal("specify bucket and key")
 	}
-	val, err := db.Get(*bucketPath, *key)
+	val, err := db.GetValue(*bucketPath, *key)
 	if err != nil {
-		if err.Error() == "EOF" {
-			log.Fatal("no such key in bucket")
-		}
 		log.Fatal(err)
 	}
+	if data, ok := val.([]byte); ok {
+		os.Stdout.Write(data)
+		return
+	}
 	print(val)
 }
 
@@ -115,7 +173,7 @@ func getAllCmd(db *boltplus.DB) {
 	if *bucketPath == "" {
 		log.Fatal("specify bucket")
 	}
-	ch, err := db.GetAll(*bucketPath)
+	ch, err := db.QueryValues(&boltplus.Query{Bucket: *bucketPath})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -128,7 +186,7 @@ func getPrefixCmd(db *boltplus.DB) {
 	if *bucketPath == "" {
 		log.Fatal("specify bucket")
 	}
-	ch, err := db.GetPrefix(*bucketPath, *prefix)
+	ch, err := db.QueryValues(&boltplus.Query{Bucket: *bucketPath, Prefix: *prefix})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -141,7 +199,7 @@ func getRangeCmd(db *boltplus.DB) {
 	if *bucketPath == "" {
 		log.Fatal("specify bucket")
 	}
-	ch, err := db.GetRange(*bucketPath, *start, *end)
+	ch, err := db.QueryValues(&boltplus.Query{Bucket: *bucketPath, Start: *start, End: *end})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -150,21 +208,76 @@ func getRangeCmd(db *boltplus.DB) {
 	}
 }
 
-func filterCmd(db *boltplus.DB) {
+func keysCmd(db *boltplus.DB) {
 	if *bucketPath == "" {
 		log.Fatal("specify bucket")
 	}
-	var ch chan *boltplus.Pair
+	opts := &boltplus.ScanOptions{Limit: *limit, Reverse: *reverse}
+	var ch chan string
 	var err error
-	if *all {
-		ch, err = db.Find(*bucketPath, *filter)
-	} else if *prefix != "" {
-		ch, err = db.FindPrefix(*bucketPath, *prefix, *filter)
+	if *prefix != "" {
+		ch, err = db.KeysPrefix(*bucketPath, *prefix, opts)
 	} else if *start != "" && *end != "" {
-		ch, err = db.FindRange(*bucketPath, *start, *end, *filter)
+		ch, err = db.KeysRange(*bucketPath, *start, *end, opts)
 	} else {
-		err = errors.New("please specify what to filter")
+		ch, err = db.Keys(*bucketPath, opts)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	for k := range ch {
+		print(k)
 	}
+}
+
+func filterCmd(db *boltplus.DB) {
+	if *bucketPath == "" {
+		log.Fatal("specify bucket")
+	}
+	q := &boltplus.Query{Bucket: *bucketPath, Filter: *filter}
+	switch {
+	case *all:
+	case *prefix != "":
+		q.Prefix = *prefix
+	case *start != "" && *end != "":
+		q.Start, q.End = *start, *end
+	default:
+		log.Fatal("please specify what to filter")
+	}
+	if *where != "" {
+		f, err := boltplus.ParseWhere([]byte(*where))
+		if err != nil {
+			log.Fatal(err)
+		}
+		q.Where = f
+	}
+	if *celFilter != "" {
+		if q.Where != nil {
+			log.Fatal("use either -where or -cel")
+		}
+		f, err := celfilter.Compile(*celFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		q.Where = f
+	}
+	if *jq != "" {
+		t, err := jqtransform.Compile(*jq)
+		if err != nil {
+			log.Fatal(err)
+		}
+		q.Transform = t
+	}
+	if *lookup != "" {
+		for _, spec := range strings.Split(*lookup, ",") {
+			l, err := boltplus.ParseLookup(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			q.Lookups = append(q.Lookups, l)
+		}
+	}
+	ch, err := db.QueryValues(q)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -184,6 +297,50 @@ func backupCmd(db *boltplus.DB) {
 	log.Printf("successfully created backup %v", *backup)
 }
 
+func restoreCmd(db *boltplus.DB) {
+	f, err := os.Open(*restore)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if err := db.Restore(f); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("successfully restored backup %v", *restore)
+}
+
+func compactCmd(db *boltplus.DB) {
+	before, err := os.Stat(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := &boltplus.CompactOptions{Reencode: *compactReencode, Swap: *compactSwap}
+	if err = db.Compact(*compact, opts); err != nil {
+		log.Fatal(err)
+	}
+	target := *compact
+	if *compactSwap {
+		target = *dbPath
+	}
+	after, err := os.Stat(target)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("successfully compacted %v (%v bytes) into %v (%v bytes)", *dbPath, before.Size(), target, after.Size())
+}
+
+func verifyCmd(db *boltplus.DB) {
+	f, err := os.Open(*verify)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if err := db.VerifyBackup(f); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("backup %v is valid", *verify)
+}
+
 func bucketsCmd(db *boltplus.DB) {
 	if list, err := db.Buckets(); err == nil {
 		print(list)
@@ -192,17 +349,239 @@ func bucketsCmd(db *boltplus.DB) {
 	}
 }
 
+func searchCmd(db *boltplus.DB) {
+	if *bucketPath == "" {
+		log.Fatal("specify bucket")
+	}
+	ch, err := db.Search(*bucketPath, *search, *limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for val := range ch {
+		print(val)
+	}
+}
+
+func searchIndexCmd(db *boltplus.DB) {
+	if *bucketPath == "" {
+		log.Fatal("specify bucket")
+	}
+	index := &boltplus.SearchIndex{
+		Fields:   strings.Split(*searchIndex, ","),
+		Language: *searchLanguage,
+	}
+	if err := db.CreateSearchIndex(*bucketPath, index); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("successfully created search index on %v", *bucketPath)
+}
+
+func geoIndexCmd(db *boltplus.DB) {
+	fields := strings.Split(*geoIndex, ",")
+	if *bucketPath == "" || len(fields) != 2 {
+		log.Fatal("specify bucket and the latitude and longitude fields")
+	}
+	if err := db.CreateGeoIndex(*bucketPath, &boltplus.GeoIndex{LatField: fields[0], LonField: fields[1]}); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("successfully created geo index on %v", *bucketPath)
+}
+
+func nearCmd(db *boltplus.DB) {
+	values := parseFloats(*near, 3)
+	if *bucketPath == "" {
+		log.Fatal("specify bucket")
+	}
+	ch, err := db.FindNear(*bucketPath, values[0], values[1], values[2])
+	if err != nil {
+		log.Fatal(err)
+	}
+	for val := range ch {
+		print(val)
+	}
+}
+
+func withinCmd(db *boltplus.DB) {
+	values := parseFloats(*within, 4)
+	if *bucketPath == "" {
+		log.Fatal("specify bucket")
+	}
+	ch, err := db.FindWithin(*bucketPath, boltplus.BBox{MinLat: values[0], MinLon: values[1], MaxLat: values[2], MaxLon: values[3]})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for val := range ch {
+		print(val)
+	}
+}
+
+// parseFloats parses n comma separated numbers
+func parseFloats(str string, n int) []float64 {
+	parts := strings.Split(str, ",")
+	if len(parts) != n {
+		log.Fatalf("expected %v comma separated numbers, got %q", n, str)
+	}
+	res := make([]float64, n)
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		res[i] = f
+	}
+	return res
+}
+
+func setSchemaCmd(db *boltplus.DB) {
+	if *bucketPath == "" {
+		log.Fatal("specify bucket")
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(*setSchema), &schema); err != nil {
+		log.Fatal(err)
+	}
+	if err := db.SetSchema(*bucketPath, schema); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func getSchemaCmd(db *boltplus.DB) {
+	if *bucketPath == "" {
+		log.Fatal("specify bucket")
+	}
+	schema, err := db.GetSchema(*bucketPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	print(schema)
+}
+
+func validateCmd(db *boltplus.DB) {
+	if *bucketPath == "" {
+		log.Fatal("specify bucket")
+	}
+	errs, err := db.ValidateBucket(*bucketPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, e := range errs {
+		print(e)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+}
+
+func exportCmd(db *boltplus.DB) {
+	if *bucketPath == "" {
+		log.Fatal("specify bucket")
+	}
+	w := os.Stdout
+	if *export != "-" {
+		f, err := os.Create(*export)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := db.Export(*bucketPath, w, boltplus.Format(*ioFormat)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func importCmd(db *boltplus.DB) {
+	if *bucketPath == "" {
+		log.Fatal("specify bucket")
+	}
+	r := os.Stdin
+	if *importFile != "-" {
+		f, err := os.Open(*importFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	n, err := db.Import(*bucketPath, r, boltplus.Format(*ioFormat))
+	if err != nil {
+		log.Fatalf("imported %v docs before failing: %v", n, err)
+	}
+	log.Printf("successfully imported %v docs", n)
+}
+
+func migrateCmd(db *boltplus.DB) {
+	switch *migrate {
+	case "status":
+		status, err := db.MigrationStatus()
+		if err != nil {
+			log.Fatal(err)
+		}
+		print(status)
+	case "up":
+		n, err := db.Migrate()
+		if err != nil {
+			log.Fatalf("applied %v migrations before failing: %v", n, err)
+		}
+		log.Printf("successfully applied %v migrations", n)
+	default:
+		log.Fatal("migrate must be status or up")
+	}
+}
+
+func rekeyCmd(db *boltplus.DB) {
+	n, err := db.Rekey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("successfully re-encrypted %v docs", n)
+}
+
+func dbOptions() *boltplus.Options {
+	opts, err := boltplus.OptionsFromKeyFile(*keysFile, *keysEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return opts
+}
+
 func main() {
 	flag.Parse()
-	db, err := boltplus.New(*dbPath)
+	db, err := boltplus.NewWithOptions(*dbPath, dbOptions())
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	if *put {
+	if *export != "" {
+		exportCmd(db)
+	} else if *importFile != "" {
+		importCmd(db)
+	} else if *migrate != "" {
+		migrateCmd(db)
+	} else if *rekey {
+		rekeyCmd(db)
+	} else if *setSchema != "" {
+		setSchemaCmd(db)
+	} else if *getSchema {
+		getSchemaCmd(db)
+	} else if *validate {
+		validateCmd(db)
+	} else if *geoIndex != "" {
+		geoIndexCmd(db)
+	} else if *near != "" {
+		nearCmd(db)
+	} else if *within != "" {
+		withinCmd(db)
+	} else if *searchIndex != "" {
+		searchIndexCmd(db)
+	} else if *search != "" {
+		searchCmd(db)
+	} else if *put {
 		putCmd(db)
-	} else if *filter != "" {
+	} else if *keysOnly {
+		keysCmd(db)
+	} else if *filter != "" || *where != "" || *celFilter != "" || *lookup != "" || *jq != "" {
 		filterCmd(db)
 	} else if *get {
 		getCmd(db)
@@ -216,6 +595,12 @@ func main() {
 		getRangeCmd(db)
 	} else if *backup != "" {
 		backupCmd(db)
+	} else if *restore != "" {
+		restoreCmd(db)
+	} else if *verify != "" {
+		verifyCmd(db)
+	} else if *compact != "" {
+		compactCmd(db)
 	} else if *buckets {
 		bucketsCmd(db)
 	} else {
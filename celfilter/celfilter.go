@@ -0,0 +1,123 @@
+// Package celfilter implements boltplus filters in the Common Expression Language (CEL).
+//
+// Expressions see the decoded doc as `doc` and its key as `key` and have to evaluate to a bool:
+//
+//	doc.age > 30 && key.startsWith("user-") && doc.tags.exists(t, t in ["a", "b"])
+//
+// They are parsed and type-checked once by Compile. Evaluation is sandboxed, expressions can not
+// cause side effects, and stopped once they exceed a cost limit, so untrusted expressions are safe to run.
+package celfilter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/trusch/boltplus"
+)
+
+// DefaultCostLimit is the evaluation cost a single match may use if Options.CostLimit is 0.
+// Every comparison, field access and iteration step costs about one unit.
+const DefaultCostLimit = 100000
+
+// Options configures the compilation of a filter
+type Options struct {
+	// CostLimit stops evaluations exceeding this cost with an error, 0 means DefaultCostLimit
+	CostLimit uint64
+}
+
+// Filter is a compiled CEL expression, it implements boltplus.Filter and is safe for concurrent use
+type Filter struct {
+	expression string
+	program    cel.Program
+}
+
+var env *cel.Env
+
+func init() {
+	var err error
+	env, err = cel.NewEnv(
+		cel.Variable("doc", cel.DynType),
+		cel.Variable("key", cel.StringType),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Compile compiles an expression with the default options
+func Compile(expression string) (*Filter, error) {
+	return CompileWithOptions(expression, nil)
+}
+
+// CompileWithOptions parses and type-checks an expression, syntax and type errors are returned as
+// *boltplus.FilterError
+func CompileWithOptions(expression string, opts *Options) (*Filter, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	limit := opts.CostLimit
+	if limit == 0 {
+		limit = DefaultCostLimit
+	}
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		first := issues.Errors()[0]
+		offset := offsetOf(expression, first.Location.Line(), first.Location.Column())
+		return nil, &boltplus.FilterError{Expression: expression, Offset: offset, Err: errors.New(first.Message)}
+	}
+	if t := ast.OutputType(); t != cel.BoolType && t != cel.DynType {
+		err := fmt.Errorf("expression evaluates to %v instead of bool", t)
+		return nil, &boltplus.FilterError{Expression: expression, Offset: -1, Err: err}
+	}
+	program, err := env.Program(ast, cel.CostLimit(limit))
+	if err != nil {
+		return nil, &boltplus.FilterError{Expression: expression, Offset: -1, Err: err}
+	}
+	return &Filter{expression, program}, nil
+}
+
+// Match evaluates the expression for a doc, exceeding the cost limit is an error.
+// Docs lacking a field the expression accesses do not match.
+func (f *Filter) Match(key string, doc interface{}) (bool, error) {
+	out, _, err := f.program.Eval(map[string]interface{}{"doc": doc, "key": key})
+	if err != nil && strings.HasPrefix(err.Error(), "no such key") {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cel filter %q on %v: %v", f.expression, key, err)
+	}
+	match, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("cel filter %q on %v: evaluated to %v instead of bool", f.expression, key, out.Type())
+	}
+	return match, nil
+}
+
+// String returns the expression
+func (f *Filter) String() string {
+	return f.expression
+}
+
+// offsetOf converts a 1-based line and 0-based column in code points into a byte offset
+func offsetOf(expression string, line, column int) int {
+	if line < 1 || column < 0 {
+		return -1
+	}
+	lines := strings.SplitAfter(expression, "\n")
+	if line > len(lines) {
+		return -1
+	}
+	offset := 0
+	for _, l := range lines[:line-1] {
+		offset += len(l)
+	}
+	for i := range lines[line-1] {
+		if column == 0 {
+			return offset + i
+		}
+		column--
+	}
+	return offset + len(lines[line-1])
+}
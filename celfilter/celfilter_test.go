@@ -0,0 +1,102 @@
+package celfilter
+
+import (
+	"os"
+	"testing"
+
+	"github.com/trusch/boltplus"
+)
+
+func TestMatch(t *testing.T) {
+	doc := map[string]interface{}{"age": 34.0, "name": "Alice", "tags": []interface{}{"a", "b"}}
+	cases := []struct {
+		expression string
+		expect     bool
+	}{
+		{"doc.age > 30.0", true},
+		{`doc.name == "Bob"`, false},
+		{`"b" in doc.tags && key.startsWith("user-")`, true},
+		{`has(doc.address)`, false},
+		{`doc.tags.exists(t, t == "c")`, false},
+	}
+	for _, c := range cases {
+		f, err := Compile(c.expression)
+		if err != nil {
+			t.Errorf("%v: %v", c.expression, err)
+			continue
+		}
+		if match, err := f.Match("user-1", doc); err != nil || match != c.expect {
+			t.Errorf("%v: wanted %v got %v (%v)", c.expression, c.expect, match, err)
+		}
+	}
+	// missing fields do not match, other evaluation errors are reported
+	f, _ := Compile("doc.address.city == 'Berlin'")
+	if match, err := f.Match("user-1", doc); err != nil || match {
+		t.Errorf("wanted no match for missing field got %v (%v)", match, err)
+	}
+	f, _ = Compile("doc.name > 3.0")
+	if _, err := f.Match("user-1", doc); err == nil {
+		t.Error("wanted error for mismatching types")
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	_, err := Compile("doc.age >")
+	filterErr, ok := err.(*boltplus.FilterError)
+	if !ok || filterErr.Offset != 9 {
+		t.Errorf("wanted FilterError at offset 9 got %#v", err)
+	}
+	if _, err := Compile(`key + "x"`); err == nil {
+		t.Error("wanted error for non-bool expression")
+	}
+	if _, err := Compile("unknown > 3"); err == nil {
+		t.Error("wanted error for undeclared variable")
+	}
+}
+
+func TestCostLimit(t *testing.T) {
+	items := make([]interface{}, 200)
+	for i := range items {
+		items[i] = float64(i)
+	}
+	doc := map[string]interface{}{"items": items}
+	expression := "doc.items.all(x, doc.items.all(y, x + y >= 0.0))"
+	f, err := CompileWithOptions(expression, &Options{CostLimit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Match("a", doc); err == nil {
+		t.Error("wanted error for exceeded cost limit")
+	}
+	f, _ = CompileWithOptions(expression, &Options{CostLimit: 100000000})
+	if match, err := f.Match("a", doc); err != nil || !match {
+		t.Errorf("wanted match got %v (%v)", match, err)
+	}
+}
+
+func TestFind(t *testing.T) {
+	os.Remove("./test.db")
+	defer os.Remove("./test.db")
+	db, err := boltplus.New("./test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("people", "a", boltplus.Object{"age": 20})
+	db.Put("people", "b", boltplus.Object{"age": 40})
+	f, err := Compile("doc.age >= 30.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := db.FindFilter("people", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for pair := range ch {
+		keys = append(keys, pair.Key)
+	}
+	if len(keys) != 1 || keys[0] != "b" {
+		t.Errorf("wanted b got %v", keys)
+	}
+}
@@ -0,0 +1,148 @@
+package boltplus
+
+import (
+	"fmt"
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// compactTxMaxSize is the number of bytes Compact writes per transaction into the new file
+const compactTxMaxSize = 64 << 20
+
+// CompactOptions configures Compact
+type CompactOptions struct {
+	// Reencode decodes all docs and encodes them again, e.g. to encrypt them with the current key
+	Reencode bool
+	// Swap replaces the database file with the compacted one, targetPath is moved in the process.
+	// Like Restore it fails with ErrSwapTimeout if transactions stay open, targetPath is kept then.
+	Swap bool
+}
+
+// Compact copies all buckets into a fresh file at targetPath, dropping the free pages which bolt never
+// returns to the file system. The database stays readable while Compact runs. Writes wait for it
+// if the compacted file is swapped in, otherwise they are not part of the copy.
+func (db *DB) Compact(targetPath string, opts *CompactOptions) error {
+	if opts == nil {
+		opts = &CompactOptions{}
+	}
+	if opts.Swap {
+		db.writeMu.Lock()
+		defer db.writeMu.Unlock()
+	}
+	if _, err := os.Stat(targetPath); err == nil {
+		return fmt.Errorf("%v already exists", targetPath)
+	}
+	dst, err := bolt.Open(targetPath, 0600, db.bolt.bolt())
+	if err != nil {
+		return err
+	}
+	err = db.compactTo(dst, opts.Reencode)
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(targetPath)
+		return err
+	}
+	if opts.Swap {
+		return db.swap(targetPath)
+	}
+	return nil
+}
+
+type compactor struct {
+	dst      *bolt.DB
+	tx       *bolt.Tx
+	src      *Transaction
+	reencode bool
+	size     int
+	// generation is increased on every commit, cached buckets of older generations are invalid
+	generation int
+}
+
+func (db *DB) compactTo(dst *bolt.DB, reencode bool) error {
+	src, err := db.Tx(false)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	c := &compactor{dst: dst, tx: tx, src: src, reencode: reencode}
+	err = src.tx.ForEach(func(name []byte, bucket backendBucket) error {
+		return c.copyBucket([][]byte{name}, bucket)
+	})
+	if err != nil {
+		c.tx.Rollback()
+		return err
+	}
+	return c.tx.Commit()
+}
+
+// copyBucket recursively copies a bucket including its sequence
+func (c *compactor) copyBucket(path [][]byte, bucket backendBucket) error {
+	target, err := c.target(path)
+	if err != nil {
+		return err
+	}
+	generation := c.generation
+	if err = target.SetSequence(bucket.Sequence()); err != nil {
+		return err
+	}
+	isDocBucket := string(path[0]) != metaBucket
+	return bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return c.copyBucket(append(append([][]byte{}, path...), k), bucket.Bucket(k))
+		}
+		if c.reencode && isDocBucket {
+			kind, body, e := openValue(c.src.db.keys, v)
+			if e != nil {
+				return e
+			}
+			if v, e = c.src.seal(kind, body); e != nil {
+				return e
+			}
+		}
+		if c.size += len(k) + len(v); c.size > compactTxMaxSize {
+			if e := c.commit(); e != nil {
+				return e
+			}
+		}
+		if generation != c.generation {
+			if target, err = c.target(path); err != nil {
+				return err
+			}
+			generation = c.generation
+		}
+		return target.Put(k, v)
+	})
+}
+
+// target returns the bucket in the new file, creating it if needed
+func (c *compactor) target(path [][]byte) (*bolt.Bucket, error) {
+	bucket, err := c.tx.CreateBucketIfNotExists(path[0])
+	for _, name := range path[1:] {
+		if err != nil {
+			return nil, err
+		}
+		bucket, err = bucket.CreateBucketIfNotExists(name)
+	}
+	return bucket, err
+}
+
+func (c *compactor) commit() error {
+	if err := c.tx.Commit(); err != nil {
+		return err
+	}
+	tx, err := c.dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	c.tx = tx
+	c.size = 0
+	c.generation++
+	return nil
+}
@@ -0,0 +1,69 @@
+package boltplus
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	skipInMemory(t)
+	db, _ := setupCleanDB()
+	defer db.Close()
+	defer os.Remove("./compact.db")
+	putN(db, 1000)
+	for i := 0; i < 900; i++ {
+		db.Delete("test.bucket", strconv.Itoa(i))
+	}
+	before, _ := db.Size()
+	if err := db.Compact("./compact.db", nil); err != nil {
+		t.Fatal(err)
+	}
+	compacted, err := New("./compact.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compacted.Close()
+	after, _ := compacted.Size()
+	if after >= before {
+		t.Errorf("compacted size %v should be smaller than %v", after, before)
+	}
+	if result, err := compacted.Get("test.bucket", "999"); err != nil || !reflect.DeepEqual(result, Object{"key": 999.}) {
+		t.Errorf("wanted doc 999 got %v (%v)", result, err)
+	}
+	if err := db.Compact("./compact.db", nil); err == nil {
+		t.Error("compacting into an existing file should fail")
+	}
+}
+
+func TestCompactSwapReencode(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	defer os.Remove("./compact.db")
+	putN(db, 10)
+	tx, _ := db.Tx(true)
+	bucket, _ := tx.getBucket("test.bucket")
+	bucket.SetSequence(42)
+	tx.Commit()
+
+	db.keys = StaticKeys{testKey("k1", 1)}
+	if err := db.Compact("./compact.db", &CompactOptions{Reencode: true, Swap: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("./compact.db"); !os.IsNotExist(err) {
+		t.Error("compacted file should have been moved")
+	}
+	tx, _ = db.Tx(false)
+	defer tx.Close()
+	bucket, _ = tx.getBucket("test.bucket")
+	if seq := bucket.Sequence(); seq != 42 {
+		t.Errorf("wanted sequence 42 got %v", seq)
+	}
+	if id, _, _ := parseEncryptionHeader(bucket.Get([]byte("3"))); id != "k1" {
+		t.Error("doc should have been encrypted")
+	}
+	if result, err := tx.Get("test.bucket", "3"); err != nil || !reflect.DeepEqual(Object(result), Object{"key": 3.}) {
+		t.Errorf("wanted doc 3 got %v (%v)", result, err)
+	}
+}
@@ -0,0 +1,61 @@
+//go:build !race
+
+// github.com/boltdb/bolt fails the pointer checks of the race detector, see bbolt
+
+package boltplus
+
+import (
+	"os"
+	"testing"
+
+	oldbolt "github.com/boltdb/bolt"
+)
+
+func TestOpenBoltDBFile(t *testing.T) {
+	os.Remove("./test.db")
+	old, err := oldbolt.Open("./test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := compressJSON(Object{"engine": "boltdb"})
+	err = old.Update(func(tx *oldbolt.Tx) error {
+		// the layout of the bucket path "files"
+		bucket, e := tx.CreateBucketIfNotExists([]byte("files"))
+		if e == nil {
+			bucket, e = bucket.CreateBucketIfNotExists([]byte("files"))
+		}
+		if e != nil {
+			return e
+		}
+		bucket.SetSequence(7)
+		return bucket.Put([]byte("a"), value)
+	})
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewWithOptions("./test.db", &Options{Bolt: &BoltOptions{FreelistType: FreelistMap}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := db.Get("files", "a"); err != nil || doc["engine"] != "boltdb" {
+		t.Errorf("wanted the doc written by boltdb got %v (%v)", doc, err)
+	}
+	if err = db.Put("files", "b", Object{"engine": "bbolt"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	// and the old engine still reads the file
+	old, err = oldbolt.Open("./test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	old.View(func(tx *oldbolt.Tx) error {
+		bucket := tx.Bucket([]byte("files")).Bucket([]byte("files"))
+		if bucket.Sequence() != 7 || bucket.Get([]byte("b")) == nil {
+			t.Error("wanted boltdb to read the file written by bbolt")
+		}
+		return nil
+	})
+}
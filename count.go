@@ -0,0 +1,141 @@
+package boltplus
+
+import (
+	"errors"
+	"time"
+)
+
+// Count returns the number of docs in a bucket without decoding them
+func (tx *Transaction) Count(bucketPath string) (int, error) {
+	return tx.count(&Query{Bucket: bucketPath}, "count")
+}
+
+// CountPrefix returns the number of docs with a key prefix without decoding them
+func (tx *Transaction) CountPrefix(bucketPath, prefix string) (int, error) {
+	if prefix == "" {
+		return 0, errors.New("empty prefix")
+	}
+	return tx.count(&Query{Bucket: bucketPath, Prefix: prefix}, "countPrefix")
+}
+
+// CountRange returns the number of docs in a key range without decoding them
+func (tx *Transaction) CountRange(bucketPath, start, end string) (int, error) {
+	if start == "" || end == "" {
+		return 0, errors.New("empty start/end")
+	}
+	return tx.count(&Query{Bucket: bucketPath, Start: start, End: end}, "countRange")
+}
+
+// CountWhere returns the number of docs matching a filter, only these counts decode the docs
+func (tx *Transaction) CountWhere(bucketPath string, filter Filter) (int, error) {
+	return tx.count(&Query{Bucket: bucketPath, Where: filter}, "countWhere")
+}
+
+// CountQuery returns the number of docs a query returns, transforms are not applied.
+// Unlike the streaming queries it does not close the transaction.
+func (tx *Transaction) CountQuery(q *Query) (int, error) {
+	return tx.count(q, "countQuery")
+}
+
+// Exists reports whether a doc is stored under a key, a missing bucket contains no docs
+func (tx *Transaction) Exists(bucketPath, key string) (bool, error) {
+	bucket, err := tx.getBucket(bucketPath)
+	if err != nil {
+		return false, nil
+	}
+	return bucket.Get([]byte(key)) != nil, nil
+}
+
+func (tx *Transaction) count(q *Query, op string) (n int, err error) {
+	defer tx.db.observe(op, time.Now(), &err)
+	p, err := prepare(q, tx.db.compileFilter)
+	if err != nil {
+		return 0, err
+	}
+	q = &p.query
+	bucket, err := tx.getBucket(q.Bucket)
+	if err != nil {
+		return 0, err
+	}
+	if len(p.filters) > 0 {
+		run := &queryRun{tx: tx, q: q, filters: p.filters, lookups: tx.lookupBuckets(q)}
+		run.scan(bucket.Cursor(), nil, nil, nil)
+		tx.db.observeScanned(op, int(run.scanned))
+		tx.db.observeMatched(op, int(run.matched))
+		run.logFilterErrors()
+		return int(run.matched), nil
+	}
+	if q.Prefix == "" && q.Start == "" {
+		// the stats count the keys of sub-buckets as well, they are exact if there are none
+		if stats := bucket.Stats(); stats.BucketN == 1 {
+			return stats.KeyN, nil
+		}
+	}
+	c := bucket.Cursor()
+	for k, v := q.seek(c); q.contains(k); k, v = c.Next() {
+		if v != nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Count returns the number of docs in a bucket without decoding them
+func (db *DB) Count(bucketPath string) (int, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+	return tx.Count(bucketPath)
+}
+
+// CountPrefix returns the number of docs with a key prefix without decoding them
+func (db *DB) CountPrefix(bucketPath, prefix string) (int, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+	return tx.CountPrefix(bucketPath, prefix)
+}
+
+// CountRange returns the number of docs in a key range without decoding them
+func (db *DB) CountRange(bucketPath, start, end string) (int, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+	return tx.CountRange(bucketPath, start, end)
+}
+
+// CountWhere returns the number of docs matching a filter
+func (db *DB) CountWhere(bucketPath string, filter Filter) (int, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+	return tx.CountWhere(bucketPath, filter)
+}
+
+// CountQuery returns the number of docs a query returns
+func (db *DB) CountQuery(q *Query) (int, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+	return tx.CountQuery(q)
+}
+
+// Exists reports whether a doc is stored under a key
+func (db *DB) Exists(bucketPath, key string) (bool, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Close()
+	return tx.Exists(bucketPath, key)
+}
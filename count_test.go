@@ -0,0 +1,61 @@
+package boltplus
+
+import (
+	"testing"
+)
+
+func TestCount(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	putN(db, 20)
+	db.Put("flat", "a", Object{"n": 1})
+	db.Put("flat", "b", Object{"n": 2})
+	cases := []struct {
+		name   string
+		count  func() (int, error)
+		expect int
+	}{
+		{"all", func() (int, error) { return db.Count("test.bucket") }, 20},
+		{"stats", func() (int, error) { return db.Count("flat") }, 2},
+		{"sub-buckets only", func() (int, error) { return db.Count("test") }, 0},
+		{"prefix", func() (int, error) { return db.CountPrefix("test.bucket", "1") }, 11},
+		{"range", func() (int, error) { return db.CountRange("test.bucket", "10", "15") }, 6},
+		{"where", func() (int, error) {
+			f, _ := GojeeFilter(".key >= 15")
+			return db.CountWhere("test.bucket", f)
+		}, 5},
+		{"query", func() (int, error) {
+			return db.CountQuery(&Query{Bucket: "test.bucket", Prefix: "1", Filter: ".key < 12"})
+		}, 3},
+	}
+	for _, c := range cases {
+		if n, err := c.count(); err != nil || n != c.expect {
+			t.Errorf("%v: wanted %v got %v (%v)", c.name, c.expect, n, err)
+		}
+	}
+	if _, err := db.Count("missing"); err == nil {
+		t.Error("wanted error for missing bucket")
+	}
+	if _, err := db.CountPrefix("test.bucket", ""); err == nil {
+		t.Error("wanted error for empty prefix")
+	}
+}
+
+func TestExists(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	putN(db, 2)
+	for _, c := range []struct {
+		bucket, key string
+		expect      bool
+	}{
+		{"test.bucket", "1", true},
+		{"test.bucket", "2", false},
+		{"test", "bucket", false},
+		{"missing", "1", false},
+	} {
+		if exists, err := db.Exists(c.bucket, c.key); err != nil || exists != c.expect {
+			t.Errorf("%v/%v: wanted %v got %v (%v)", c.bucket, c.key, c.expect, exists, err)
+		}
+	}
+}
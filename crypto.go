@@ -0,0 +1,363 @@
+package boltplus
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyProvider supplies the keys used to encrypt the stored docs
+type KeyProvider interface {
+	// CurrentKey returns the id and the 32 byte key used to encrypt new values
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given id, it is used to decrypt values written with older keys
+	Key(id string) ([]byte, error)
+}
+
+// Key is an AES-256 key with its id
+type Key struct {
+	ID  string
+	Key []byte
+}
+
+// StaticKeys is a KeyProvider holding a fixed set of keys, the first one is the current key
+type StaticKeys []Key
+
+// CurrentKey returns the first key
+func (keys StaticKeys) CurrentKey() (string, []byte, error) {
+	if len(keys) == 0 {
+		return "", nil, errors.New("no encryption key")
+	}
+	return keys[0].ID, keys[0].Key, nil
+}
+
+// Key returns the key with the given id
+func (keys StaticKeys) Key(id string) ([]byte, error) {
+	for _, k := range keys {
+		if k.ID == id {
+			return k.Key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown encryption key %v", id)
+}
+
+// KeyFile reads keys from a file with one "<id> <base64 key>" pair per line, the first one is the current key
+func KeyFile(path string) (StaticKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys StaticKeys
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed key line: %v", line)
+		}
+		key, err := parseKey(fields[0], fields[1])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys in key file")
+	}
+	return keys, nil
+}
+
+// EnvKeys reads keys from an environment variable formatted as "<id>:<base64 key>,<id>:<base64 key>", the first one is the current key
+func EnvKeys(name string) (StaticKeys, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil, fmt.Errorf("environment variable %v is empty", name)
+	}
+	var keys StaticKeys
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed key entry in %v", name)
+		}
+		key, err := parseKey(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// OptionsFromKeyFile returns options encrypting with the keys of a key file (see KeyFile) or, if keysFile
+// is empty, of an environment variable (see EnvKeys). Without both the options do not encrypt.
+// The commands map their -keys-file and -keys-env flags with it.
+func OptionsFromKeyFile(keysFile, keysEnv string) (*Options, error) {
+	opts := &Options{}
+	switch {
+	case keysFile != "":
+		keys, err := KeyFile(keysFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.Keys = keys
+	case keysEnv != "":
+		keys, err := EnvKeys(keysEnv)
+		if err != nil {
+			return nil, err
+		}
+		opts.Keys = keys
+	}
+	return opts, nil
+}
+
+func parseKey(id, encoded string) (Key, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return Key{}, err
+	}
+	if len(key) != 32 {
+		return Key{}, fmt.Errorf("key %v must be 32 bytes long", id)
+	}
+	if len(id) > 255 {
+		return Key{}, fmt.Errorf("key id %v is too long", id)
+	}
+	return Key{id, key}, nil
+}
+
+// Stored values are either a plain snappy stream (which always starts with 0xff) or
+// carry a header: valueMagic | flags | ...
+// Encrypted values continue with: len(key id) | key id | nonce | AES-256-GCM sealed body
+const (
+	valueMagic     byte = 0xb7
+	valueEncrypted byte = 1 << 0
+	// valueKindMask selects the kind of the value from the flags
+	valueKindMask byte = 3 << 1
+)
+
+// The kinds of stored values. Objects are 0, so the values written before kinds existed stay valid.
+// The body of objects and other JSON values is a snappy stream, raw values are stored as they are.
+const (
+	kindObject byte = 0 << 1
+	kindJSON   byte = 1 << 1
+	kindRaw    byte = 2 << 1
+)
+
+// encrypt seals the body of a value with the current key
+func encrypt(keys KeyProvider, kind byte, payload []byte) ([]byte, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	flags := valueEncrypted | kind
+	header := append([]byte{valueMagic, flags, byte(len(id))}, id...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(append(header, nonce...), nonce, payload, additionalData(flags, id)), nil
+}
+
+// decrypt opens a sealed value, values without encryption header are returned as they are
+func decrypt(keys KeyProvider, data []byte) ([]byte, error) {
+	id, sealed, err := parseEncryptionHeader(data)
+	if err != nil || sealed == nil {
+		return data, err
+	}
+	if keys == nil {
+		return nil, errors.New("value is encrypted but no keys are configured")
+	}
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted value too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData(data[1], id))
+}
+
+// additionalData authenticates the flags of a value along with its body, so its kind can not be changed.
+// Objects only use the key id, like the values encrypted before kinds existed.
+func additionalData(flags byte, id string) []byte {
+	if flags&valueKindMask == kindObject {
+		return []byte(id)
+	}
+	return append([]byte{flags}, id...)
+}
+
+// parseEncryptionHeader returns the key id and the nonce+ciphertext of an encrypted value.
+// sealed is nil if the value is not encrypted.
+func parseEncryptionHeader(data []byte) (id string, sealed []byte, err error) {
+	if len(data) < 2 || data[0] != valueMagic || data[1]&valueEncrypted == 0 {
+		return "", nil, nil
+	}
+	if len(data) < 3 || len(data) < 3+int(data[2]) {
+		return "", nil, errors.New("malformed encryption header")
+	}
+	return string(data[3 : 3+int(data[2])]), data[3+int(data[2]):], nil
+}
+
+// openValue decrypts a value and returns its kind and body
+func openValue(keys KeyProvider, data []byte) (kind byte, body []byte, err error) {
+	if len(data) < 2 || data[0] != valueMagic {
+		return kindObject, data, nil
+	}
+	kind = data[1] & valueKindMask
+	if kind != kindObject && kind != kindJSON && kind != kindRaw {
+		return 0, nil, fmt.Errorf("unknown value kind %#x", kind)
+	}
+	if data[1]&valueEncrypted == 0 {
+		return kind, data[2:], nil
+	}
+	body, err = decrypt(keys, data)
+	return kind, body, err
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// rekeyBatchSize is the number of values re-encrypted per write transaction
+const rekeyBatchSize = 1000
+
+// Rekey re-encrypts all docs which are not encrypted with the current key yet and returns their number.
+// It commits in small batches, so the database stays usable while it runs. Finally it rebuilds the
+// search indexes whose terms are not hashed with the current key.
+func (db *DB) Rekey() (int, error) {
+	if db.keys == nil {
+		return 0, errors.New("no encryption keys configured")
+	}
+	currentID, _, err := db.keys.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+	var paths [][][]byte
+	tx, err := db.Tx(false)
+	if err != nil {
+		return 0, err
+	}
+	tx.tx.ForEach(func(name []byte, bucket backendBucket) error {
+		if string(name) != metaBucket {
+			paths = append(paths, bucketPaths(bucket, [][]byte{append([]byte{}, name...)})...)
+		}
+		return nil
+	})
+	tx.Close()
+	count := 0
+	for _, path := range paths {
+		var last []byte
+		for done := false; !done; {
+			n := 0
+			n, last, done, err = db.rekeyBatch(path, last, currentID)
+			count += n
+			if err != nil {
+				return count, err
+			}
+		}
+	}
+	tx, err = db.Tx(true)
+	if err != nil {
+		return count, err
+	}
+	defer tx.Close()
+	if err = tx.rekeySearchIndexes(currentID); err != nil {
+		return count, err
+	}
+	return count, tx.Commit()
+}
+
+// rekeyBatch re-encrypts up to rekeyBatchSize values of a bucket starting after the key last
+func (db *DB) rekeyBatch(path [][]byte, last []byte, currentID string) (n int, next []byte, done bool, err error) {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	defer tx.Close()
+	bucket := tx.tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if bucket == nil {
+			break
+		}
+		bucket = bucket.Bucket(name)
+	}
+	if bucket == nil {
+		return 0, nil, true, nil
+	}
+	type update struct{ key, value []byte }
+	var updates []update
+	c := bucket.Cursor()
+	k, v := c.First()
+	if last != nil {
+		if k, v = c.Seek(last); k != nil && string(k) == string(last) {
+			k, v = c.Next()
+		}
+	}
+	done = true
+	for ; k != nil; k, v = c.Next() {
+		if len(updates) == rekeyBatchSize {
+			done = false
+			break
+		}
+		next = k
+		if v == nil {
+			continue
+		}
+		if id, sealed, e := parseEncryptionHeader(v); e == nil && sealed != nil && id == currentID {
+			continue
+		}
+		kind, body, e := openValue(db.keys, v)
+		if e != nil {
+			return 0, nil, false, e
+		}
+		value, e := encrypt(db.keys, kind, body)
+		if e != nil {
+			return 0, nil, false, e
+		}
+		updates = append(updates, update{append([]byte{}, k...), value})
+	}
+	next = append([]byte{}, next...)
+	for _, u := range updates {
+		if err = bucket.Put(u.key, u.value); err != nil {
+			return 0, nil, false, err
+		}
+	}
+	return len(updates), next, done, tx.Commit()
+}
+
+// bucketPaths returns the raw name paths of a bucket and all its sub-buckets
+func bucketPaths(bucket backendBucket, path [][]byte) [][][]byte {
+	res := [][][]byte{path}
+	bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			sub := append(append([][]byte{}, path...), append([]byte{}, k...))
+			res = append(res, bucketPaths(bucket.Bucket(k), sub)...)
+		}
+		return nil
+	})
+	return res
+}
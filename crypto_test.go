@@ -0,0 +1,147 @@
+package boltplus
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func testKey(id string, b byte) Key {
+	return Key{id, bytes.Repeat([]byte{b}, 32)}
+}
+
+func setupEncryptedDB(keys KeyProvider) (*DB, error) {
+	os.Remove("./test.db")
+	return NewWithOptions("./test.db", testOptions(&Options{Keys: keys}))
+}
+
+func TestEncryptedPutGet(t *testing.T) {
+	db, err := setupEncryptedDB(StaticKeys{testKey("k1", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	doc := Object{"secret": "swordfish"}
+	if err := db.Put("test.bucket", "key", doc); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := db.Get("test.bucket", "key"); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(result, doc) {
+		t.Errorf("wanted %v got %v", doc, result)
+	}
+
+	tx, _ := db.Tx(false)
+	defer tx.Close()
+	bucket, _ := tx.getBucket("test.bucket")
+	raw := bucket.Get([]byte("key"))
+	if raw[0] != valueMagic || bytes.Contains(raw, []byte("swordfish")) {
+		t.Error("value is not encrypted")
+	}
+}
+
+func TestEncryptedWrongKey(t *testing.T) {
+	skipInMemory(t)
+	db, _ := setupEncryptedDB(StaticKeys{testKey("k1", 1)})
+	db.Put("test.bucket", "key", Object{"a": 1.})
+	db.Close()
+	db, _ = NewWithOptions("./test.db", testOptions(&Options{Keys: StaticKeys{testKey("k1", 2)}}))
+	defer db.Close()
+	if _, err := db.Get("test.bucket", "key"); err == nil {
+		t.Error("decrypting with the wrong key should fail")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	skipInMemory(t)
+	db, _ := setupCleanDB()
+	putN(db, 2500)
+	db.Close()
+
+	db, _ = NewWithOptions("./test.db", testOptions(&Options{Keys: StaticKeys{testKey("k1", 1)}}))
+	if n, err := db.Rekey(); err != nil || n != 2500 {
+		t.Errorf("wanted 2500 rekeyed values got %v (%v)", n, err)
+	}
+	db.Close()
+
+	db, _ = NewWithOptions("./test.db", testOptions(&Options{Keys: StaticKeys{testKey("k2", 2), testKey("k1", 1)}}))
+	defer db.Close()
+	if result, err := db.Get("test.bucket", "42"); err != nil || !reflect.DeepEqual(result, Object{"key": 42.}) {
+		t.Errorf("reading value with old key failed: %v %v", result, err)
+	}
+	if n, err := db.Rekey(); err != nil || n != 2500 {
+		t.Errorf("wanted 2500 rekeyed values got %v (%v)", n, err)
+	}
+	if n, _ := db.Rekey(); n != 0 {
+		t.Errorf("second rekey should be a noop, rekeyed %v", n)
+	}
+	db.keys = StaticKeys{testKey("k2", 2)}
+	if result, err := db.Get("test.bucket", "2499"); err != nil || !reflect.DeepEqual(result, Object{"key": 2499.}) {
+		t.Errorf("reading rekeyed value failed: %v %v", result, err)
+	}
+}
+
+func TestEncryptedSearch(t *testing.T) {
+	db, err := setupEncryptedDB(StaticKeys{testKey("k1", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("notes", "1", Object{"text": "buy apples and bananas"})
+	if err := db.CreateSearchIndex("notes", &SearchIndex{Fields: []string{"text"}, Language: "en"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("notes", "2", Object{"text": "apple pie"})
+
+	search := func() []string {
+		result, err := db.Search("notes", "apple", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return collectKeys(result)
+	}
+	if keys := search(); !reflect.DeepEqual(keys, []string{"2", "1"}) {
+		t.Errorf("wanted [2 1] got %v", keys)
+	}
+	tx, _ := db.Tx(false)
+	tx.getMetaBucket("search", "notes").Bucket(searchTermsKey).ForEach(func(term, v []byte) error {
+		if string(term) == "appl" || string(term) == "banana" {
+			t.Errorf("search term %q is stored in plain text", term)
+		}
+		return nil
+	})
+	tx.Close()
+
+	db.keys = StaticKeys{testKey("k2", 2), testKey("k1", 1)}
+	if _, err := db.Rekey(); err != nil {
+		t.Fatal(err)
+	}
+	db.keys = StaticKeys{testKey("k2", 2)}
+	if keys := search(); !reflect.DeepEqual(keys, []string{"2", "1"}) {
+		t.Errorf("wanted [2 1] after rekey got %v", keys)
+	}
+}
+
+func TestEnvKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	os.Setenv("BOLTPLUS_TEST_KEYS", "new:"+key+",old:"+key)
+	defer os.Unsetenv("BOLTPLUS_TEST_KEYS")
+	keys, err := EnvKeys("BOLTPLUS_TEST_KEYS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _, _ := keys.CurrentKey(); id != "new" {
+		t.Errorf("wanted current key new got %v", id)
+	}
+	if _, err := keys.Key("old"); err != nil {
+		t.Error(err)
+	}
+	if opts, err := OptionsFromKeyFile("", "BOLTPLUS_TEST_KEYS"); err != nil || opts.Keys == nil {
+		t.Errorf("wanted options with keys got %v (%v)", opts, err)
+	}
+	if opts, err := OptionsFromKeyFile("", ""); err != nil || opts.Keys != nil {
+		t.Errorf("wanted options without keys got %v (%v)", opts, err)
+	}
+}
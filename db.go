@@ -2,15 +2,60 @@ package boltplus
 
 import (
 	"io"
-
-	"github.com/boltdb/bolt"
+	"sync"
+	"time"
 )
 
-// DB wraps the boltdb handle
+// DB wraps the handle of the storage backend
 type DB struct {
-	db *bolt.DB
+	db      backend
+	backend Backend
+	bolt    *BoltOptions
+	path    string
+	keys    KeyProvider
+	// mu is read-locked by every open transaction, Restore write-locks it to swap the file
+	mu sync.RWMutex
+	// gate is passed by every new transaction, a swap write-locks it to hold new transactions back
+	// while the open ones drain
+	gate sync.RWMutex
+	// writeMu is held by write transactions, Compact holds it to not lose writes when swapping
+	writeMu sync.Mutex
+	hooks   hooks
+	metrics Metrics
+	oplog   bool
+	filters *filterCache
+	schemas schemaCache
+	// swapTimeout is how long Restore and Compact wait for open transactions
+	swapTimeout time.Duration
+}
+
+// Options configures a database
+type Options struct {
+	// Keys enables encryption of the stored docs. Docs written without encryption stay readable,
+	// Rekey encrypts them. Search terms are stored as keyed hashes, keys, bucket names, schemas and geo
+	// cells stay plain text.
+	Keys KeyProvider
+	// Migrate applies all pending registered migrations when opening the database
+	Migrate bool
+	// Metrics receives operation counts and latencies, see PrometheusMetrics
+	Metrics Metrics
+	// OpLog records every write in an append-only log which replicas can read with ReadLog
+	OpLog bool
+	// FilterCacheSize is the number of compiled filters kept for reuse, 0 means DefaultFilterCacheSize
+	// and a negative size disables the cache
+	FilterCacheSize int
+	// Backend selects the storage engine, the default is BackendBolt
+	Backend Backend
+	// Bolt tunes the bolt backend
+	Bolt *BoltOptions
+	// SwapTimeout is how long Restore and Compact with Swap wait for open transactions to be closed,
+	// 0 means DefaultSwapTimeout
+	SwapTimeout time.Duration
 }
 
+// DefaultSwapTimeout is how long Restore waits for open transactions if Options.SwapTimeout is 0
+const DefaultSwapTimeout = 30 * time.Second
+
 type Object map[string]interface{}
 
 // Pair is a key value pair
@@ -19,19 +64,74 @@ type Pair struct {
 	Value map[string]interface{} `json:"value"`
 }
 
+// ValuePair is a key value pair of any value, JSON values stored with PutValue or raw values ([]byte)
+// stored with PutRaw
+type ValuePair struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
 // New opens a database
 func New(filename string) (*DB, error) {
-	db := &DB{}
-	return db, db.open(filename)
+	return NewWithOptions(filename, nil)
+}
+
+// NewWithOptions opens a database with the given options, nil options are the defaults
+func NewWithOptions(filename string, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	db := &DB{keys: opts.Keys, metrics: opts.Metrics, oplog: opts.OpLog, backend: opts.Backend, bolt: opts.Bolt, swapTimeout: opts.SwapTimeout}
+	if db.swapTimeout <= 0 {
+		db.swapTimeout = DefaultSwapTimeout
+	}
+	switch {
+	case opts.FilterCacheSize == 0:
+		db.filters = newFilterCache(DefaultFilterCacheSize)
+	case opts.FilterCacheSize > 0:
+		db.filters = newFilterCache(opts.FilterCacheSize)
+	}
+	if err := db.open(filename); err != nil {
+		return db, err
+	}
+	if opts.Migrate {
+		if _, err := db.Migrate(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
 }
 
 // Tx creates a new transaction. Do not forget to commit all writing transactions and to close read and write messages!
+// Open transactions block Restore. Streams returned by the read methods hold their transaction until they are
+// drained and attachment readers until they are closed, so always drain or close them.
 func (db *DB) Tx(writable bool) (*Transaction, error) {
+	if writable {
+		db.writeMu.Lock()
+	}
+	return db.begin(writable)
+}
+
+// begin opens a transaction, writers must hold writeMu already which is released with the transaction
+func (db *DB) begin(writable bool) (*Transaction, error) {
+	db.gate.RLock()
+	db.mu.RLock()
+	db.gate.RUnlock()
 	tx, err := db.db.Begin(writable)
 	if err != nil {
+		db.release(writable)
 		return nil, err
 	}
-	return &Transaction{tx: tx}, nil
+	return &Transaction{tx: tx, db: db, started: time.Now()}, nil
+}
+
+// release gives up the locks taken by Tx
+func (db *DB) release(writable bool) {
+	db.mu.RUnlock()
+	if writable {
+		db.writeMu.Unlock()
+	}
 }
 
 // Close closes the db
@@ -83,7 +183,11 @@ func (db *DB) GetAll(bucketPath string) (chan *Pair, error) {
 	if err != nil {
 		return nil, err
 	}
-	return tx.GetAll(bucketPath)
+	ch, err := tx.GetAll(bucketPath)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
 }
 
 // GetPrefix returns all docs in a bucket matching a prefix
@@ -92,7 +196,11 @@ func (db *DB) GetPrefix(bucketPath, prefix string) (chan *Pair, error) {
 	if err != nil {
 		return nil, err
 	}
-	return tx.GetPrefix(bucketPath, prefix)
+	ch, err := tx.GetPrefix(bucketPath, prefix)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
 }
 
 // GetRange returns all docs in a bucket matching a prefix
@@ -101,7 +209,11 @@ func (db *DB) GetRange(bucketPath, start, end string) (chan *Pair, error) {
 	if err != nil {
 		return nil, err
 	}
-	return tx.GetRange(bucketPath, start, end)
+	ch, err := tx.GetRange(bucketPath, start, end)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
 }
 
 // Find searches a bucket for documents
@@ -110,7 +222,11 @@ func (db *DB) Find(bucketPath, filterExpression string) (chan *Pair, error) {
 	if err != nil {
 		return nil, err
 	}
-	return tx.Find(bucketPath, filterExpression)
+	ch, err := tx.Find(bucketPath, filterExpression)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
 }
 
 // FindPrefix searches a bucket for documents
@@ -119,7 +235,11 @@ func (db *DB) FindPrefix(bucketPath, prefix, filterExpression string) (chan *Pai
 	if err != nil {
 		return nil, err
 	}
-	return tx.FindPrefix(bucketPath, prefix, filterExpression)
+	ch, err := tx.FindPrefix(bucketPath, prefix, filterExpression)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
 }
 
 // FindRange searches a bucket for documents
@@ -128,7 +248,200 @@ func (db *DB) FindRange(bucketPath, start, end, filterExpression string) (chan *
 	if err != nil {
 		return nil, err
 	}
-	return tx.FindRange(bucketPath, start, end, filterExpression)
+	ch, err := tx.FindRange(bucketPath, start, end, filterExpression)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
+
+// FindFilter searches a bucket for documents matching a Filter
+func (db *DB) FindFilter(bucketPath string, filter Filter) (chan *Pair, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := tx.FindFilter(bucketPath, filter)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
+
+// FindPrefixFilter searches the documents with a key prefix for documents matching a Filter
+func (db *DB) FindPrefixFilter(bucketPath, prefix string, filter Filter) (chan *Pair, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := tx.FindPrefixFilter(bucketPath, prefix, filter)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
+
+// FindRangeFilter searches the documents in a key range for documents matching a Filter
+func (db *DB) FindRangeFilter(bucketPath, start, end string, filter Filter) (chan *Pair, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := tx.FindRangeFilter(bucketPath, start, end, filter)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
+
+// Query streams the docs matching a query
+func (db *DB) Query(q *Query) (chan *Pair, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := tx.Query(q)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
+
+// QueryValues streams the values of any kind matching a query
+func (db *DB) QueryValues(q *Query) (chan *ValuePair, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := tx.QueryValues(q)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
+
+// CreateSearchIndex creates (or recreates) a full-text index on a bucket
+func (db *DB) CreateSearchIndex(bucketPath string, index *SearchIndex) error {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	if err = tx.CreateSearchIndex(bucketPath, index); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DropSearchIndex removes the full-text index of a bucket
+func (db *DB) DropSearchIndex(bucketPath string) error {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	if err = tx.DropSearchIndex(bucketPath); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Search returns the docs of a bucket matching the query ranked by relevance
+func (db *DB) Search(bucketPath, query string, limit int) (chan *Pair, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := tx.Search(bucketPath, query, limit)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
+
+// CreateGeoIndex creates (or recreates) a geospatial index on a bucket
+func (db *DB) CreateGeoIndex(bucketPath string, index *GeoIndex) error {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	if err = tx.CreateGeoIndex(bucketPath, index); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DropGeoIndex removes the geospatial index of a bucket
+func (db *DB) DropGeoIndex(bucketPath string) error {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	if err = tx.DropGeoIndex(bucketPath); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// FindNear returns the docs of a bucket within radius meters of a point, nearest first
+func (db *DB) FindNear(bucketPath string, lat, lon, radius float64) (chan *Pair, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := tx.FindNear(bucketPath, lat, lon, radius)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
+
+// FindWithin returns the docs of a bucket inside a bounding box, nearest to its center first
+func (db *DB) FindWithin(bucketPath string, box BBox) (chan *Pair, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := tx.FindWithin(bucketPath, box)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
+
+// SetSchema attaches a JSON schema to a bucket, Put rejects docs not matching it with a *ValidationError
+func (db *DB) SetSchema(bucketPath string, schema map[string]interface{}) error {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	if err = tx.SetSchema(bucketPath, schema); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetSchema returns the schema of a bucket or nil if there is none
+func (db *DB) GetSchema(bucketPath string) (map[string]interface{}, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	return tx.GetSchema(bucketPath)
+}
+
+// ValidateBucket checks all docs of a bucket against its schema
+func (db *DB) ValidateBucket(bucketPath string) ([]*ValidationError, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	return tx.ValidateBucket(bucketPath)
 }
 
 // Backup performs a hot backup of the whole database
@@ -162,10 +475,17 @@ func (db *DB) Buckets() ([]string, error) {
 }
 
 func (db *DB) open(filename string) error {
-	dbHandle, err := bolt.Open(filename, 0600, nil)
+	handle, err := openBackend(db.backend, filename, db.bolt)
+	if err != nil {
+		return err
+	}
+	db.db = handle
+	db.path = filename
+	tx, err := handle.Begin(false)
 	if err != nil {
 		return err
 	}
-	db.db = dbHandle
+	defer tx.Rollback()
+	db.observeSize(tx.Size())
 	return nil
 }
@@ -7,9 +7,27 @@ import (
 	"testing"
 )
 
+// testBackend is the backend the tests run against, BOLTPLUS_TEST_BACKEND=memory runs them in memory
+var testBackend = Backend(os.Getenv("BOLTPLUS_TEST_BACKEND"))
+
+func testOptions(opts *Options) *Options {
+	if opts == nil {
+		opts = &Options{}
+	}
+	opts.Backend = testBackend
+	return opts
+}
+
+// skipInMemory skips tests which reopen or inspect the database file
+func skipInMemory(t *testing.T) {
+	if testBackend == BackendMemory {
+		t.Skip("the memory backend has no file")
+	}
+}
+
 func setupCleanDB() (*DB, error) {
 	os.Remove("./test.db")
-	return New("./test.db")
+	return NewWithOptions("./test.db", testOptions(nil))
 }
 
 func putN(db *DB, n int) error {
@@ -0,0 +1,359 @@
+package boltplus
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Format is a serialization format for Export and Import
+type Format string
+
+// Supported formats
+const (
+	// FormatNDJSON writes one JSON record per line
+	FormatNDJSON Format = "ndjson"
+	// FormatJSON writes a JSON array of records
+	FormatJSON Format = "json"
+	// FormatCSV writes one line per doc with the nested fields flattened to dotted columns.
+	// Non-string values and strings which look like JSON are written as JSON.
+	FormatCSV Format = "csv"
+)
+
+// importBatchSize is the number of docs Import writes per transaction
+const importBatchSize = 1000
+
+// Record is a doc as written by Export. Bucket is the path of the sub-bucket relative to the exported bucket.
+type Record struct {
+	Bucket string `json:"bucket,omitempty"`
+	ValuePair
+	// Raw marks values stored with PutRaw, their value is base64 encoded
+	Raw bool `json:"raw,omitempty"`
+}
+
+// Export writes all docs of a bucket and its sub-buckets to w
+func (tx *Transaction) Export(bucketPath string, w io.Writer, format Format) error {
+	bucket, err := tx.getBucket(bucketPath)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	switch format {
+	case FormatNDJSON:
+		encoder := json.NewEncoder(bw)
+		err = tx.exportBucket(bucket, "", func(r *Record) error {
+			return encoder.Encode(r)
+		})
+	case FormatJSON:
+		first := true
+		bw.WriteString("[")
+		err = tx.exportBucket(bucket, "", func(r *Record) error {
+			bs, e := json.Marshal(r)
+			if e != nil {
+				return e
+			}
+			if !first {
+				bw.WriteString(",")
+			}
+			first = false
+			_, e = bw.Write(bs)
+			return e
+		})
+		bw.WriteString("]\n")
+	case FormatCSV:
+		err = tx.exportCSV(bucket, bw)
+	default:
+		err = fmt.Errorf("unknown format %v", format)
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (tx *Transaction) exportCSV(bucket backendBucket, w io.Writer) error {
+	// the first pass only collects the columns, so memory stays bounded by their number
+	columnSet := make(map[string]bool)
+	err := tx.exportBucket(bucket, "", func(r *Record) error {
+		doc, ok := r.Value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("csv only supports objects, %v is not one", r.Key)
+		}
+		fields, err := flatten(doc, "", nil)
+		if err != nil {
+			return fmt.Errorf("exporting %v as csv: %v", r.Key, err)
+		}
+		for column := range fields {
+			columnSet[column] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	columns := make([]string, 0, len(columnSet))
+	for column := range columnSet {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	writer := csv.NewWriter(w)
+	if err = writer.Write(append([]string{"bucket", "key"}, columns...)); err != nil {
+		return err
+	}
+	err = tx.exportBucket(bucket, "", func(r *Record) error {
+		fields, err := flatten(r.Value.(map[string]interface{}), "", nil)
+		if err != nil {
+			return err
+		}
+		line := append(make([]string, 0, len(columns)+2), r.Bucket, r.Key)
+		for _, column := range columns {
+			line = append(line, fields[column])
+		}
+		return writer.Write(line)
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// exportBucket calls fn for every doc in a bucket and recursively in its sub-buckets
+func (tx *Transaction) exportBucket(bucket backendBucket, path string, fn func(*Record) error) error {
+	return bucket.ForEach(func(k, v []byte) error {
+		if v == nil && string(k) == attachmentsBucket {
+			return nil
+		}
+		if v == nil {
+			sub := string(k)
+			if path != "" {
+				sub = path + "." + sub
+			}
+			return tx.exportBucket(bucket.Bucket(k), sub, fn)
+		}
+		value, err := tx.decodeValue(v)
+		if err != nil {
+			return err
+		}
+		_, raw := value.([]byte)
+		return fn(&Record{path, ValuePair{string(k), value}, raw})
+	})
+}
+
+// flatten converts nested objects to dotted keys with the leaf values formatted as CSV cells.
+// Empty objects are cells too, field names containing dots are rejected as they would be split on import.
+func flatten(doc map[string]interface{}, prefix string, res map[string]string) (map[string]string, error) {
+	if res == nil {
+		res = make(map[string]string)
+	}
+	for key, value := range doc {
+		if strings.Contains(key, ".") {
+			return nil, fmt.Errorf("field %q contains a dot", prefix+key)
+		}
+		column := prefix + key
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if len(v) == 0 {
+				res[column] = "{}"
+			} else if _, err := flatten(v, column+".", res); err != nil {
+				return nil, err
+			}
+		case string:
+			if v == "" || json.Valid([]byte(v)) {
+				bs, _ := json.Marshal(v)
+				v = string(bs)
+			}
+			res[column] = v
+		default:
+			bs, _ := json.Marshal(v)
+			res[column] = string(bs)
+		}
+	}
+	return res, nil
+}
+
+// unflatten reverses flatten, empty cells are skipped
+func unflatten(columns, cells []string) map[string]interface{} {
+	doc := make(map[string]interface{})
+	for i, column := range columns {
+		if i >= len(cells) || cells[i] == "" {
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(cells[i]), &value); err != nil {
+			value = cells[i]
+		}
+		parts := strings.Split(column, ".")
+		current := doc
+		for _, part := range parts[:len(parts)-1] {
+			next, ok := current[part].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				current[part] = next
+			}
+			current = next
+		}
+		current[parts[len(parts)-1]] = value
+	}
+	return doc
+}
+
+// Export writes all docs of a bucket and its sub-buckets to w
+func (db *DB) Export(bucketPath string, w io.Writer, format Format) error {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	return tx.Export(bucketPath, w, format)
+}
+
+// Import reads records as written by Export and puts them into a bucket. It commits every few
+// thousand docs, so a failing import leaves the docs before the failure in place.
+// It returns the number of imported docs.
+func (db *DB) Import(bucketPath string, r io.Reader, format Format) (int, error) {
+	next, err := recordReader(r, format)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for {
+		n, err := db.importBatch(bucketPath, next)
+		count += n
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+}
+
+// Import reads records as written by Export and puts them into a bucket within the transaction.
+// It returns the number of imported docs.
+func (tx *Transaction) Import(bucketPath string, r io.Reader, format Format) (int, error) {
+	next, err := recordReader(r, format)
+	if err != nil {
+		return 0, err
+	}
+	n, err := tx.importRecords(bucketPath, next, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// recordReader returns a function reading the next record, it returns io.EOF when the input is drained
+func recordReader(r io.Reader, format Format) (func() (*Record, error), error) {
+	var next func() (*Record, error)
+	switch format {
+	case FormatNDJSON:
+		decoder := json.NewDecoder(r)
+		next = func() (*Record, error) {
+			record := &Record{}
+			if err := decoder.Decode(record); err != nil {
+				return nil, err
+			}
+			return record, nil
+		}
+	case FormatJSON:
+		decoder := json.NewDecoder(r)
+		if t, err := decoder.Token(); err != nil || t != json.Delim('[') {
+			return nil, errors.New("expected a json array")
+		}
+		next = func() (*Record, error) {
+			if !decoder.More() {
+				return nil, io.EOF
+			}
+			record := &Record{}
+			if err := decoder.Decode(record); err != nil {
+				return nil, err
+			}
+			return record, nil
+		}
+	case FormatCSV:
+		reader := csv.NewReader(r)
+		header, err := reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		if len(header) < 2 || header[0] != "bucket" || header[1] != "key" {
+			return nil, errors.New("csv must start with the columns bucket and key")
+		}
+		next = func() (*Record, error) {
+			line, err := reader.Read()
+			if err != nil {
+				return nil, err
+			}
+			return &Record{line[0], ValuePair{line[1], unflatten(header[2:], line[2:])}, false}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %v", format)
+	}
+	return next, nil
+}
+
+// importBatch imports up to importBatchSize records in one transaction. It returns io.EOF when the input is drained.
+func (db *DB) importBatch(bucketPath string, next func() (*Record, error)) (int, error) {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+	n, err := tx.importRecords(bucketPath, next, importBatchSize)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if e := tx.Commit(); e != nil {
+		return 0, e
+	}
+	return n, err
+}
+
+// importRecords imports up to limit records, all of them if limit is 0. It returns io.EOF when the input is drained.
+func (tx *Transaction) importRecords(bucketPath string, next func() (*Record, error), limit int) (int, error) {
+	n := 0
+	for ; limit <= 0 || n < limit; n++ {
+		record, err := next()
+		if err != nil {
+			return n, err
+		}
+		if record.Key == "" {
+			return n, errors.New("record without key")
+		}
+		path := bucketPath
+		if record.Bucket != "" {
+			path += "." + record.Bucket
+		}
+		if err = importRecord(tx, path, record); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// importRecord puts the value of a record, records without value are imported as empty docs
+func importRecord(tx *Transaction, bucketPath string, record *Record) error {
+	if record.Raw {
+		encoded, ok := record.Value.(string)
+		if !ok {
+			return fmt.Errorf("raw value of %v is not a base64 string", record.Key)
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+		return tx.PutRaw(bucketPath, record.Key, data)
+	}
+	if record.Value == nil {
+		record.Value = make(map[string]interface{})
+	}
+	return tx.PutValue(bucketPath, record.Key, record.Value)
+}
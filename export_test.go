@@ -0,0 +1,71 @@
+package boltplus
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []Format{FormatNDJSON, FormatJSON, FormatCSV} {
+		db, _ := setupCleanDB()
+		db.Put("src", "a", Object{"name": "foo", "nested": Object{"n": 1, "s": "42"}, "list": []interface{}{"x"}})
+		db.Put("src", "b", Object{"name": "", "flag": true, "empty": Object{}, "nested": Object{"empty": Object{}}})
+		db.Put("src.sub", "c", Object{"name": "bar"})
+
+		var buf bytes.Buffer
+		if err := db.Export("src", &buf, format); err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		n, err := db.Import("dst", &buf, format)
+		if err != nil || n != 3 {
+			t.Fatalf("%v: wanted 3 imported docs got %v (%v)", format, n, err)
+		}
+		for _, c := range []struct{ src, dst, key string }{{"src", "dst", "a"}, {"src", "dst", "b"}, {"src.sub", "dst.sub", "c"}} {
+			expect, _ := db.Get(c.src, c.key)
+			result, err := db.Get(c.dst, c.key)
+			if err != nil || !reflect.DeepEqual(expect, result) {
+				t.Errorf("%v: wanted %v got %v (%v)", format, expect, result, err)
+			}
+		}
+		db.Close()
+	}
+}
+
+func TestExportCSVColumns(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.Put("src", "a", Object{"x": Object{"y": 1}})
+	db.Put("src", "b", Object{"z": "foo"})
+	var buf bytes.Buffer
+	if err := db.Export("src", &buf, FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	expect := "bucket,key,x.y,z\n,a,1,\n,b,,foo\n"
+	if buf.String() != expect {
+		t.Errorf("wanted %q got %q", expect, buf.String())
+	}
+}
+
+func TestExportCSVDottedField(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.Put("src", "a", Object{"x": Object{"a.b": 1}})
+	var buf bytes.Buffer
+	if err := db.Export("src", &buf, FormatCSV); err == nil {
+		t.Errorf("wanted error for a field containing a dot got %q", buf.String())
+	}
+}
+
+func TestImportChunked(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	putN(db, 2500)
+	var buf bytes.Buffer
+	if err := db.Export("test.bucket", &buf, FormatNDJSON); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Import("copy", &buf, FormatNDJSON); err != nil || n != 2500 {
+		t.Errorf("wanted 2500 imported docs got %v (%v)", n, err)
+	}
+}
@@ -0,0 +1,404 @@
+package boltplus
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// GeoIndex describes a geospatial index over a point stored in two number fields of the docs
+type GeoIndex struct {
+	// LatField and LonField are the (dotted) paths of the coordinates in degrees, "lat" and "lon" by default
+	LatField string `json:"latField"`
+	LonField string `json:"lonField"`
+}
+
+// BBox is a bounding box in degrees. Boxes with MinLon > MaxLon cross the antimeridian.
+type BBox struct {
+	MinLat float64 `json:"minLat"`
+	MinLon float64 `json:"minLon"`
+	MaxLat float64 `json:"maxLat"`
+	MaxLon float64 `json:"maxLon"`
+}
+
+const (
+	// earthRadius is the mean earth radius in meters
+	earthRadius = 6371008.8
+	// geohashPrecision is the length of the geohashes stored in the index
+	geohashPrecision = 12
+	// geoMaxCells limits the number of geohash cells scanned per query
+	geoMaxCells = 64
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+var (
+	geoConfigKey = []byte("config")
+	geoCellsKey  = []byte("cells")
+	geoDocsKey   = []byte("docs")
+)
+
+// CreateGeoIndex creates (or recreates) a geospatial index on a bucket and indexes all existing docs.
+// Docs without valid coordinates are not indexed.
+func (tx *Transaction) CreateGeoIndex(bucketPath string, index *GeoIndex) error {
+	if index == nil {
+		index = &GeoIndex{}
+	}
+	if index.LatField == "" {
+		index.LatField = "lat"
+	}
+	if index.LonField == "" {
+		index.LonField = "lon"
+	}
+	if err := tx.dropGeoIndex(bucketPath); err != nil {
+		return err
+	}
+	idx, err := tx.getMetaBucketOrCreate("geo", bucketPath)
+	if err != nil {
+		return err
+	}
+	bs, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err = idx.Put(geoConfigKey, bs); err != nil {
+		return err
+	}
+	config := map[string]interface{}{"latField": index.LatField, "lonField": index.LonField}
+	if err = tx.appendLog(&LogEntry{Op: OpCreateGeoIndex, Bucket: bucketPath, Value: config}); err != nil {
+		return err
+	}
+	bucket, err := tx.getBucket(bucketPath)
+	if err != nil {
+		// nothing to index yet
+		return nil
+	}
+	return bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		doc, e := tx.bytesToData(v)
+		if e == ErrNotObject {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		return tx.indexGeo(bucketPath, string(k), doc)
+	})
+}
+
+// DropGeoIndex removes the geospatial index of a bucket
+func (tx *Transaction) DropGeoIndex(bucketPath string) error {
+	if err := tx.dropGeoIndex(bucketPath); err != nil {
+		return err
+	}
+	return tx.appendLog(&LogEntry{Op: OpDropGeoIndex, Bucket: bucketPath})
+}
+
+func (tx *Transaction) dropGeoIndex(bucketPath string) error {
+	geo := tx.getMetaBucket("geo")
+	if geo == nil || geo.Bucket([]byte(bucketPath)) == nil {
+		return nil
+	}
+	return geo.DeleteBucket([]byte(bucketPath))
+}
+
+// GetGeoIndex returns the geospatial index configuration of a bucket or nil if there is none
+func (tx *Transaction) GetGeoIndex(bucketPath string) (*GeoIndex, error) {
+	idx := tx.getMetaBucket("geo", bucketPath)
+	if idx == nil {
+		return nil, nil
+	}
+	index := &GeoIndex{}
+	if err := json.Unmarshal(idx.Get(geoConfigKey), index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// FindNear returns the docs of a bucket within radius meters of a point, nearest first
+func (tx *Transaction) FindNear(bucketPath string, lat, lon, radius float64) (res chan *Pair, err error) {
+	defer tx.db.observe("findNear", time.Now(), &err)
+	if radius < 0 {
+		return nil, errors.New("negative radius")
+	}
+	// the bounding box of the circle, over the poles all longitudes are covered
+	dLat := radius / earthRadius * 180 / math.Pi
+	box := BBox{math.Max(lat-dLat, -90), -180, math.Min(lat+dLat, 90), 180}
+	if box.MinLat > -90 && box.MaxLat < 90 {
+		dLon := math.Asin(math.Min(math.Sin(radius/earthRadius)/math.Cos(lat*math.Pi/180), 1)) * 180 / math.Pi
+		if dLon < 180 {
+			box.MinLon, box.MaxLon = normalizeLon(lon-dLon), normalizeLon(lon+dLon)
+		}
+	}
+	return tx.findGeo(bucketPath, box, lat, lon, func(pLat, pLon, distance float64) bool {
+		return distance <= radius
+	})
+}
+
+// FindWithin returns the docs of a bucket inside a bounding box, nearest to the center of the box first
+func (tx *Transaction) FindWithin(bucketPath string, box BBox) (res chan *Pair, err error) {
+	defer tx.db.observe("findWithin", time.Now(), &err)
+	if box.MinLat > box.MaxLat {
+		return nil, errors.New("minLat is greater than maxLat")
+	}
+	centerLat := (box.MinLat + box.MaxLat) / 2
+	centerLon := (box.MinLon + box.MaxLon) / 2
+	if box.MinLon > box.MaxLon {
+		centerLon = normalizeLon(centerLon + 180)
+	}
+	return tx.findGeo(bucketPath, box, centerLat, centerLon, func(pLat, pLon, distance float64) bool {
+		return box.contains(pLat, pLon)
+	})
+}
+
+// findGeo scans the index cells covering a box, keeps the points accepted by match and streams their docs
+// sorted by distance to lat/lon
+func (tx *Transaction) findGeo(bucketPath string, box BBox, lat, lon float64, match func(pLat, pLon, distance float64) bool) (chan *Pair, error) {
+	index, err := tx.GetGeoIndex(bucketPath)
+	if err != nil {
+		return nil, err
+	}
+	if index == nil {
+		return nil, errors.New("no geo index on bucket")
+	}
+	bucket, err := tx.getBucket(bucketPath)
+	if err != nil {
+		return nil, err
+	}
+	type hit struct {
+		key      string
+		distance float64
+	}
+	var hits []hit
+	scanned := 0
+	if cells := tx.getMetaBucket("geo", bucketPath).Bucket(geoCellsKey); cells != nil {
+		c := cells.Cursor()
+		for _, cell := range coveringCells(box) {
+			prefix := []byte(cell)
+			for k, v := c.Seek(prefix); k != nil && len(k) >= geohashPrecision && string(k[:len(prefix)]) == cell; k, v = c.Next() {
+				scanned++
+				pLat, pLon := decodePoint(v)
+				distance := haversine(lat, lon, pLat, pLon)
+				if match(pLat, pLon, distance) {
+					hits = append(hits, hit{string(k[geohashPrecision:]), distance})
+				}
+			}
+		}
+	}
+	tx.db.observeScanned("geo", scanned)
+	tx.db.observeMatched("geo", len(hits))
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].distance != hits[j].distance {
+			return hits[i].distance < hits[j].distance
+		}
+		return hits[i].key < hits[j].key
+	})
+
+	returnChannel := make(chan *Pair, 64)
+	go func() {
+		defer close(returnChannel)
+		defer tx.Close()
+		for _, h := range hits {
+			value, e := tx.bytesToData(bucket.Get([]byte(h.key)))
+			if e != nil {
+				continue
+			}
+			returnChannel <- &Pair{h.key, value}
+		}
+	}()
+	return returnChannel, nil
+}
+
+// indexGeo (re)indexes a doc if its bucket has a geo index
+func (tx *Transaction) indexGeo(bucketPath, key string, doc map[string]interface{}) error {
+	index, err := tx.GetGeoIndex(bucketPath)
+	if err != nil || index == nil {
+		return err
+	}
+	if err = tx.unindexGeo(bucketPath, key); err != nil {
+		return err
+	}
+	lat, okLat := toFloat(valueAt(doc, index.LatField))
+	lon, okLon := toFloat(valueAt(doc, index.LonField))
+	if !okLat || !okLon || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return nil
+	}
+	idx := tx.getMetaBucket("geo", bucketPath)
+	cells, err := idx.CreateBucketIfNotExists(geoCellsKey)
+	if err != nil {
+		return err
+	}
+	docs, err := idx.CreateBucketIfNotExists(geoDocsKey)
+	if err != nil {
+		return err
+	}
+	hash := geohash(lat, lon, geohashPrecision)
+	if err = cells.Put([]byte(hash+key), encodePoint(lat, lon)); err != nil {
+		return err
+	}
+	return docs.Put([]byte(key), []byte(hash))
+}
+
+// unindexGeo removes a doc from the geo index of its bucket
+func (tx *Transaction) unindexGeo(bucketPath, key string) error {
+	idx := tx.getMetaBucket("geo", bucketPath)
+	if idx == nil || idx.Bucket(geoDocsKey) == nil {
+		return nil
+	}
+	docs, cells := idx.Bucket(geoDocsKey), idx.Bucket(geoCellsKey)
+	hash := docs.Get([]byte(key))
+	if hash == nil {
+		return nil
+	}
+	if err := cells.Delete(append(append([]byte{}, hash...), key...)); err != nil {
+		return err
+	}
+	return docs.Delete([]byte(key))
+}
+
+func (box BBox) contains(lat, lon float64) bool {
+	if lat < box.MinLat || lat > box.MaxLat {
+		return false
+	}
+	if box.MinLon <= box.MaxLon {
+		return lon >= box.MinLon && lon <= box.MaxLon
+	}
+	return lon >= box.MinLon || lon <= box.MaxLon
+}
+
+// coveringCells returns the geohash prefixes of the cells covering a box, using the finest precision
+// which needs at most geoMaxCells cells
+func coveringCells(box BBox) []string {
+	lonRanges := [][2]float64{{box.MinLon, box.MaxLon}}
+	if box.MinLon > box.MaxLon {
+		lonRanges = [][2]float64{{box.MinLon, 180}, {-180, box.MaxLon}}
+	}
+	var best []string
+	for precision := 1; precision <= geohashPrecision; precision++ {
+		latBits := uint(5 * precision / 2)
+		lonBits := uint(5*precision) - latBits
+		latStep, lonStep := 180/math.Ldexp(1, int(latBits)), 360/math.Ldexp(1, int(lonBits))
+		count := 0
+		for _, r := range lonRanges {
+			count += cellCount(box.MinLat+90, box.MaxLat+90, latStep) * cellCount(r[0]+180, r[1]+180, lonStep)
+		}
+		if count > geoMaxCells && best != nil {
+			break
+		}
+		seen := make(map[string]bool)
+		best = nil
+		for _, r := range lonRanges {
+			for lat := cellCenter(box.MinLat+90, latStep) - 90; lat <= box.MaxLat+latStep/2 && lat < 90; lat += latStep {
+				for lon := cellCenter(r[0]+180, lonStep) - 180; lon <= r[1]+lonStep/2 && lon < 180; lon += lonStep {
+					cell := geohash(lat, lon, precision)
+					if !seen[cell] {
+						seen[cell] = true
+						best = append(best, cell)
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(best)
+	return best
+}
+
+// cellCount returns the number of cells of a size touched by the range from-to, both shifted to be >= 0
+func cellCount(from, to, step float64) int {
+	return int(math.Floor(to/step)-math.Floor(from/step)) + 1
+}
+
+// cellCenter returns the center of the cell containing v, shifted to be >= 0
+func cellCenter(v, step float64) float64 {
+	return (math.Floor(v/step) + 0.5) * step
+}
+
+// geohash encodes a point with the given number of characters
+func geohash(lat, lon float64, precision int) string {
+	latMin, latMax, lonMin, lonMax := -90.0, 90.0, -180.0, 180.0
+	hash := make([]byte, 0, precision)
+	bit, ch, even := 0, 0, true
+	for len(hash) < precision {
+		if even {
+			mid := (lonMin + lonMax) / 2
+			if lon >= mid {
+				ch = ch<<1 | 1
+				lonMin = mid
+			} else {
+				ch <<= 1
+				lonMax = mid
+			}
+		} else {
+			mid := (latMin + latMax) / 2
+			if lat >= mid {
+				ch = ch<<1 | 1
+				latMin = mid
+			} else {
+				ch <<= 1
+				latMax = mid
+			}
+		}
+		even = !even
+		if bit++; bit == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// haversine returns the great-circle distance between two points in meters
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(math.Sqrt(a), 1))
+}
+
+func normalizeLon(lon float64) float64 {
+	for lon > 180 {
+		lon -= 360
+	}
+	for lon < -180 {
+		lon += 360
+	}
+	return lon
+}
+
+func encodePoint(lat, lon float64) []byte {
+	bs := make([]byte, 16)
+	binary.BigEndian.PutUint64(bs, math.Float64bits(lat))
+	binary.BigEndian.PutUint64(bs[8:], math.Float64bits(lon))
+	return bs
+}
+
+func decodePoint(bs []byte) (float64, float64) {
+	return math.Float64frombits(binary.BigEndian.Uint64(bs)), math.Float64frombits(binary.BigEndian.Uint64(bs[8:]))
+}
+
+// toFloat converts the numbers found in docs to float64
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
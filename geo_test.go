@@ -0,0 +1,86 @@
+package boltplus
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func setupGeoDB(t *testing.T) *DB {
+	db, _ := setupCleanDB()
+	db.Put("cities", "berlin", Object{"lat": 52.52, "lon": 13.405})
+	db.Put("cities", "potsdam", Object{"lat": 52.3906, "lon": 13.0645})
+	db.Put("cities", "hamburg", Object{"lat": 53.5511, "lon": 9.9937})
+	db.Put("cities", "paris", Object{"lat": 48.8566, "lon": 2.3522})
+	db.Put("cities", "nowhere", Object{"name": "no coordinates"})
+	if err := db.CreateGeoIndex("cities", nil); err != nil {
+		t.Fatal(err)
+	}
+	// indexed on put as well
+	db.Put("cities", "suva", Object{"lat": -18.1248, "lon": 178.4501})
+	db.Put("cities", "apia", Object{"lat": -13.8507, "lon": -171.7514})
+	return db
+}
+
+func TestGeohash(t *testing.T) {
+	if hash := geohash(57.64911, 10.40744, 11); hash != "u4pruydqqvj" {
+		t.Errorf("wanted u4pruydqqvj got %v", hash)
+	}
+	if d := haversine(52.52, 13.405, 48.8566, 2.3522); math.Abs(d-877500) > 2000 {
+		t.Errorf("wanted about 877.5km from Berlin to Paris got %v", d)
+	}
+}
+
+func TestFindNear(t *testing.T) {
+	db := setupGeoDB(t)
+	defer db.Close()
+	for _, c := range []struct {
+		radius float64
+		expect []string
+	}{
+		{1000, []string{"berlin"}},
+		{50000, []string{"berlin", "potsdam"}},
+		{300000, []string{"berlin", "potsdam", "hamburg"}},
+		{1000000, []string{"berlin", "potsdam", "hamburg", "paris"}},
+	} {
+		ch, err := db.FindNear("cities", 52.52, 13.4, c.radius)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := collectKeys(ch); !reflect.DeepEqual(keys, c.expect) {
+			t.Errorf("radius %v: wanted %v got %v", c.radius, c.expect, keys)
+		}
+	}
+	// across the antimeridian
+	ch, _ := db.FindNear("cities", -16, 180, 1000000)
+	if keys := collectKeys(ch); !reflect.DeepEqual(keys, []string{"suva", "apia"}) {
+		t.Errorf("wanted suva and apia got %v", keys)
+	}
+}
+
+func TestFindWithin(t *testing.T) {
+	db := setupGeoDB(t)
+	defer db.Close()
+	ch, err := db.FindWithin("cities", BBox{MinLat: 52, MinLon: 9, MaxLat: 54, MaxLon: 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := collectKeys(ch); !reflect.DeepEqual(keys, []string{"hamburg", "potsdam", "berlin"}) {
+		t.Errorf("wanted hamburg, potsdam, berlin got %v", keys)
+	}
+	ch, _ = db.FindWithin("cities", BBox{MinLat: -20, MinLon: 170, MaxLat: -10, MaxLon: -170})
+	if keys := collectKeys(ch); len(keys) != 2 {
+		t.Errorf("wanted suva and apia got %v", keys)
+	}
+
+	// moved and deleted docs leave the index
+	db.Put("cities", "berlin", Object{"lat": 0, "lon": 0})
+	db.Delete("cities", "potsdam")
+	ch, _ = db.FindWithin("cities", BBox{MinLat: 52, MinLon: 9, MaxLat: 54, MaxLon: 14})
+	if keys := collectKeys(ch); !reflect.DeepEqual(keys, []string{"hamburg"}) {
+		t.Errorf("wanted hamburg got %v", keys)
+	}
+	if _, err = db.FindWithin("other", BBox{}); err == nil {
+		t.Error("wanted error without geo index")
+	}
+}
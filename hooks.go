@@ -0,0 +1,159 @@
+package boltplus
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PutHook is called when a doc is written. Before-put hooks may modify the doc or reject it by returning an error,
+// they get a copy, so the doc passed to Put stays unchanged.
+// Hooks run inside the writing transaction, so they can read and write other docs and an error rolls back everything.
+type PutHook func(tx *Transaction, bucketPath, key string, doc map[string]interface{}) error
+
+// DeleteHook is called when a doc is deleted. Before-delete hooks may reject the delete by returning an error.
+type DeleteHook func(tx *Transaction, bucketPath, key string) error
+
+type hookKind int
+
+const (
+	beforePut hookKind = iota
+	afterPut
+	beforeDelete
+	afterDelete
+)
+
+type hook struct {
+	kind     hookKind
+	pattern  string
+	onPut    PutHook
+	onDelete DeleteHook
+}
+
+type hooks struct {
+	mu    sync.RWMutex
+	hooks []hook
+}
+
+// BeforePut registers a hook running before docs are written to buckets matching the pattern.
+// Patterns are dotted bucket paths where * matches a single path segment, e.g. "users.*".
+func (db *DB) BeforePut(pattern string, fn PutHook) error {
+	return db.hooks.add(hook{kind: beforePut, pattern: pattern, onPut: fn})
+}
+
+// AfterPut registers a hook running after docs are written to buckets matching the pattern
+func (db *DB) AfterPut(pattern string, fn PutHook) error {
+	return db.hooks.add(hook{kind: afterPut, pattern: pattern, onPut: fn})
+}
+
+// BeforeDelete registers a hook running before docs are deleted from buckets matching the pattern
+func (db *DB) BeforeDelete(pattern string, fn DeleteHook) error {
+	return db.hooks.add(hook{kind: beforeDelete, pattern: pattern, onDelete: fn})
+}
+
+// AfterDelete registers a hook running after docs are deleted from buckets matching the pattern
+func (db *DB) AfterDelete(pattern string, fn DeleteHook) error {
+	return db.hooks.add(hook{kind: afterDelete, pattern: pattern, onDelete: fn})
+}
+
+// StampTime returns a hook which sets a field to the current time in RFC 3339 format, use it with BeforePut
+func StampTime(field string) PutHook {
+	return func(tx *Transaction, bucketPath, key string, doc map[string]interface{}) error {
+		doc[field] = time.Now().UTC().Format(time.RFC3339Nano)
+		return nil
+	}
+}
+
+// RegisterStandardHooks registers the hooks the commands offer as flags. stampUpdated is a comma separated
+// list of bucket patterns whose docs get an updatedAt timestamp on every write (see StampTime).
+func RegisterStandardHooks(db *DB, stampUpdated string) error {
+	if stampUpdated == "" {
+		return nil
+	}
+	for _, pattern := range strings.Split(stampUpdated, ",") {
+		if err := db.BeforePut(pattern, StampTime("updatedAt")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *hooks) add(hk hook) error {
+	if _, err := path.Match(hookPath(hk.pattern), ""); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks = append(h.hooks, hk)
+	return nil
+}
+
+// matching returns the hooks of a kind whose pattern matches the bucket path, in registration order
+func (h *hooks) matching(kind hookKind, bucketPath string) []hook {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var res []hook
+	for _, hk := range h.hooks {
+		if hk.kind != kind {
+			continue
+		}
+		if ok, _ := path.Match(hookPath(hk.pattern), hookPath(bucketPath)); ok {
+			res = append(res, hk)
+		}
+	}
+	return res
+}
+
+// beforePutDoc runs the before-put hooks on a copy of the doc and returns it
+func (tx *Transaction) beforePutDoc(bucketPath, key string, doc map[string]interface{}) (map[string]interface{}, error) {
+	if len(tx.db.hooks.matching(beforePut, bucketPath)) == 0 {
+		return doc, nil
+	}
+	doc = copyValue(doc).(map[string]interface{})
+	return doc, tx.runPutHooks(beforePut, bucketPath, key, doc)
+}
+
+func (tx *Transaction) runPutHooks(kind hookKind, bucketPath, key string, doc map[string]interface{}) error {
+	for _, hk := range tx.db.hooks.matching(kind, bucketPath) {
+		if err := hk.onPut(tx, bucketPath, key, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *Transaction) runDeleteHooks(kind hookKind, bucketPath, key string) error {
+	for _, hk := range tx.db.hooks.matching(kind, bucketPath) {
+		if err := hk.onDelete(tx, bucketPath, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyValue deep copies the maps and slices of a decoded JSON value
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			res[k] = copyValue(elem)
+		}
+		return res
+	case Object:
+		return copyValue(map[string]interface{}(v))
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, elem := range v {
+			res[i] = copyValue(elem)
+		}
+		return res
+	}
+	return value
+}
+
+// hookPath converts a dotted bucket path to a slash separated one, so path.Match treats the segments correctly
+func hookPath(bucketPath string) string {
+	return strings.Replace(bucketPath, ".", "/", -1)
+}
@@ -0,0 +1,96 @@
+package boltplus
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPutHooks(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.BeforePut("users.*", func(tx *Transaction, bucketPath, key string, doc map[string]interface{}) error {
+		if doc["name"] == "" {
+			return errors.New("name missing")
+		}
+		doc["bucket"] = bucketPath
+		return nil
+	})
+	db.AfterPut("users.*", func(tx *Transaction, bucketPath, key string, doc map[string]interface{}) error {
+		return tx.Put("log", key, map[string]interface{}{"written": bucketPath})
+	})
+
+	if err := db.Put("users.admins", "a", Object{"name": "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if doc, _ := db.Get("users.admins", "a"); doc["bucket"] != "users.admins" {
+		t.Errorf("before-put hook did not modify doc: %v", doc)
+	}
+	if doc, _ := db.Get("log", "a"); doc["written"] != "users.admins" {
+		t.Errorf("after-put hook did not write log: %v", doc)
+	}
+
+	if err := db.Put("users.admins", "b", Object{"name": ""}); err == nil || err.Error() != "name missing" {
+		t.Errorf("wanted rejected put got %v", err)
+	}
+	if doc, _ := db.Get("log", "b"); doc != nil {
+		t.Errorf("rejected put ran after-put hook: %v", doc)
+	}
+
+	// patterns match whole segments only
+	if err := db.Put("users", "c", Object{"name": ""}); err != nil {
+		t.Errorf("hook matched unrelated bucket: %v", err)
+	}
+	if err := db.Put("users.admins.old", "c", Object{"name": ""}); err != nil {
+		t.Errorf("hook matched unrelated bucket: %v", err)
+	}
+}
+
+func TestDeleteHooks(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.Put("test", "keep", Object{"foo": "bar"})
+	db.Put("test", "drop", Object{"foo": "bar"})
+	db.BeforeDelete("test", func(tx *Transaction, bucketPath, key string) error {
+		if key == "keep" {
+			return errors.New("protected")
+		}
+		return nil
+	})
+	deleted := ""
+	db.AfterDelete("*", func(tx *Transaction, bucketPath, key string) error {
+		deleted = key
+		return nil
+	})
+	if err := db.Delete("test", "keep"); err == nil {
+		t.Error("wanted rejected delete")
+	}
+	if doc, _ := db.Get("test", "keep"); doc == nil {
+		t.Error("rejected delete removed doc")
+	}
+	if err := db.Delete("test", "drop"); err != nil || deleted != "drop" {
+		t.Errorf("wanted after-delete hook for drop got %q (%v)", deleted, err)
+	}
+}
+
+func TestStampTime(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	if err := db.BeforePut("[", StampTime("updatedAt")); err == nil {
+		t.Error("wanted error for bad pattern")
+	}
+	if err := RegisterStandardHooks(db, "test,other.*"); err != nil {
+		t.Fatal(err)
+	}
+	doc := Object{"foo": "bar", "nested": Object{"a": 1.}}
+	db.Put("test", "a", doc)
+	if stored, _ := db.Get("test", "a"); stored["updatedAt"] == nil {
+		t.Errorf("wanted updatedAt got %v", stored)
+	}
+	if _, ok := doc["updatedAt"]; ok {
+		t.Errorf("hook modified the doc of the caller: %v", doc)
+	}
+	db.Put("other.bucket", "b", Object{"foo": "bar"})
+	if stored, _ := db.Get("other.bucket", "b"); stored["updatedAt"] == nil {
+		t.Errorf("wanted updatedAt got %v", stored)
+	}
+}
@@ -0,0 +1,84 @@
+// Package jqtransform reshapes boltplus query results with jq expressions.
+//
+// The expression gets the doc as input and its key as $key, e.g.
+//
+//	{name, city: .address.city, id: $key}
+//	select(.age > 30) | {name}
+//
+// An expression producing no output drops the doc, one producing more than one output is an error.
+package jqtransform
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/itchyny/gojq"
+)
+
+// DefaultTimeout is how long the expression may run on a single doc if Options.Timeout is 0
+const DefaultTimeout = 100 * time.Millisecond
+
+// Options configures the compilation of an expression
+type Options struct {
+	// Timeout stops evaluations running longer with an error, 0 means DefaultTimeout
+	Timeout time.Duration
+}
+
+// Transformer is a compiled jq expression, it implements boltplus.Transformer and is safe for concurrent use
+type Transformer struct {
+	expression string
+	code       *gojq.Code
+	timeout    time.Duration
+}
+
+// Compile parses and compiles a jq expression with the default options
+func Compile(expression string) (*Transformer, error) {
+	return CompileWithOptions(expression, nil)
+}
+
+// CompileWithOptions parses and compiles a jq expression
+func CompileWithOptions(expression string, opts *Options) (*Transformer, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	query, err := gojq.Parse(expression)
+	if err != nil {
+		if parseErr, ok := err.(*gojq.ParseError); ok {
+			return nil, fmt.Errorf("invalid jq expression %q at offset %v: %v", expression, parseErr.Offset, err)
+		}
+		return nil, fmt.Errorf("invalid jq expression %q: %v", expression, err)
+	}
+	code, err := gojq.Compile(query, gojq.WithVariables([]string{"$key"}))
+	if err != nil {
+		return nil, fmt.Errorf("invalid jq expression %q: %v", expression, err)
+	}
+	return &Transformer{expression, code, timeout}, nil
+}
+
+// Transform runs the expression on a doc, it returns false if the expression produced no output
+func (t *Transformer) Transform(key string, doc interface{}) (interface{}, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	iter := t.code.RunWithContext(ctx, doc, key)
+	res, ok := iter.Next()
+	if !ok {
+		return nil, false, nil
+	}
+	if err, ok := res.(error); ok {
+		return nil, false, fmt.Errorf("jq %q on %v: %v", t.expression, key, err)
+	}
+	if _, more := iter.Next(); more {
+		return nil, false, fmt.Errorf("jq %q on %v: more than one result, collect them with [...]", t.expression, key)
+	}
+	return res, true, nil
+}
+
+// String returns the expression
+func (t *Transformer) String() string {
+	return t.expression
+}
@@ -0,0 +1,85 @@
+package jqtransform
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/trusch/boltplus"
+)
+
+func TestTransform(t *testing.T) {
+	doc := map[string]interface{}{"name": "Alice", "age": 34.0, "address": map[string]interface{}{"city": "Berlin"}}
+	cases := []struct {
+		expression string
+		expect     interface{}
+		keep       bool
+	}{
+		{"{name, city: .address.city, id: $key}", map[string]interface{}{"name": "Alice", "city": "Berlin", "id": "a"}, true},
+		{"select(.age > 40)", nil, false},
+		{".age + 1", 35.0, true},
+	}
+	for _, c := range cases {
+		tr, err := Compile(c.expression)
+		if err != nil {
+			t.Errorf("%v: %v", c.expression, err)
+			continue
+		}
+		res, keep, err := tr.Transform("a", doc)
+		if err != nil || keep != c.keep || !reflect.DeepEqual(res, c.expect) {
+			t.Errorf("%v: wanted %v (%v) got %v (%v, %v)", c.expression, c.expect, c.keep, res, keep, err)
+		}
+	}
+	tr, _ := Compile(".name, .age")
+	if _, _, err := tr.Transform("a", doc); err == nil {
+		t.Error("wanted error for multiple results")
+	}
+	tr, _ = Compile(".name | error")
+	if _, _, err := tr.Transform("a", doc); err == nil {
+		t.Error("wanted error from jq")
+	}
+	if _, err := Compile("{name"); err == nil {
+		t.Error("wanted error for invalid expression")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	for _, expression := range []string{"[range(1e12)]", "def f: f; f"} {
+		tr, err := CompileWithOptions(expression, &Options{Timeout: 10 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = tr.Transform("a", map[string]interface{}{}); err == nil {
+			t.Errorf("%v: wanted a timeout", expression)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	os.Remove("./test.db")
+	defer os.Remove("./test.db")
+	db, err := boltplus.New("./test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("people", "a", boltplus.Object{"name": "Alice", "age": 20})
+	db.Put("people", "b", boltplus.Object{"name": "Bob", "age": 40})
+	tr, err := Compile("select(.age >= 30) | {name, id: $key}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := db.Query(&boltplus.Query{Bucket: "people", Transform: tr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []*boltplus.Pair
+	for pair := range ch {
+		res = append(res, pair)
+	}
+	expect := []*boltplus.Pair{{Key: "b", Value: map[string]interface{}{"name": "Bob", "id": "b"}}}
+	if !reflect.DeepEqual(res, expect) {
+		t.Errorf("wanted %v got %v", expect, res)
+	}
+}
@@ -0,0 +1,152 @@
+package boltplus
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// ScanOptions control key scans, nil options scan all keys in ascending order
+type ScanOptions struct {
+	// Limit stops the scan after this many keys if > 0
+	Limit int
+	// Reverse scans in descending key order
+	Reverse bool
+}
+
+// Keys streams the keys of all docs in a bucket without reading the docs
+func (tx *Transaction) Keys(bucketPath string, opts *ScanOptions) (chan string, error) {
+	return tx.keys(&Query{Bucket: bucketPath}, opts, "keys")
+}
+
+// KeysPrefix streams the keys with a prefix
+func (tx *Transaction) KeysPrefix(bucketPath, prefix string, opts *ScanOptions) (chan string, error) {
+	if prefix == "" {
+		return nil, errors.New("empty prefix")
+	}
+	return tx.keys(&Query{Bucket: bucketPath, Prefix: prefix}, opts, "keysPrefix")
+}
+
+// KeysRange streams the keys in a range, both bounds are inclusive
+func (tx *Transaction) KeysRange(bucketPath, start, end string, opts *ScanOptions) (chan string, error) {
+	if start == "" || end == "" {
+		return nil, errors.New("empty start/end")
+	}
+	return tx.keys(&Query{Bucket: bucketPath, Start: start, End: end}, opts, "keysRange")
+}
+
+func (tx *Transaction) keys(q *Query, opts *ScanOptions, op string) (chan string, error) {
+	started := time.Now()
+	if opts == nil {
+		opts = &ScanOptions{}
+	}
+	bucket, err := tx.getBucket(q.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	returnChannel := make(chan string, 64)
+	go func() {
+		scanned := 0
+		defer close(returnChannel)
+		defer tx.Close()
+		defer func() { tx.db.observeScan(op, started, scanned) }()
+		c := bucket.Cursor()
+		seek, next, contains := q.seek, c.Next, q.contains
+		if opts.Reverse {
+			seek, next, contains = q.seekLast, c.Prev, q.containsReverse
+		}
+		for k, v := seek(c); contains(k) && (opts.Limit <= 0 || scanned < opts.Limit); k, v = next() {
+			if v == nil {
+				continue
+			}
+			scanned++
+			returnChannel <- string(k)
+		}
+	}()
+	return returnChannel, nil
+}
+
+// seekLast positions the cursor on the last key of the query
+func (q *Query) seekLast(c backendCursor) ([]byte, []byte) {
+	var after []byte
+	switch {
+	case q.Prefix != "":
+		after = prefixEnd([]byte(q.Prefix))
+	case q.End != "":
+		if k, v := c.Seek([]byte(q.End)); k != nil && bytes.Equal(k, []byte(q.End)) {
+			return k, v
+		}
+		after = []byte(q.End)
+	}
+	if after == nil {
+		return c.Last()
+	}
+	if k, _ := c.Seek(after); k == nil {
+		return c.Last()
+	}
+	return c.Prev()
+}
+
+// containsReverse reports whether a descending scan continues with the key
+func (q *Query) containsReverse(k []byte) bool {
+	switch {
+	case k == nil:
+		return false
+	case q.Prefix != "":
+		return bytes.HasPrefix(k, []byte(q.Prefix))
+	case q.Start != "":
+		return bytes.Compare(k, []byte(q.Start)) >= 0
+	}
+	return true
+}
+
+// prefixEnd returns the first key after all keys with the prefix, nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Keys streams the keys of all docs in a bucket without reading the docs
+func (db *DB) Keys(bucketPath string, opts *ScanOptions) (chan string, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := tx.Keys(bucketPath, opts)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
+
+// KeysPrefix streams the keys with a prefix
+func (db *DB) KeysPrefix(bucketPath, prefix string, opts *ScanOptions) (chan string, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := tx.KeysPrefix(bucketPath, prefix, opts)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
+
+// KeysRange streams the keys in a range, both bounds are inclusive
+func (db *DB) KeysRange(bucketPath, start, end string, opts *ScanOptions) (chan string, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := tx.KeysRange(bucketPath, start, end, opts)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
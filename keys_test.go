@@ -0,0 +1,58 @@
+package boltplus
+
+import (
+	"reflect"
+	"testing"
+)
+
+func collectStrings(t *testing.T, ch chan string, err error) []string {
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := []string{}
+	for s := range ch {
+		res = append(res, s)
+	}
+	return res
+}
+
+func TestKeys(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	putN(db, 12)
+	db.Put("bytes", "a\xff", Object{})
+	db.Put("bytes", "a\xff\x01", Object{})
+	db.Put("bytes", "b", Object{})
+
+	ch, err := db.Keys("test.bucket", nil)
+	if keys := collectStrings(t, ch, err); len(keys) != 12 || keys[0] != "0" || keys[11] != "9" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+	cases := []struct {
+		name   string
+		keys   func(opts *ScanOptions) (chan string, error)
+		opts   *ScanOptions
+		expect []string
+	}{
+		{"limit", func(o *ScanOptions) (chan string, error) { return db.Keys("test.bucket", o) }, &ScanOptions{Limit: 3}, []string{"0", "1", "10"}},
+		{"reverse", func(o *ScanOptions) (chan string, error) { return db.Keys("test.bucket", o) }, &ScanOptions{Limit: 2, Reverse: true}, []string{"9", "8"}},
+		{"prefix", func(o *ScanOptions) (chan string, error) { return db.KeysPrefix("test.bucket", "1", o) }, nil, []string{"1", "10", "11"}},
+		{"prefix reverse", func(o *ScanOptions) (chan string, error) { return db.KeysPrefix("test.bucket", "1", o) }, &ScanOptions{Reverse: true}, []string{"11", "10", "1"}},
+		{"prefix 0xff", func(o *ScanOptions) (chan string, error) { return db.KeysPrefix("bytes", "a\xff", o) }, &ScanOptions{Reverse: true}, []string{"a\xff\x01", "a\xff"}},
+		{"range", func(o *ScanOptions) (chan string, error) { return db.KeysRange("test.bucket", "2", "5", o) }, nil, []string{"2", "3", "4", "5"}},
+		{"range reverse", func(o *ScanOptions) (chan string, error) { return db.KeysRange("test.bucket", "2", "5", o) }, &ScanOptions{Reverse: true}, []string{"5", "4", "3", "2"}},
+		{"range reverse between keys", func(o *ScanOptions) (chan string, error) { return db.KeysRange("test.bucket", "11", "55", o) }, &ScanOptions{Reverse: true}, []string{"5", "4", "3", "2", "11"}},
+		{"range reverse after last key", func(o *ScanOptions) (chan string, error) { return db.KeysRange("test.bucket", "8", "z", o) }, &ScanOptions{Reverse: true}, []string{"9", "8"}},
+	}
+	for _, c := range cases {
+		ch, err := c.keys(c.opts)
+		if keys := collectStrings(t, ch, err); !reflect.DeepEqual(keys, c.expect) {
+			t.Errorf("%v: wanted %q got %q", c.name, c.expect, keys)
+		}
+	}
+	// sub-buckets are no docs
+	ch, err = db.Keys("test", nil)
+	if keys := collectStrings(t, ch, err); len(keys) != 0 {
+		t.Errorf("wanted no keys got %v", keys)
+	}
+}
@@ -0,0 +1,562 @@
+package boltplus
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// memoryBackend keeps the buckets in sorted slices. Committed buckets are never modified, write transactions
+// copy the buckets on the path to a change once, so readers keep seeing the state they started with.
+type memoryBackend struct {
+	// writer is held by the write transaction
+	writer sync.Mutex
+	mu     sync.RWMutex
+	root   *memBucket
+	size   int64
+	closed bool
+}
+
+// memBucket holds the entries of a bucket ordered by key, sub-buckets are entries with a child
+type memBucket struct {
+	entries []memEntry
+	seq     uint64
+}
+
+type memEntry struct {
+	key, value []byte
+	child      *memBucket
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{root: &memBucket{}}
+}
+
+func (b *memoryBackend) Begin(writable bool) (backendTx, error) {
+	if writable {
+		b.writer.Lock()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		if writable {
+			b.writer.Unlock()
+		}
+		return nil, bolt.ErrDatabaseNotOpen
+	}
+	tx := &memTx{backend: b, root: b.root, size: b.size, writable: writable}
+	if writable {
+		tx.owned = make(map[*memBucket]bool)
+	}
+	return tx, nil
+}
+
+func (b *memoryBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed, b.root = true, nil
+	return nil
+}
+
+// loadMemoryBackend copies a bolt file into memory
+func loadMemoryBackend(filename string) (*memoryBackend, error) {
+	src, err := bolt.Open(filename, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	b := newMemoryBackend()
+	dst, _ := b.Begin(true)
+	defer dst.Rollback()
+	err = src.View(func(tx *bolt.Tx) error {
+		return (&boltTx{tx}).ForEach(func(name []byte, bucket backendBucket) error {
+			target, e := dst.CreateBucketIfNotExists(name)
+			if e != nil {
+				return e
+			}
+			return copyBackendBucket(target, bucket)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, dst.Commit()
+}
+
+// copyBackendBucket recursively copies the pairs, sub-buckets and sequences of a bucket
+func copyBackendBucket(dst, src backendBucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		sub, err := dst.CreateBucketIfNotExists(k)
+		if err != nil {
+			return err
+		}
+		return copyBackendBucket(sub, src.Bucket(k))
+	})
+}
+
+type memTx struct {
+	backend  *memoryBackend
+	root     *memBucket
+	size     int64
+	writable bool
+	closed   bool
+	// owned are the buckets copied by this transaction, they are modified in place
+	owned map[*memBucket]bool
+	// generation is increased when buckets are copied or deleted, handles resolve their bucket again then
+	generation int
+}
+
+func (tx *memTx) rootHandle() *memHandle {
+	return &memHandle{tx: tx, node: tx.root, generation: tx.generation}
+}
+
+func (tx *memTx) Bucket(name []byte) backendBucket {
+	return tx.rootHandle().Bucket(name)
+}
+
+func (tx *memTx) CreateBucketIfNotExists(name []byte) (backendBucket, error) {
+	return tx.rootHandle().CreateBucketIfNotExists(name)
+}
+
+func (tx *memTx) DeleteBucket(name []byte) error {
+	return tx.rootHandle().DeleteBucket(name)
+}
+
+func (tx *memTx) ForEach(fn func(name []byte, bucket backendBucket) error) error {
+	root := tx.rootHandle()
+	return root.ForEach(func(k, v []byte) error {
+		return fn(k, root.Bucket(k))
+	})
+}
+
+func (tx *memTx) Writable() bool {
+	return tx.writable
+}
+
+// Size is the number of bytes of all keys and values
+func (tx *memTx) Size() int64 {
+	return tx.size
+}
+
+// WriteTo writes the database as bolt file
+func (tx *memTx) WriteTo(w io.Writer) (int64, error) {
+	f, err := ioutil.TempFile("", "boltplus-memory")
+	if err != nil {
+		return 0, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	dst, err := bolt.Open(f.Name(), 0600, nil)
+	if err != nil {
+		return 0, err
+	}
+	err = dst.Update(func(btx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket backendBucket) error {
+			target, e := (&boltTx{btx}).CreateBucketIfNotExists(name)
+			if e != nil {
+				return e
+			}
+			return copyBackendBucket(target, bucket)
+		})
+	})
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return 0, err
+	}
+	if f, err = os.Open(f.Name()); err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+func (tx *memTx) Commit() error {
+	if tx.closed {
+		return bolt.ErrTxClosed
+	}
+	if !tx.writable {
+		return bolt.ErrTxNotWritable
+	}
+	tx.closed = true
+	tx.backend.mu.Lock()
+	tx.backend.root, tx.backend.size = tx.root, tx.size
+	tx.backend.mu.Unlock()
+	tx.backend.writer.Unlock()
+	return nil
+}
+
+func (tx *memTx) Rollback() error {
+	if tx.closed {
+		return bolt.ErrTxClosed
+	}
+	tx.closed = true
+	if tx.writable {
+		tx.backend.writer.Unlock()
+	}
+	return nil
+}
+
+// own copies the buckets on a path which are not owned by the transaction yet and returns the last one
+func (tx *memTx) own(path [][]byte) *memBucket {
+	copied := false
+	if !tx.owned[tx.root] {
+		tx.root = tx.root.clone()
+		tx.owned[tx.root] = true
+		copied = true
+	}
+	node := tx.root
+	for _, name := range path {
+		i, ok := node.find(name)
+		if !ok || node.entries[i].child == nil {
+			return nil
+		}
+		child := node.entries[i].child
+		if !tx.owned[child] {
+			child = child.clone()
+			node.entries[i].child = child
+			tx.owned[child] = true
+			copied = true
+		}
+		node = child
+	}
+	if copied {
+		tx.generation++
+	}
+	return node
+}
+
+func (tx *memTx) resolve(path [][]byte) *memBucket {
+	node := tx.root
+	for _, name := range path {
+		i, ok := node.find(name)
+		if !ok || node.entries[i].child == nil {
+			return nil
+		}
+		node = node.entries[i].child
+	}
+	return node
+}
+
+func (b *memBucket) clone() *memBucket {
+	return &memBucket{entries: append([]memEntry(nil), b.entries...), seq: b.seq}
+}
+
+// find returns the index of a key or where it would be inserted
+func (b *memBucket) find(key []byte) (int, bool) {
+	i := sort.Search(len(b.entries), func(i int) bool { return bytes.Compare(b.entries[i].key, key) >= 0 })
+	return i, i < len(b.entries) && bytes.Equal(b.entries[i].key, key)
+}
+
+func (b *memBucket) insert(i int, entry memEntry) {
+	b.entries = append(b.entries, memEntry{})
+	copy(b.entries[i+1:], b.entries[i:])
+	b.entries[i] = entry
+}
+
+func (b *memBucket) remove(i int) {
+	b.entries = append(b.entries[:i], b.entries[i+1:]...)
+}
+
+// size is the number of bytes of all keys and values of the bucket and its sub-buckets
+func (b *memBucket) size() int64 {
+	var n int64
+	for _, e := range b.entries {
+		n += int64(len(e.key) + len(e.value))
+		if e.child != nil {
+			n += e.child.size()
+		}
+	}
+	return n
+}
+
+func (b *memBucket) stats() bucketStats {
+	stats := bucketStats{KeyN: len(b.entries), BucketN: 1}
+	for _, e := range b.entries {
+		if e.child != nil {
+			sub := e.child.stats()
+			stats.KeyN += sub.KeyN
+			stats.BucketN += sub.BucketN
+		}
+	}
+	return stats
+}
+
+// memHandle is a bucket of a transaction, it is located by its path since write transactions replace
+// the buckets they modify with copies
+type memHandle struct {
+	tx         *memTx
+	path       [][]byte
+	node       *memBucket
+	generation int
+}
+
+func (h *memHandle) bucket() *memBucket {
+	if h.generation != h.tx.generation {
+		h.node, h.generation = h.tx.resolve(h.path), h.tx.generation
+	}
+	return h.node
+}
+
+// writableBucket returns the bucket owned by the transaction, copying it if needed
+func (h *memHandle) writableBucket() (*memBucket, error) {
+	if h.tx.closed {
+		return nil, bolt.ErrTxClosed
+	}
+	if !h.tx.writable {
+		return nil, bolt.ErrTxNotWritable
+	}
+	node := h.bucket()
+	if node == nil {
+		return nil, bolt.ErrBucketNotFound
+	}
+	if !h.tx.owned[node] {
+		node = h.tx.own(h.path)
+		h.node, h.generation = node, h.tx.generation
+	}
+	return node, nil
+}
+
+func (h *memHandle) child(name []byte) *memHandle {
+	path := append(append(make([][]byte, 0, len(h.path)+1), h.path...), append([]byte{}, name...))
+	if !h.tx.writable {
+		// read transactions never change, resolving now keeps handles free of writes so that
+		// parallel query workers can share them
+		return &memHandle{tx: h.tx, path: path, node: h.tx.resolve(path), generation: h.tx.generation}
+	}
+	return &memHandle{tx: h.tx, path: path, generation: -1}
+}
+
+func (h *memHandle) Get(key []byte) []byte {
+	node := h.bucket()
+	if node == nil {
+		return nil
+	}
+	if i, ok := node.find(key); ok && node.entries[i].child == nil {
+		return node.entries[i].value
+	}
+	return nil
+}
+
+func (h *memHandle) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return bolt.ErrKeyRequired
+	}
+	node, err := h.writableBucket()
+	if err != nil {
+		return err
+	}
+	value = append([]byte{}, value...)
+	i, ok := node.find(key)
+	if ok {
+		if node.entries[i].child != nil {
+			return bolt.ErrIncompatibleValue
+		}
+		h.tx.size += int64(len(value) - len(node.entries[i].value))
+		node.entries[i].value = value
+		return nil
+	}
+	h.tx.size += int64(len(key) + len(value))
+	node.insert(i, memEntry{key: append([]byte{}, key...), value: value})
+	return nil
+}
+
+func (h *memHandle) Delete(key []byte) error {
+	node, err := h.writableBucket()
+	if err != nil {
+		return err
+	}
+	i, ok := node.find(key)
+	if !ok {
+		return nil
+	}
+	if node.entries[i].child != nil {
+		return bolt.ErrIncompatibleValue
+	}
+	h.tx.size -= int64(len(key) + len(node.entries[i].value))
+	node.remove(i)
+	return nil
+}
+
+func (h *memHandle) Bucket(name []byte) backendBucket {
+	node := h.bucket()
+	if node == nil {
+		return nil
+	}
+	if i, ok := node.find(name); ok && node.entries[i].child != nil {
+		return h.child(name)
+	}
+	return nil
+}
+
+func (h *memHandle) CreateBucketIfNotExists(name []byte) (backendBucket, error) {
+	if len(name) == 0 {
+		return nil, bolt.ErrBucketNameRequired
+	}
+	node, err := h.writableBucket()
+	if err != nil {
+		return nil, err
+	}
+	i, ok := node.find(name)
+	if ok {
+		if node.entries[i].child == nil {
+			return nil, bolt.ErrIncompatibleValue
+		}
+		return h.child(name), nil
+	}
+	child := &memBucket{}
+	h.tx.owned[child] = true
+	h.tx.size += int64(len(name))
+	node.insert(i, memEntry{key: append([]byte{}, name...), child: child})
+	return h.child(name), nil
+}
+
+func (h *memHandle) DeleteBucket(name []byte) error {
+	node, err := h.writableBucket()
+	if err != nil {
+		return err
+	}
+	i, ok := node.find(name)
+	if !ok {
+		return bolt.ErrBucketNotFound
+	}
+	if node.entries[i].child == nil {
+		return bolt.ErrIncompatibleValue
+	}
+	h.tx.size -= int64(len(name)) + node.entries[i].child.size()
+	node.remove(i)
+	// handles of the deleted buckets must not find them anymore
+	h.tx.generation++
+	h.generation = h.tx.generation
+	return nil
+}
+
+// ForEach calls fn for every pair and sub-bucket, it continues after the last key if fn modifies the bucket
+func (h *memHandle) ForEach(fn func(k, v []byte) error) error {
+	c := h.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *memHandle) Cursor() backendCursor {
+	return &memCursor{handle: h}
+}
+
+func (h *memHandle) Sequence() uint64 {
+	if node := h.bucket(); node != nil {
+		return node.seq
+	}
+	return 0
+}
+
+func (h *memHandle) SetSequence(v uint64) error {
+	node, err := h.writableBucket()
+	if err != nil {
+		return err
+	}
+	node.seq = v
+	return nil
+}
+
+func (h *memHandle) NextSequence() (uint64, error) {
+	node, err := h.writableBucket()
+	if err != nil {
+		return 0, err
+	}
+	node.seq++
+	return node.seq, nil
+}
+
+func (h *memHandle) Stats() bucketStats {
+	if node := h.bucket(); node != nil {
+		return node.stats()
+	}
+	return bucketStats{}
+}
+
+// memCursor remembers the current key instead of a position, so it stays valid when the bucket is modified
+type memCursor struct {
+	handle *memHandle
+	key    []byte
+}
+
+// at moves the cursor to the entry with index i
+func (c *memCursor) at(node *memBucket, i int) ([]byte, []byte) {
+	if node == nil || i < 0 || i >= len(node.entries) {
+		c.key = nil
+		return nil, nil
+	}
+	e := node.entries[i]
+	c.key = e.key
+	return e.key, e.value
+}
+
+func (c *memCursor) First() ([]byte, []byte) {
+	return c.at(c.handle.bucket(), 0)
+}
+
+func (c *memCursor) Last() ([]byte, []byte) {
+	node := c.handle.bucket()
+	if node == nil {
+		return c.at(nil, 0)
+	}
+	return c.at(node, len(node.entries)-1)
+}
+
+func (c *memCursor) Seek(seek []byte) ([]byte, []byte) {
+	node := c.handle.bucket()
+	if node == nil {
+		return c.at(nil, 0)
+	}
+	i, _ := node.find(seek)
+	return c.at(node, i)
+}
+
+func (c *memCursor) Next() ([]byte, []byte) {
+	node := c.handle.bucket()
+	if node == nil || c.key == nil {
+		return c.at(nil, 0)
+	}
+	i, ok := node.find(c.key)
+	if ok {
+		i++
+	}
+	return c.at(node, i)
+}
+
+func (c *memCursor) Prev() ([]byte, []byte) {
+	node := c.handle.bucket()
+	if node == nil || c.key == nil {
+		return c.at(nil, 0)
+	}
+	i, _ := node.find(c.key)
+	return c.at(node, i-1)
+}
+
+func (c *memCursor) Delete() error {
+	if c.key == nil {
+		return nil
+	}
+	node := c.handle.bucket()
+	if i, ok := node.find(c.key); ok && node.entries[i].child != nil {
+		return bolt.ErrIncompatibleValue
+	}
+	return c.handle.Delete(c.key)
+}
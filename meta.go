@@ -0,0 +1,33 @@
+package boltplus
+
+// metaBucket is the reserved top-level bucket where boltplus keeps its own bookkeeping
+// (search indexes and the like). It is hidden from Buckets().
+const metaBucket = "_boltplus"
+
+// getMetaBucket returns the sub-bucket path below the meta bucket or nil if it does not exist.
+// Unlike getBucket it uses the raw names, so the path segments may contain dots.
+func (tx *Transaction) getMetaBucket(path ...string) backendBucket {
+	bucket := tx.tx.Bucket([]byte(metaBucket))
+	for _, name := range path {
+		if bucket == nil {
+			return nil
+		}
+		bucket = bucket.Bucket([]byte(name))
+	}
+	return bucket
+}
+
+// getMetaBucketOrCreate returns the sub-bucket path below the meta bucket, creating it if needed
+func (tx *Transaction) getMetaBucketOrCreate(path ...string) (backendBucket, error) {
+	bucket, err := tx.tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range path {
+		bucket, err = bucket.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bucket, nil
+}
@@ -0,0 +1,282 @@
+package boltplus
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Labels are the dimensions of a metric sample
+type Labels map[string]string
+
+// Metrics receives the instrumentation of a database. Implementations must be safe for concurrent use.
+// PrometheusMetrics is a ready to use implementation, adapters for other systems only need these three methods.
+type Metrics interface {
+	// Add increases a counter
+	Add(name string, labels Labels, delta float64)
+	// Observe records a sample of a distribution, e.g. a duration in seconds
+	Observe(name string, labels Labels, value float64)
+	// Set sets a gauge
+	Set(name string, labels Labels, value float64)
+}
+
+// The metrics recorded by a database
+const (
+	MetricOperations          = "boltplus_operations_total"
+	MetricOperationDuration   = "boltplus_operation_duration_seconds"
+	MetricDocsScanned         = "boltplus_docs_scanned_total"
+	MetricDocsMatched         = "boltplus_docs_matched_total"
+	MetricBytesEncoded        = "boltplus_encoded_bytes_total"
+	MetricBytesDecoded        = "boltplus_decoded_bytes_total"
+	MetricTransactionDuration = "boltplus_transaction_duration_seconds"
+	MetricSize                = "boltplus_db_size_bytes"
+	MetricFilterCache         = "boltplus_filter_cache_total"
+)
+
+// observe records an operation, call it deferred as defer db.observe(op, time.Now(), &err)
+func (db *DB) observe(op string, start time.Time, err *error) {
+	if db.metrics == nil {
+		return
+	}
+	result := "ok"
+	if err != nil && *err != nil {
+		result = "error"
+	}
+	db.metrics.Add(MetricOperations, Labels{"op": op, "result": result}, 1)
+	db.metrics.Observe(MetricOperationDuration, Labels{"op": op}, time.Since(start).Seconds())
+}
+
+// observeScan records a streaming operation once its stream is exhausted
+func (db *DB) observeScan(op string, start time.Time, scanned int) {
+	if db.metrics == nil {
+		return
+	}
+	db.observe(op, start, nil)
+	db.observeScanned(op, scanned)
+}
+
+func (db *DB) observeScanned(op string, scanned int) {
+	if db.metrics != nil {
+		db.metrics.Add(MetricDocsScanned, Labels{"op": op}, float64(scanned))
+	}
+}
+
+func (db *DB) observeMatched(op string, matched int) {
+	if db.metrics != nil {
+		db.metrics.Add(MetricDocsMatched, Labels{"op": op}, float64(matched))
+	}
+}
+
+func (db *DB) observeBytes(name string, n int) {
+	if db.metrics != nil {
+		db.metrics.Add(name, nil, float64(n))
+	}
+}
+
+func (db *DB) observeTx(writable bool, start time.Time) {
+	if db.metrics == nil {
+		return
+	}
+	mode := "read"
+	if writable {
+		mode = "write"
+	}
+	db.metrics.Observe(MetricTransactionDuration, Labels{"mode": mode}, time.Since(start).Seconds())
+}
+
+func (db *DB) observeSize(size int64) {
+	if db.metrics != nil {
+		db.metrics.Set(MetricSize, nil, float64(size))
+	}
+}
+
+func (db *DB) observeFilterCache(result string) {
+	if db.metrics != nil {
+		db.metrics.Add(MetricFilterCache, Labels{"result": result}, 1)
+	}
+}
+
+// DefaultBuckets are the histogram bucket bounds PrometheusMetrics uses, in seconds
+var DefaultBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10}
+
+// PrometheusMetrics collects metrics in memory and writes them in the Prometheus text format
+type PrometheusMetrics struct {
+	// buckets are the sorted upper bounds of the histogram buckets, fixed by NewPrometheusMetrics
+	buckets  []float64
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	kind   string
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	value  float64
+	sum    float64
+	count  uint64
+	bounds []float64
+	counts []uint64
+}
+
+// NewPrometheusMetrics creates an empty collector. The buckets are the upper bounds of the histogram
+// buckets, DefaultBuckets if there are none. It panics if a bound is NaN or given twice.
+func NewPrometheusMetrics(buckets ...float64) *PrometheusMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	bounds := make([]float64, 0, len(buckets))
+	for _, bound := range buckets {
+		if math.IsNaN(bound) {
+			panic("histogram bucket bound is NaN")
+		}
+		// the +Inf bucket is always written
+		if !math.IsInf(bound, 1) {
+			bounds = append(bounds, bound)
+		}
+	}
+	sort.Float64s(bounds)
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] == bounds[i-1] {
+			panic(fmt.Sprintf("histogram bucket bound %v is given twice", bounds[i]))
+		}
+	}
+	return &PrometheusMetrics{buckets: bounds}
+}
+
+// Add increases a counter
+func (m *PrometheusMetrics) Add(name string, labels Labels, delta float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get("counter", name, labels).value += delta
+}
+
+// Set sets a gauge
+func (m *PrometheusMetrics) Set(name string, labels Labels, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get("gauge", name, labels).value = value
+}
+
+// Observe records a sample in a histogram
+func (m *PrometheusMetrics) Observe(name string, labels Labels, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get("histogram", name, labels)
+	if s.counts == nil {
+		s.bounds = m.buckets
+		if s.bounds == nil {
+			s.bounds = DefaultBuckets
+		}
+		s.counts = make([]uint64, len(s.bounds))
+	}
+	for i, bound := range s.bounds {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	m.mu.Lock()
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := m.families[name]
+		fmt.Fprintf(&buf, "# TYPE %v %v\n", name, family.kind)
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := family.series[key]
+			if family.kind != "histogram" {
+				fmt.Fprintf(&buf, "%v%v %v\n", name, braces(key), formatFloat(s.value))
+				continue
+			}
+			for i, bound := range s.bounds {
+				fmt.Fprintf(&buf, "%v_bucket%v %v\n", name, braces(joinLabels(key, "le", formatFloat(bound))), s.counts[i])
+			}
+			fmt.Fprintf(&buf, "%v_bucket%v %v\n", name, braces(joinLabels(key, "le", "+Inf")), s.count)
+			fmt.Fprintf(&buf, "%v_sum%v %v\n", name, braces(key), formatFloat(s.sum))
+			fmt.Fprintf(&buf, "%v_count%v %v\n", name, braces(key), s.count)
+		}
+	}
+	m.mu.Unlock()
+	return buf.WriteTo(w)
+}
+
+func (m *PrometheusMetrics) get(kind, name string, labels Labels) *metricSeries {
+	if m.families == nil {
+		m.families = make(map[string]*metricFamily)
+	}
+	family, ok := m.families[name]
+	if !ok {
+		family = &metricFamily{kind: kind, series: make(map[string]*metricSeries)}
+		m.families[name] = family
+	}
+	key := formatLabels(labels)
+	s, ok := family.series[key]
+	if !ok {
+		s = &metricSeries{}
+		family.series[key] = s
+	}
+	return s
+}
+
+// formatLabels renders labels sorted by name without braces, e.g. a="x",b="y"
+func formatLabels(labels Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=" + quoteLabel(labels[name])
+	}
+	return strings.Join(parts, ",")
+}
+
+func joinLabels(rendered, name, value string) string {
+	label := name + "=" + quoteLabel(value)
+	if rendered == "" {
+		return label
+	}
+	return rendered + "," + label
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func braces(rendered string) string {
+	if rendered == "" {
+		return ""
+	}
+	return "{" + rendered + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,90 @@
+package boltplus
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	os.Remove("./test.db")
+	metrics := NewPrometheusMetrics()
+	db, err := NewWithOptions("./test.db", testOptions(&Options{Metrics: metrics}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("test", "a", Object{"foo": "bar"})
+	db.Put("test", "b", Object{"foo": "baz"})
+	db.Get("test", "a")
+	db.Get("test", "missing")
+	ch, _ := db.Find("test", `.foo == "bar"`)
+	for range ch {
+	}
+
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE boltplus_operations_total counter",
+		`boltplus_operations_total{op="put",result="ok"} 2`,
+		`boltplus_operations_total{op="get",result="ok"} 1`,
+		`boltplus_operations_total{op="get",result="error"} 1`,
+		`boltplus_docs_scanned_total{op="find"} 2`,
+		`boltplus_docs_matched_total{op="find"} 1`,
+		`boltplus_operation_duration_seconds_count{op="put"} 2`,
+		`boltplus_transaction_duration_seconds_bucket{mode="write",le="+Inf"} 2`,
+		"# TYPE boltplus_db_size_bytes gauge",
+		"boltplus_encoded_bytes_total ",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing %q in:\n%v", line, out)
+		}
+	}
+}
+
+func TestPrometheusFormat(t *testing.T) {
+	metrics := NewPrometheusMetrics(2, 1)
+	metrics.Add("c", Labels{"l": "a\"b"}, 1)
+	metrics.Set("g", nil, 3.5)
+	metrics.Observe("h", nil, 1.5)
+	metrics.Observe("h", nil, 0.5)
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	expect := `# TYPE c counter
+c{l="a\"b"} 1
+# TYPE g gauge
+g 3.5
+# TYPE h histogram
+h_bucket{le="1"} 1
+h_bucket{le="2"} 2
+h_bucket{le="+Inf"} 2
+h_sum 2
+h_count 2
+`
+	if buf.String() != expect {
+		t.Errorf("wanted\n%v\ngot\n%v", expect, buf.String())
+	}
+}
+
+func TestPrometheusBuckets(t *testing.T) {
+	metrics := NewPrometheusMetrics(1, math.Inf(1))
+	metrics.Observe("h", nil, 0.5)
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	if strings.Count(buf.String(), `le="+Inf"`) != 1 || !strings.Contains(buf.String(), `h_bucket{le="1"} 1`) {
+		t.Errorf("unexpected histogram:\n%v", buf.String())
+	}
+	for _, bounds := range [][]float64{{1, math.NaN()}, {1, 2, 1}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("wanted panic for bounds %v", bounds)
+				}
+			}()
+			NewPrometheusMetrics(bounds...)
+		}()
+	}
+}
@@ -0,0 +1,117 @@
+package boltplus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MigrationFunc moves the data from the previous version to the version it is registered for
+type MigrationFunc func(tx *Transaction) error
+
+// MigrationStatus describes the applied and pending migrations of a database
+type MigrationStatus struct {
+	Version int   `json:"version"`
+	Pending []int `json:"pending"`
+}
+
+var (
+	migrationsMu sync.Mutex
+	migrations   = make(map[int]MigrationFunc)
+)
+
+var migrationVersionKey = []byte("version")
+
+// RegisterMigration registers a migration step, usually from an init function.
+// Versions must be positive and are applied in ascending order.
+func RegisterMigration(version int, fn MigrationFunc) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	if version <= 0 {
+		panic(fmt.Sprintf("boltplus: invalid migration version %v", version))
+	}
+	if _, ok := migrations[version]; ok {
+		panic(fmt.Sprintf("boltplus: migration %v registered twice", version))
+	}
+	migrations[version] = fn
+}
+
+// MigrationStatus returns the applied version and the pending migrations
+func (db *DB) MigrationStatus() (*MigrationStatus, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	version := tx.migrationVersion()
+	return &MigrationStatus{version, pendingMigrations(version)}, nil
+}
+
+// Migrate applies all pending migrations in order, each in its own transaction.
+// It stops at the first failing migration, which is rolled back, and returns the number of applied ones.
+func (db *DB) Migrate() (int, error) {
+	status, err := db.MigrationStatus()
+	if err != nil {
+		return 0, err
+	}
+	for i, version := range status.Pending {
+		if err = db.applyMigration(version); err != nil {
+			return i, fmt.Errorf("migration %v failed: %v", version, err)
+		}
+	}
+	return len(status.Pending), nil
+}
+
+func (db *DB) applyMigration(version int) error {
+	migrationsMu.Lock()
+	fn := migrations[version]
+	migrationsMu.Unlock()
+	tx, err := db.Tx(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	if current := tx.migrationVersion(); current >= version {
+		// someone else was faster
+		return nil
+	}
+	if err = fn(tx); err != nil {
+		return err
+	}
+	bucket, err := tx.getMetaBucketOrCreate("migrations")
+	if err != nil {
+		return err
+	}
+	bs := make([]byte, 8)
+	binary.BigEndian.PutUint64(bs, uint64(version))
+	if err = bucket.Put(migrationVersionKey, bs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (tx *Transaction) migrationVersion() int {
+	bucket := tx.getMetaBucket("migrations")
+	if bucket == nil {
+		return 0
+	}
+	bs := bucket.Get(migrationVersionKey)
+	if len(bs) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(bs))
+}
+
+func pendingMigrations(version int) []int {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	res := []int{}
+	for v := range migrations {
+		if v > version {
+			res = append(res, v)
+		}
+	}
+	sort.Ints(res)
+	return res
+}
@@ -0,0 +1,71 @@
+package boltplus
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func resetMigrations() {
+	migrationsMu.Lock()
+	migrations = make(map[int]MigrationFunc)
+	migrationsMu.Unlock()
+}
+
+func TestMigrate(t *testing.T) {
+	defer resetMigrations()
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.Put("people", "1", Object{"name": "Alice Smith"})
+
+	RegisterMigration(2, func(tx *Transaction) error {
+		doc, err := tx.Get("people", "1")
+		if err != nil {
+			return err
+		}
+		doc["version"] = 2.
+		return tx.Put("people", "1", doc)
+	})
+	RegisterMigration(1, func(tx *Transaction) error {
+		return tx.Put("people", "1", map[string]interface{}{"first": "Alice", "last": "Smith"})
+	})
+
+	if status, err := db.MigrationStatus(); err != nil || status.Version != 0 || !reflect.DeepEqual(status.Pending, []int{1, 2}) {
+		t.Errorf("unexpected status %v (%v)", status, err)
+	}
+	if n, err := db.Migrate(); err != nil || n != 2 {
+		t.Errorf("wanted 2 applied migrations got %v (%v)", n, err)
+	}
+	expect := Object{"first": "Alice", "last": "Smith", "version": 2.}
+	if result, _ := db.Get("people", "1"); !reflect.DeepEqual(result, expect) {
+		t.Errorf("wanted %v got %v", expect, result)
+	}
+	if n, err := db.Migrate(); err != nil || n != 0 {
+		t.Errorf("second migrate should be a noop, applied %v (%v)", n, err)
+	}
+}
+
+func TestMigrateFailureRollsBack(t *testing.T) {
+	skipInMemory(t)
+	defer resetMigrations()
+	db, _ := setupCleanDB()
+	db.Close()
+	RegisterMigration(1, func(tx *Transaction) error {
+		return tx.Put("people", "1", map[string]interface{}{})
+	})
+	RegisterMigration(2, func(tx *Transaction) error {
+		tx.Put("people", "2", map[string]interface{}{})
+		return errors.New("broken")
+	})
+	if _, err := NewWithOptions("./test.db", testOptions(&Options{Migrate: true})); err == nil {
+		t.Fatal("open should fail with a broken migration")
+	}
+	db, _ = NewWithOptions("./test.db", testOptions(nil))
+	defer db.Close()
+	if status, _ := db.MigrationStatus(); status.Version != 1 {
+		t.Errorf("wanted version 1 got %v", status.Version)
+	}
+	if _, err := db.Get("people", "2"); err == nil {
+		t.Error("changes of the failed migration should be rolled back")
+	}
+}
@@ -0,0 +1,307 @@
+package boltplus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// The operations recorded in the log
+const (
+	OpPut      = "put"
+	OpPutValue = "putValue"
+	OpPutRaw   = "putRaw"
+	// OpPutAttachmentChunk carries a chunk of an upload, OpPutAttachment completes the upload
+	OpPutAttachmentChunk = "putAttachmentChunk"
+	OpPutAttachment      = "putAttachment"
+	OpDeleteAttachment   = "deleteAttachment"
+	OpDelete             = "delete"
+	OpSetSchema          = "setSchema"
+	OpCreateSearchIndex  = "createSearchIndex"
+	OpDropSearchIndex    = "dropSearchIndex"
+	OpCreateGeoIndex     = "createGeoIndex"
+	OpDropGeoIndex       = "dropGeoIndex"
+	// OpRestore marks that a backup replaced the database, replicas have to restore a backup then
+	OpRestore = "restore"
+)
+
+// ErrLogTruncated is returned when log entries were requested which are no longer available
+// or when an OpRestore entry is applied. A replica has to restore a backup of the primary then.
+var ErrLogTruncated = errors.New("log truncated")
+
+// LogEntry is a single write operation in the log
+type LogEntry struct {
+	Seq    uint64                 `json:"seq"`
+	Op     string                 `json:"op"`
+	Bucket string                 `json:"bucket"`
+	Key    string                 `json:"key,omitempty"`
+	Value  map[string]interface{} `json:"value,omitempty"`
+	// Data is the JSON encoding of the value of OpPutValue and the bytes of OpPutRaw
+	Data []byte `json:"data,omitempty"`
+}
+
+var appliedSeqKey = []byte("applied")
+
+// appendLog records an operation if the database keeps a log. Entries are encoded like docs,
+// so they are compressed and encrypted as well.
+func (tx *Transaction) appendLog(entry *LogEntry) error {
+	if tx.recording {
+		recorded := *entry
+		tx.recorded = append(tx.recorded, &recorded)
+		return nil
+	}
+	if !tx.db.oplog || tx.applying {
+		return nil
+	}
+	bucket, err := tx.getMetaBucketOrCreate("oplog")
+	if err != nil {
+		return err
+	}
+	if entry.Seq, err = bucket.NextSequence(); err != nil {
+		return err
+	}
+	bs, err := tx.dataToBytes(entry)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(encodeSeq(entry.Seq), bs)
+}
+
+// ReadLog streams the log entries following the sequence number from, at most limit entries if limit > 0
+func (tx *Transaction) ReadLog(from uint64, limit int) (chan *LogEntry, error) {
+	bucket := tx.getMetaBucket("oplog")
+	if bucket == nil {
+		if from > 0 {
+			return nil, ErrLogTruncated
+		}
+	} else if k, _ := bucket.Cursor().First(); (k == nil && bucket.Sequence() > from) || (k != nil && decodeSeq(k) > from+1) {
+		return nil, ErrLogTruncated
+	}
+	returnChannel := make(chan *LogEntry, 64)
+	go func() {
+		defer close(returnChannel)
+		defer tx.Close()
+		if bucket == nil {
+			return
+		}
+		c := bucket.Cursor()
+		n := 0
+		for k, v := c.Seek(encodeSeq(from + 1)); k != nil && (limit <= 0 || n < limit); k, v = c.Next() {
+			entry := &LogEntry{}
+			if err := tx.decodeBytes(v, entry); err != nil {
+				log.Print(err)
+				return
+			}
+			returnChannel <- entry
+			n++
+		}
+	}()
+	return returnChannel, nil
+}
+
+// LastSequence returns the sequence number of the latest log entry contained in the database,
+// on replicas this is the latest applied entry
+func (tx *Transaction) LastSequence() uint64 {
+	var seq uint64
+	if bucket := tx.getMetaBucket("oplog"); bucket != nil {
+		seq = bucket.Sequence()
+	}
+	if bucket := tx.getMetaBucket("replication"); bucket != nil {
+		if bs := bucket.Get(appliedSeqKey); len(bs) == 8 && decodeSeq(bs) > seq {
+			seq = decodeSeq(bs)
+		}
+	}
+	return seq
+}
+
+// TruncateLog removes all log entries up to and including the sequence number before
+func (tx *Transaction) TruncateLog(before uint64) (int, error) {
+	bucket := tx.getMetaBucket("oplog")
+	if bucket == nil {
+		return 0, nil
+	}
+	n := 0
+	c := bucket.Cursor()
+	for k, _ := c.First(); k != nil && decodeSeq(k) <= before; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// applyLog applies entries of another database's log. Entries which are already contained are skipped,
+// so applying the same entries twice is fine.
+func (tx *Transaction) applyLog(entries []*LogEntry) (int, error) {
+	tx.applying = true
+	defer func() { tx.applying = false }()
+	last := tx.LastSequence()
+	n := 0
+	for _, entry := range entries {
+		if entry.Seq <= last {
+			continue
+		}
+		if entry.Seq != last+1 {
+			return n, fmt.Errorf("log entry %v missing", last+1)
+		}
+		if entry.Op == OpRestore {
+			return n, ErrLogTruncated
+		}
+		if err := tx.applyEntry(entry); err != nil {
+			return n, fmt.Errorf("applying log entry %v: %v", entry.Seq, err)
+		}
+		last = entry.Seq
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	bucket, err := tx.getMetaBucketOrCreate("replication")
+	if err != nil {
+		return 0, err
+	}
+	return n, bucket.Put(appliedSeqKey, encodeSeq(last))
+}
+
+func (tx *Transaction) applyEntry(entry *LogEntry) error {
+	switch entry.Op {
+	case OpPut:
+		return tx.put(entry.Bucket, entry.Key, entry.Value)
+	case OpPutValue:
+		return tx.putValue(entry.Bucket, entry.Key, kindJSON, entry.Data)
+	case OpPutRaw:
+		return tx.putValue(entry.Bucket, entry.Key, kindRaw, entry.Data)
+	case OpPutAttachmentChunk:
+		name, _ := entry.Value["name"].(string)
+		id, _ := entry.Value["upload"].(float64)
+		index, _ := entry.Value["index"].(float64)
+		return tx.putChunk(entry.Bucket, entry.Key, name, uint64(id), uint64(index), entry.Data)
+	case OpPutAttachment:
+		info, err := attachmentFromMap(entry.Value)
+		if err != nil {
+			return err
+		}
+		return tx.putAttachmentInfo(entry.Bucket, entry.Key, info)
+	case OpDeleteAttachment:
+		name, _ := entry.Value["name"].(string)
+		return tx.deleteAttachment(entry.Bucket, entry.Key, name)
+	case OpDelete:
+		return tx.delete(entry.Bucket, entry.Key)
+	case OpSetSchema:
+		return tx.SetSchema(entry.Bucket, entry.Value)
+	case OpCreateSearchIndex:
+		index := &SearchIndex{}
+		index.Language, _ = entry.Value["language"].(string)
+		fields, _ := entry.Value["fields"].([]interface{})
+		for _, field := range fields {
+			index.Fields = append(index.Fields, fmt.Sprint(field))
+		}
+		return tx.CreateSearchIndex(entry.Bucket, index)
+	case OpDropSearchIndex:
+		return tx.DropSearchIndex(entry.Bucket)
+	case OpCreateGeoIndex:
+		index := &GeoIndex{}
+		index.LatField, _ = entry.Value["latField"].(string)
+		index.LonField, _ = entry.Value["lonField"].(string)
+		return tx.CreateGeoIndex(entry.Bucket, index)
+	case OpDropGeoIndex:
+		return tx.DropGeoIndex(entry.Bucket)
+	}
+	return fmt.Errorf("unknown operation %q", entry.Op)
+}
+
+// ReadLog streams the log entries following the sequence number from, at most limit entries if limit > 0
+func (db *DB) ReadLog(from uint64, limit int) (chan *LogEntry, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := tx.ReadLog(from, limit)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
+
+// ApplyLog applies entries read from the log of a primary in a single transaction and returns the number of
+// applied entries. Entries are applied without hooks and validation, the primary already ran them.
+func (db *DB) ApplyLog(entries []*LogEntry) (int, error) {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+	n, err := tx.applyLog(entries)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// Record runs fn in a write transaction which is rolled back afterwards and returns the log entries of its writes.
+// Hooks and validation run while recording, so applying the entries with ApplyEntries writes the same docs
+// to every database, e.g. to all nodes of a cluster.
+func (db *DB) Record(fn func(tx *Transaction) error) ([]*LogEntry, error) {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	tx.recording = true
+	if err = fn(tx); err != nil {
+		return nil, err
+	}
+	return tx.recorded, nil
+}
+
+// ApplyEntries applies recorded log entries in a single transaction without hooks and validation.
+// Unlike ApplyLog it ignores the sequence numbers, the entries are logged as new writes.
+func (db *DB) ApplyEntries(entries []*LogEntry) error {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	for _, entry := range entries {
+		if err = tx.applyEntry(entry); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LastSequence returns the sequence number of the latest log entry contained in the database
+func (db *DB) LastSequence() (uint64, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+	return tx.LastSequence(), nil
+}
+
+// TruncateLog removes all log entries up to and including the sequence number before
+func (db *DB) TruncateLog(before uint64) (int, error) {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+	n, err := tx.TruncateLog(before)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func encodeSeq(seq uint64) []byte {
+	bs := make([]byte, 8)
+	binary.BigEndian.PutUint64(bs, seq)
+	return bs
+}
+
+func decodeSeq(bs []byte) uint64 {
+	return binary.BigEndian.Uint64(bs)
+}
@@ -0,0 +1,200 @@
+package boltplus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func setupLoggedDB(t *testing.T) (*DB, *DB) {
+	os.Remove("./test.db")
+	os.Remove("./replica.db")
+	primary, err := NewWithOptions("./test.db", testOptions(&Options{OpLog: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := NewWithOptions("./replica.db", testOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return primary, replica
+}
+
+func readLog(t *testing.T, db *DB, from uint64) []*LogEntry {
+	ch, err := db.ReadLog(from, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []*LogEntry
+	for entry := range ch {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestReplication(t *testing.T) {
+	primary, replica := setupLoggedDB(t)
+	defer primary.Close()
+	defer replica.Close()
+	defer os.Remove("./replica.db")
+	// hooks ran on the primary already
+	replica.BeforePut("*", func(tx *Transaction, bucketPath, key string, doc map[string]interface{}) error {
+		return errors.New("hook ran on replica")
+	})
+
+	primary.CreateSearchIndex("test", &SearchIndex{Fields: []string{"text"}, Language: "en"})
+	primary.Put("test", "a", Object{"text": "hello world"})
+	primary.Put("test", "b", Object{"text": "goodbye"})
+	primary.Delete("test", "b")
+	primary.SetSchema("test", map[string]interface{}{"required": []interface{}{"text"}})
+
+	entries := readLog(t, primary, 0)
+	if len(entries) != 5 || entries[0].Seq != 1 || entries[4].Seq != 5 || entries[3].Op != OpDelete {
+		t.Fatalf("unexpected log %v", entries)
+	}
+	if n, err := replica.ApplyLog(entries[:2]); err != nil || n != 2 {
+		t.Fatalf("wanted 2 applied entries got %v (%v)", n, err)
+	}
+	// applying again skips the known entries
+	if n, err := replica.ApplyLog(entries); err != nil || n != 3 {
+		t.Fatalf("wanted 3 applied entries got %v (%v)", n, err)
+	}
+	if seq, _ := replica.LastSequence(); seq != 5 {
+		t.Errorf("wanted sequence 5 got %v", seq)
+	}
+
+	if doc, err := replica.Get("test", "a"); err != nil || !reflect.DeepEqual(doc, Object{"text": "hello world"}) {
+		t.Errorf("unexpected doc %v (%v)", doc, err)
+	}
+	if doc, _ := replica.Get("test", "b"); doc != nil {
+		t.Errorf("deleted doc was replicated: %v", doc)
+	}
+	if schema, _ := replica.GetSchema("test"); schema == nil {
+		t.Error("schema was not replicated")
+	}
+	ch, err := replica.Search("test", "hello", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := collectKeys(ch); !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Errorf("wanted search result a got %v", keys)
+	}
+
+	if entries := readLog(t, primary, 4); len(entries) != 1 || entries[0].Seq != 5 {
+		t.Errorf("wanted entry 5 got %v", entries)
+	}
+}
+
+func TestReplicationGap(t *testing.T) {
+	primary, replica := setupLoggedDB(t)
+	defer primary.Close()
+	defer replica.Close()
+	defer os.Remove("./replica.db")
+	putN(primary, 10)
+	entries := readLog(t, primary, 0)
+	if _, err := replica.ApplyLog(entries[5:]); err == nil {
+		t.Error("wanted error for missing entries")
+	}
+	if seq, _ := replica.LastSequence(); seq != 0 {
+		t.Errorf("failed apply changed the sequence to %v", seq)
+	}
+
+	if n, err := primary.TruncateLog(5); err != nil || n != 5 {
+		t.Fatalf("wanted 5 truncated entries got %v (%v)", n, err)
+	}
+	if _, err := primary.ReadLog(2, 0); err != ErrLogTruncated {
+		t.Errorf("wanted ErrLogTruncated got %v", err)
+	}
+	if entries := readLog(t, primary, 5); len(entries) != 5 {
+		t.Errorf("wanted 5 entries got %v", len(entries))
+	}
+}
+
+func TestRecordAndApplyEntries(t *testing.T) {
+	leader, node := setupLoggedDB(t)
+	defer leader.Close()
+	defer node.Close()
+	defer os.Remove("./replica.db")
+	os.Remove("./other.db")
+	other, err := NewWithOptions("./other.db", testOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	defer os.Remove("./other.db")
+	for _, db := range []*DB{leader, node, other} {
+		db.BeforePut("test", StampTime("updatedAt"))
+	}
+
+	entries, err := leader.Record(func(tx *Transaction) error {
+		if err := tx.Put("test", "a", Object{"text": "hello"}); err != nil {
+			return err
+		}
+		return tx.PutValue("test", "b", 42.)
+	})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("wanted 2 recorded entries got %v (%v)", entries, err)
+	}
+	if _, err = leader.Get("test", "a"); err == nil {
+		t.Error("recording wrote to the db")
+	}
+	// the entries travel as json like a raft command
+	bs, _ := json.Marshal(entries)
+	var decoded []*LogEntry
+	json.Unmarshal(bs, &decoded)
+
+	var exports [2]bytes.Buffer
+	for i, db := range []*DB{node, other} {
+		time.Sleep(2 * time.Millisecond)
+		if err = db.ApplyEntries(decoded); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Export("test", &exports[i], FormatNDJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(exports[0].Bytes(), exports[1].Bytes()) {
+		t.Errorf("nodes differ:\n%s\n%s", exports[0].Bytes(), exports[1].Bytes())
+	}
+	if doc, err := node.Get("test", "a"); err != nil || doc["updatedAt"] != entries[0].Value["updatedAt"] {
+		t.Errorf("wanted the stamp of the leader got %v (%v)", doc, err)
+	}
+}
+
+func TestRestoreContinuesLog(t *testing.T) {
+	primary, replica := setupLoggedDB(t)
+	defer primary.Close()
+	defer replica.Close()
+	defer os.Remove("./replica.db")
+	putN(primary, 5)
+	var backup bytes.Buffer
+	primary.Backup(&backup)
+	primary.Put("test.bucket", "5", Object{})
+	primary.Put("test.bucket", "6", Object{})
+	replica.ApplyLog(readLog(t, primary, 0))
+
+	if err := primary.Restore(&backup); err != nil {
+		t.Fatal(err)
+	}
+	if seq, _ := primary.LastSequence(); seq != 8 {
+		t.Errorf("wanted the sequence to continue with 8 got %v", seq)
+	}
+	entries := readLog(t, primary, 7)
+	if len(entries) != 1 || entries[0].Op != OpRestore {
+		t.Fatalf("wanted a restore entry got %v", entries)
+	}
+	if _, err := replica.ApplyLog(entries); err != ErrLogTruncated {
+		t.Errorf("wanted ErrLogTruncated on the replica got %v", err)
+	}
+	if _, err := primary.ReadLog(2, 0); err != ErrLogTruncated {
+		t.Errorf("wanted the log of the backup to be dropped got %v", err)
+	}
+	primary.Put("test.bucket", "7", Object{})
+	if seq, _ := primary.LastSequence(); seq != 9 {
+		t.Errorf("wanted sequence 9 got %v", seq)
+	}
+}
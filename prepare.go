@@ -0,0 +1,220 @@
+package boltplus
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nytlabs/gojee"
+)
+
+// DefaultFilterCacheSize is the number of compiled filters a database caches if Options.FilterCacheSize is 0
+const DefaultFilterCacheSize = 256
+
+// FilterError is a syntax error in a filter expression
+type FilterError struct {
+	Expression string
+	// Offset is the byte offset of the error in the expression, -1 if it is unknown
+	Offset int
+	Err    error
+}
+
+func (e *FilterError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("invalid filter %q: %v", e.Expression, e.Err)
+	}
+	return fmt.Sprintf("invalid filter %q at offset %v: %v", e.Expression, e.Offset, e.Err)
+}
+
+// PreparedQuery is a validated query with a compiled filter. It can be executed any number of times,
+// concurrently and in transactions of any database.
+type PreparedQuery struct {
+	query   Query
+	filters []Filter
+}
+
+// Prepare validates a query and compiles its filter, syntax errors are returned as *FilterError
+func Prepare(q *Query) (*PreparedQuery, error) {
+	return prepare(q, compileFilter)
+}
+
+// Query returns the prepared query
+func (p *PreparedQuery) Query() Query {
+	q := p.query
+	q.Lookups = append([]Lookup(nil), p.query.Lookups...)
+	return q
+}
+
+func prepare(q *Query, compile func(string) (*jee.TokenTree, error)) (*PreparedQuery, error) {
+	if (q.Start == "") != (q.End == "") {
+		return nil, errors.New("empty start/end")
+	}
+	if q.Prefix != "" && q.Start != "" {
+		return nil, errors.New("prefix and range can not be combined")
+	}
+	for _, lookup := range q.Lookups {
+		if lookup.LocalField == "" || lookup.FromBucket == "" {
+			return nil, errors.New("lookups need a local field and a bucket")
+		}
+	}
+	p := &PreparedQuery{query: *q}
+	// the lookups are copied, changes of the caller must not affect the prepared query
+	p.query.Lookups = append([]Lookup(nil), q.Lookups...)
+	if q.Filter != "" {
+		tree, err := compile(q.Filter)
+		if err != nil {
+			return nil, err
+		}
+		p.filters = append(p.filters, FilterFunc(func(key string, doc interface{}) (bool, error) {
+			return matches(tree, doc)
+		}))
+	}
+	if q.Where != nil {
+		p.filters = append(p.filters, q.Where)
+	}
+	return p, nil
+}
+
+// compileFilter lexes and parses a gojee expression. The resulting tree is only read by jee.Eval,
+// so it is shared by parallel workers and cached across transactions.
+func compileFilter(filterExpression string) (*jee.TokenTree, error) {
+	// gojee reports errors without their position, the common ones are located up front
+	if offset, err := checkSyntax(filterExpression); err != nil {
+		return nil, &FilterError{filterExpression, offset, err}
+	}
+	tokens, err := jee.Lexer(filterExpression)
+	if err == nil {
+		var tree *jee.TokenTree
+		if tree, err = jee.Parser(tokens); err == nil {
+			return tree, nil
+		}
+	}
+	return nil, &FilterError{filterExpression, -1, err}
+}
+
+// checkSyntax finds unterminated strings and unbalanced brackets and returns their offset
+func checkSyntax(expr string) (int, error) {
+	var open []int
+	quote, quoteStart := rune(0), 0
+	for i, r := range expr {
+		switch {
+		case quote != 0:
+			if r == quote && !strings.HasSuffix(expr[:i], `\`) {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote, quoteStart = r, i
+		case r == '(' || r == '[' || r == '{':
+			open = append(open, i)
+		case r == ')' || r == ']' || r == '}':
+			if len(open) == 0 || !bracketsMatch(expr[open[len(open)-1]], byte(r)) {
+				return i, fmt.Errorf("unexpected %q", r)
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if quote != 0 {
+		return quoteStart, errors.New("unterminated string")
+	}
+	if len(open) > 0 {
+		return open[len(open)-1], fmt.Errorf("unclosed %q", expr[open[len(open)-1]])
+	}
+	return -1, nil
+}
+
+func bracketsMatch(open, close byte) bool {
+	return open == '(' && close == ')' || open == '[' && close == ']' || open == '{' && close == '}'
+}
+
+// filterCache keeps the most recently used compiled filters of a database
+type filterCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of *filterCacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type filterCacheEntry struct {
+	expression string
+	tree       *jee.TokenTree
+}
+
+func newFilterCache(size int) *filterCache {
+	return &filterCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *filterCache) get(expression string) (*jee.TokenTree, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[expression]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*filterCacheEntry).tree, true
+}
+
+func (c *filterCache) add(expression string, tree *jee.TokenTree) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[expression]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[expression] = c.order.PushFront(&filterCacheEntry{expression, tree})
+	if c.order.Len() > c.size {
+		oldest := c.order.Remove(c.order.Back()).(*filterCacheEntry)
+		delete(c.entries, oldest.expression)
+	}
+}
+
+// compileFilter compiles a filter using the cache of the database, failed compilations are not cached
+func (db *DB) compileFilter(expression string) (*jee.TokenTree, error) {
+	if db.filters == nil {
+		return compileFilter(expression)
+	}
+	if tree, ok := db.filters.get(expression); ok {
+		db.observeFilterCache("hit")
+		return tree, nil
+	}
+	db.observeFilterCache("miss")
+	tree, err := compileFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	db.filters.add(expression, tree)
+	return tree, nil
+}
+
+// Prepare validates a query and compiles its filter using the filter cache of the database
+func (db *DB) Prepare(q *Query) (*PreparedQuery, error) {
+	return prepare(q, db.compileFilter)
+}
+
+// Execute streams the docs matching a prepared query
+func (db *DB) Execute(p *PreparedQuery) (chan *Pair, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := tx.Execute(p)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
+
+// ExecuteValues streams the values of any kind matching a prepared query
+func (db *DB) ExecuteValues(p *PreparedQuery) (chan *ValuePair, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := tx.ExecuteValues(p)
+	if err != nil {
+		tx.Close()
+	}
+	return ch, err
+}
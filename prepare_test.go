@@ -0,0 +1,116 @@
+package boltplus
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFilterError(t *testing.T) {
+	cases := []struct {
+		expr   string
+		offset int
+	}{
+		{".a == 'foo", 6},
+		{"(.a == 1", 0},
+		{".a == 1)", 7},
+		{"(.a == [1, 2)", 12},
+		{"", -1},
+	}
+	for _, c := range cases {
+		_, err := Prepare(&Query{Bucket: "test", Filter: c.expr})
+		if err == nil && c.expr != "" {
+			t.Errorf("%q: wanted error", c.expr)
+			continue
+		}
+		if c.expr == "" {
+			continue
+		}
+		filterErr, ok := err.(*FilterError)
+		if !ok {
+			t.Errorf("%q: wanted *FilterError got %T", c.expr, err)
+			continue
+		}
+		if filterErr.Offset != c.offset {
+			t.Errorf("%q: wanted offset %v got %v", c.expr, c.offset, filterErr.Offset)
+		}
+	}
+	if _, err := Prepare(&Query{Bucket: "test", Start: "a"}); err == nil {
+		t.Error("wanted error for open range")
+	}
+}
+
+func TestPreparedQuery(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	putN(db, 10)
+	os.Remove("./other.db")
+	defer os.Remove("./other.db")
+	other, err := NewWithOptions("./other.db", testOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	putN(other, 5)
+
+	q := &Query{Bucket: "test.bucket", Filter: ".key >= 3", Lookups: []Lookup{{LocalField: "ref", FromBucket: "refs"}}}
+	p, err := Prepare(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Lookups[0].FromBucket = "changed"
+	if p.Query().Lookups[0].FromBucket != "refs" {
+		t.Error("changing the query changed the prepared query")
+	}
+	for i := 0; i < 2; i++ {
+		ch, err := db.Execute(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := collectKeys(ch); len(keys) != 7 {
+			t.Errorf("wanted 7 docs got %v", keys)
+		}
+	}
+	ch, err := other.Execute(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := collectKeys(ch); len(keys) != 2 {
+		t.Errorf("wanted 2 docs got %v", keys)
+	}
+}
+
+func TestFilterCache(t *testing.T) {
+	os.Remove("./test.db")
+	metrics := NewPrometheusMetrics()
+	db, err := NewWithOptions("./test.db", testOptions(&Options{Metrics: metrics, FilterCacheSize: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	putN(db, 10)
+	for _, filter := range []string{".key == 1", ".key == 2", ".key == 1", ".key == 3", ".key == 2"} {
+		ch, err := db.Find("test.bucket", filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := collectKeys(ch); len(keys) != 1 {
+			t.Errorf("%v: wanted 1 doc got %v", filter, keys)
+		}
+	}
+	// .key == 2 was evicted by .key == 3
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	for _, line := range []string{`boltplus_filter_cache_total{result="hit"} 1`, `boltplus_filter_cache_total{result="miss"} 4`} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("missing %q in:\n%v", line, buf.String())
+		}
+	}
+	if _, err := db.Find("test.bucket", ".key == ("); err == nil {
+		t.Error("wanted error for invalid filter")
+	}
+	if db.filters.order.Len() != 2 {
+		t.Errorf("wanted 2 cached filters got %v", db.filters.order.Len())
+	}
+}
@@ -0,0 +1,418 @@
+package boltplus
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nytlabs/gojee"
+)
+
+// Query describes a scan over the docs of a bucket. Without Prefix and Start/End all docs are scanned.
+type Query struct {
+	Bucket string `json:"bucket"`
+	// Prefix restricts the scan to keys with this prefix
+	Prefix string `json:"prefix,omitempty"`
+	// Start and End restrict the scan to keys in this range, both inclusive
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	// Filter is a gojee expression the docs have to match, it sees the docs embedded by the lookups
+	Filter string `json:"filter,omitempty"`
+	// Where is matched in addition to Filter, e.g. a query document compiled with CompileWhere
+	Where Filter `json:"-"`
+	// Transform reshapes every matching doc, see the jqtransform package
+	Transform Transformer `json:"-"`
+	// Lookups embed referenced docs of other buckets into the results, they are applied in order
+	Lookups []Lookup `json:"lookups,omitempty"`
+	// Workers > 1 decodes and filters the docs on this many goroutines, each scanning a part of the keys
+	Workers int `json:"workers,omitempty"`
+	// Ordered keeps the results of a parallel query in key order, serial queries are always ordered
+	Ordered bool `json:"ordered,omitempty"`
+}
+
+// Transformer reshapes the docs returned by a query. It returns false to drop a doc.
+// Implementations must be safe for concurrent use like filters.
+type Transformer interface {
+	Transform(key string, doc interface{}) (interface{}, bool, error)
+}
+
+// partitionSampleRate is the distance of the keys sampled to partition a parallel query
+const partitionSampleRate = 64
+
+// Lookup resolves the key (or array of keys) stored in LocalField in the bucket FromBucket and stores the
+// referenced doc (or array of docs) in As. As defaults to LocalField, replacing the reference.
+// References to missing docs resolve to null or are left out of arrays.
+type Lookup struct {
+	LocalField string `json:"localField"`
+	FromBucket string `json:"fromBucket"`
+	As         string `json:"as,omitempty"`
+}
+
+// ParseLookup parses a lookup in the form localField:fromBucket[:as]
+func ParseLookup(str string) (Lookup, error) {
+	parts := strings.Split(str, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Lookup{}, fmt.Errorf("malformed lookup %q, use localField:fromBucket[:as]", str)
+	}
+	lookup := Lookup{LocalField: parts[0], FromBucket: parts[1]}
+	if len(parts) == 3 {
+		lookup.As = parts[2]
+	}
+	return lookup, nil
+}
+
+// Query streams the docs matching a query. Scanning, lookups and filtering run in a single goroutine
+// on this transaction, so lookups see the same snapshot as the scanned docs.
+// Values which are no objects are skipped, use QueryValues for them.
+func (tx *Transaction) Query(q *Query) (chan *Pair, error) {
+	return tx.query(q, "query")
+}
+
+// Execute streams the docs matching a prepared query, values which are no objects are skipped
+func (tx *Transaction) Execute(p *PreparedQuery) (chan *Pair, error) {
+	return tx.execute(p, "query")
+}
+
+// QueryValues streams the values of any kind matching a query, raw values are []byte
+func (tx *Transaction) QueryValues(q *Query) (chan *ValuePair, error) {
+	p, err := prepare(q, tx.db.compileFilter)
+	if err != nil {
+		return nil, err
+	}
+	return tx.ExecuteValues(p)
+}
+
+// ExecuteValues streams the values of any kind matching a prepared query, raw values are []byte
+func (tx *Transaction) ExecuteValues(p *PreparedQuery) (chan *ValuePair, error) {
+	return tx.run(p, "query", false)
+}
+
+// query prepares and runs a query, the op names the operation in the metrics
+func (tx *Transaction) query(q *Query, op string) (chan *Pair, error) {
+	p, err := prepare(q, tx.db.compileFilter)
+	if err != nil {
+		return nil, err
+	}
+	return tx.execute(p, op)
+}
+
+// execute runs a query streaming objects only
+func (tx *Transaction) execute(p *PreparedQuery, op string) (chan *Pair, error) {
+	values, err := tx.run(p, op, true)
+	if err != nil {
+		return nil, err
+	}
+	returnChannel := make(chan *Pair, 64)
+	go func() {
+		defer close(returnChannel)
+		for pair := range values {
+			returnChannel <- &Pair{pair.Key, pair.Value.(map[string]interface{})}
+		}
+	}()
+	return returnChannel, nil
+}
+
+// run streams the results of a query, with objects set values which are no objects are skipped
+func (tx *Transaction) run(p *PreparedQuery, op string, objects bool) (chan *ValuePair, error) {
+	started := time.Now()
+	q := &p.query
+	bucket, err := tx.getBucket(q.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	run := &queryRun{tx: tx, q: q, filters: p.filters, lookups: tx.lookupBuckets(q), objects: objects}
+	returnChannel := make(chan *ValuePair, 64)
+	go func() {
+		defer close(returnChannel)
+		defer tx.Close()
+		defer func() {
+			tx.db.observeScan(op, started, int(run.scanned))
+			if len(p.filters) > 0 {
+				tx.db.observeMatched(op, int(run.matched))
+				run.logFilterErrors()
+			}
+		}()
+		if q.Workers > 1 {
+			run.parallel(bucket, returnChannel)
+			return
+		}
+		run.scan(bucket.Cursor(), nil, nil, returnChannel)
+	}()
+	return returnChannel, nil
+}
+
+// lookupBuckets returns the buckets referenced by the lookups of a query, nil for missing ones
+// which resolve all references to null
+func (tx *Transaction) lookupBuckets(q *Query) []backendBucket {
+	lookups := make([]backendBucket, len(q.Lookups))
+	for i, lookup := range q.Lookups {
+		lookups[i], _ = tx.getBucket(lookup.FromBucket)
+	}
+	return lookups
+}
+
+// queryRun is the state of a running query shared by its workers
+type queryRun struct {
+	// the counters come first to keep them aligned for atomic access on 32 bit platforms
+	scanned int64
+	matched int64
+	// failed counts the docs whose filters returned an error, the first one is kept in err
+	failed  int64
+	errOnce sync.Once
+	err     error
+	tx      *Transaction
+	q       *Query
+	filters []Filter
+	lookups []backendBucket
+	// objects skips values and transform results which are no objects
+	objects bool
+}
+
+// scan decodes, resolves and filters the docs from the key from up to the key to (exclusive).
+// A nil from starts at the beginning of the query, a nil to runs until its end.
+// With a nil out the matching docs are only counted.
+func (r *queryRun) scan(c backendCursor, from, to []byte, out chan<- *ValuePair) {
+	k, v := r.q.seek(c)
+	if from != nil {
+		k, v = c.Seek(from)
+	}
+	for ; r.q.contains(k) && (to == nil || bytes.Compare(k, to) < 0); k, v = c.Next() {
+		if v == nil {
+			continue
+		}
+		atomic.AddInt64(&r.scanned, 1)
+		value, e := r.tx.decodeValue(v)
+		if e != nil {
+			log.Print(e)
+			continue
+		}
+		if doc, ok := value.(map[string]interface{}); ok {
+			for i, lookup := range r.q.Lookups {
+				r.tx.resolveLookup(doc, lookup, r.lookups[i])
+			}
+		} else if r.objects {
+			continue
+		}
+		if !r.matches(string(k), value) {
+			continue
+		}
+		atomic.AddInt64(&r.matched, 1)
+		if out == nil {
+			continue
+		}
+		if r.q.Transform != nil {
+			var keep bool
+			if value, keep = r.transform(string(k), value); !keep {
+				continue
+			}
+		}
+		out <- &ValuePair{string(k), value}
+	}
+}
+
+// matches reports whether a doc passes all filters, errors count as mismatch and are logged once per run
+func (r *queryRun) matches(key string, doc interface{}) bool {
+	for _, f := range r.filters {
+		match, err := f.Match(key, doc)
+		if err != nil {
+			atomic.AddInt64(&r.failed, 1)
+			r.errOnce.Do(func() { r.err = err })
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// logFilterErrors logs the first filter error of a finished run and on how many docs filters failed
+func (r *queryRun) logFilterErrors() {
+	if n := atomic.LoadInt64(&r.failed); n > 0 {
+		log.Printf("%v (filters failed on %v docs)", r.err, n)
+	}
+}
+
+// transform applies the transformer of the query, it returns false if the doc is dropped.
+// Object streams drop results which are no objects.
+func (r *queryRun) transform(key string, doc interface{}) (interface{}, bool) {
+	res, keep, err := r.q.Transform.Transform(key, doc)
+	if err != nil {
+		log.Print(err)
+		return nil, false
+	}
+	if _, ok := res.(map[string]interface{}); keep && r.objects && !ok {
+		log.Printf("transforming %v: the result is no object but %T", key, res)
+		return nil, false
+	}
+	return res, keep
+}
+
+// parallel splits the keys of the query into one partition per worker and scans them concurrently.
+// Ordered queries emit the partitions one after another, the workers of later partitions block once
+// their buffer is full.
+func (r *queryRun) parallel(bucket backendBucket, out chan<- *ValuePair) {
+	bounds := r.boundaries(bucket.Cursor(), r.q.Workers)
+	outputs := make([]chan *ValuePair, len(bounds)+1)
+	// cursors are created up front, the transaction must not be modified by the workers
+	cursors := make([]backendCursor, len(outputs))
+	for i := range outputs {
+		outputs[i] = make(chan *ValuePair, 64)
+		cursors[i] = bucket.Cursor()
+	}
+	for i := range outputs {
+		var from, to []byte
+		if i > 0 {
+			from = bounds[i-1]
+		}
+		if i < len(bounds) {
+			to = bounds[i]
+		}
+		go func(i int, from, to []byte) {
+			defer close(outputs[i])
+			r.scan(cursors[i], from, to, outputs[i])
+		}(i, from, to)
+	}
+	if r.q.Ordered {
+		for _, ch := range outputs {
+			for pair := range ch {
+				out <- pair
+			}
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(outputs))
+	for _, ch := range outputs {
+		go func(ch chan *ValuePair) {
+			defer wg.Done()
+			for pair := range ch {
+				out <- pair
+			}
+		}(ch)
+	}
+	wg.Wait()
+}
+
+// boundaries samples the keys of the query to split them into at most n partitions of similar size.
+// It returns the first key of every partition except the first one.
+func (r *queryRun) boundaries(c backendCursor, n int) [][]byte {
+	var samples [][]byte
+	i := 0
+	for k, _ := r.q.seek(c); r.q.contains(k); k, _ = c.Next() {
+		if i%partitionSampleRate == 0 {
+			samples = append(samples, k)
+		}
+		i++
+	}
+	var bounds [][]byte
+	for j := 1; j < n; j++ {
+		idx := len(samples) * j / n
+		if idx > 0 && (len(bounds) == 0 || !bytes.Equal(bounds[len(bounds)-1], samples[idx])) {
+			bounds = append(bounds, samples[idx])
+		}
+	}
+	return bounds
+}
+
+// seek positions the cursor on the first key of the query
+func (q *Query) seek(c backendCursor) ([]byte, []byte) {
+	switch {
+	case q.Prefix != "":
+		return c.Seek([]byte(q.Prefix))
+	case q.Start != "":
+		return c.Seek([]byte(q.Start))
+	}
+	return c.First()
+}
+
+// contains reports whether the scan continues with the key
+func (q *Query) contains(k []byte) bool {
+	switch {
+	case k == nil:
+		return false
+	case q.Prefix != "":
+		return bytes.HasPrefix(k, []byte(q.Prefix))
+	case q.End != "":
+		return bytes.Compare(k, []byte(q.End)) <= 0
+	}
+	return true
+}
+
+func matches(tree *jee.TokenTree, doc interface{}) (bool, error) {
+	val, err := jee.Eval(tree, doc)
+	if err != nil {
+		return false, err
+	}
+	match, ok := val.(bool)
+	return ok && match, nil
+}
+
+// resolveLookup embeds the docs referenced by a doc, from is nil if the bucket does not exist
+func (tx *Transaction) resolveLookup(doc map[string]interface{}, lookup Lookup, from backendBucket) {
+	as := lookup.As
+	if as == "" {
+		as = lookup.LocalField
+	}
+	var res interface{}
+	switch ref := valueAt(doc, lookup.LocalField).(type) {
+	case []interface{}:
+		docs := make([]interface{}, 0, len(ref))
+		for _, r := range ref {
+			if d := tx.lookupKey(from, r); d != nil {
+				docs = append(docs, d)
+			}
+		}
+		res = docs
+	default:
+		if d := tx.lookupKey(from, ref); d != nil {
+			res = d
+		}
+	}
+	setValueAt(doc, as, res)
+}
+
+func (tx *Transaction) lookupKey(from backendBucket, ref interface{}) interface{} {
+	if from == nil {
+		return nil
+	}
+	var key string
+	switch r := ref.(type) {
+	case string:
+		key = r
+	case float64:
+		key = strconv.FormatFloat(r, 'f', -1, 64)
+	case int:
+		key = strconv.Itoa(r)
+	default:
+		return nil
+	}
+	data := from.Get([]byte(key))
+	if data == nil {
+		return nil
+	}
+	value, err := tx.decodeValue(data)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	return value
+}
+
+// setValueAt sets a dotted field path inside a doc, creating the objects on the way
+func setValueAt(doc map[string]interface{}, path string, value interface{}) {
+	fields := strings.Split(path, ".")
+	for _, field := range fields[:len(fields)-1] {
+		next, ok := doc[field].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			doc[field] = next
+		}
+		doc = next
+	}
+	doc[fields[len(fields)-1]] = value
+}
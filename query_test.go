@@ -0,0 +1,206 @@
+package boltplus
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func runQuery(t *testing.T, db *DB, q *Query) map[string]map[string]interface{} {
+	ch, err := db.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[string]map[string]interface{})
+	for pair := range ch {
+		res[pair.Key] = pair.Value
+	}
+	return res
+}
+
+func TestQueryLookup(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.Put("customers", "c1", Object{"name": "Alice", "city": "Berlin"})
+	db.Put("customers", "c2", Object{"name": "Bob", "city": "Paris"})
+	db.Put("products", "p1", Object{"title": "Apple"})
+	db.Put("products", "p2", Object{"title": "Pear"})
+	db.Put("orders", "o1", Object{"customer": "c1", "items": []interface{}{"p1", "p2", "p3"}})
+	db.Put("orders", "o2", Object{"customer": "c2", "items": []interface{}{"p2"}})
+	db.Put("orders", "o3", Object{"customer": "c9"})
+
+	res := runQuery(t, db, &Query{
+		Bucket: "orders",
+		Lookups: []Lookup{
+			{LocalField: "customer", FromBucket: "customers"},
+			{LocalField: "items", FromBucket: "products", As: "details.products"},
+		},
+	})
+	if len(res) != 3 {
+		t.Fatalf("wanted 3 orders got %v", res)
+	}
+	if name := valueAt(res["o1"], "customer.name"); name != "Alice" {
+		t.Errorf("customer was not embedded: %v", res["o1"])
+	}
+	// the missing product p3 is left out
+	expect := []interface{}{map[string]interface{}{"title": "Apple"}, map[string]interface{}{"title": "Pear"}}
+	if products := valueAt(res["o1"], "details.products"); !reflect.DeepEqual(products, expect) {
+		t.Errorf("wanted products %v got %v", expect, products)
+	}
+	if !reflect.DeepEqual(res["o1"]["items"], []interface{}{"p1", "p2", "p3"}) {
+		t.Errorf("references were changed: %v", res["o1"]["items"])
+	}
+	if customer, ok := res["o3"]["customer"]; !ok || customer != nil {
+		t.Errorf("missing customer should be null, got %v", customer)
+	}
+
+	// filters see the embedded docs
+	res = runQuery(t, db, &Query{
+		Bucket:  "orders",
+		Filter:  ".customer.city == 'Paris'",
+		Lookups: []Lookup{{LocalField: "customer", FromBucket: "customers"}},
+	})
+	if len(res) != 1 || res["o2"] == nil {
+		t.Errorf("wanted order o2 got %v", res)
+	}
+
+	res = runQuery(t, db, &Query{Bucket: "orders", Start: "o2", End: "o3", Lookups: []Lookup{{LocalField: "customer", FromBucket: "missing"}}})
+	if len(res) != 2 || res["o2"]["customer"] != nil {
+		t.Errorf("wanted orders o2 and o3 without customers got %v", res)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	putN(db, 3)
+	cases := []*Query{
+		{Bucket: "missing"},
+		{Bucket: "test.bucket", Start: "a"},
+		{Bucket: "test.bucket", Prefix: "a", Start: "a", End: "b"},
+		{Bucket: "test.bucket", Filter: "((("},
+		{Bucket: "test.bucket", Lookups: []Lookup{{LocalField: "a"}}},
+	}
+	for _, q := range cases {
+		if _, err := db.Query(q); err == nil {
+			t.Errorf("wanted error for %+v", q)
+		}
+	}
+	if _, err := ParseLookup("a"); err == nil {
+		t.Error("wanted error for malformed lookup")
+	}
+	if l, err := ParseLookup("a:b:c"); err != nil || l != (Lookup{"a", "b", "c"}) {
+		t.Errorf("unexpected lookup %v (%v)", l, err)
+	}
+}
+
+func TestParallelQuery(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	putN(db, 1000)
+	for _, workers := range []int{2, 3, 8, 2000} {
+		ch, err := db.Query(&Query{Bucket: "test.bucket", Filter: ".key < 500", Workers: workers, Ordered: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := collectKeys(ch)
+		if len(keys) != 500 || !sort.StringsAreSorted(keys) {
+			t.Errorf("%v workers: wanted 500 ordered keys got %v", workers, len(keys))
+		}
+		res := runQuery(t, db, &Query{Bucket: "test.bucket", Prefix: "1", Workers: workers})
+		if len(res) != 111 {
+			t.Errorf("%v workers: wanted 111 docs with prefix 1 got %v", workers, len(res))
+		}
+	}
+	if res := runQuery(t, db, &Query{Bucket: "test.bucket", Prefix: "x", Workers: 4}); len(res) != 0 {
+		t.Errorf("wanted no docs got %v", res)
+	}
+}
+
+// the workers share the lookup buckets of one transaction, run with -race
+func TestParallelLookup(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	tx, _ := db.Tx(true)
+	for i := 0; i < 10; i++ {
+		tx.Put("customers", strconv.Itoa(i), Object{"name": "customer " + strconv.Itoa(i)})
+	}
+	for i := 0; i < 1000; i++ {
+		tx.Put("orders", strconv.Itoa(i), Object{"customer": strconv.Itoa(i % 10)})
+	}
+	tx.Commit()
+	res := runQuery(t, db, &Query{Bucket: "orders", Workers: 8, Lookups: []Lookup{{LocalField: "customer", FromBucket: "customers"}}})
+	if len(res) != 1000 {
+		t.Fatalf("wanted 1000 orders got %v", len(res))
+	}
+	if name := valueAt(res["42"], "customer.name"); name != "customer 2" {
+		t.Errorf("wanted customer 2 got %v", res["42"])
+	}
+}
+
+type transformFunc func(key string, doc interface{}) (interface{}, bool, error)
+
+func (f transformFunc) Transform(key string, doc interface{}) (interface{}, bool, error) {
+	return f(key, doc)
+}
+
+func TestQueryTransform(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	putN(db, 4)
+	transform := transformFunc(func(key string, doc interface{}) (interface{}, bool, error) {
+		switch key {
+		case "0":
+			return nil, false, nil
+		case "1":
+			return "no object", true, nil
+		case "2":
+			return nil, false, errors.New("failed")
+		}
+		return map[string]interface{}{"id": key}, true, nil
+	})
+	res := runQuery(t, db, &Query{Bucket: "test.bucket", Transform: transform, Workers: 2})
+	if !reflect.DeepEqual(res, map[string]map[string]interface{}{"3": {"id": "3"}}) {
+		t.Errorf("wanted only the transformed doc 3 got %v", res)
+	}
+	// value streams keep results which are no objects
+	ch, err := db.QueryValues(&Query{Bucket: "test.bucket", Transform: transform, Workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]interface{})
+	for pair := range ch {
+		values[pair.Key] = pair.Value
+	}
+	expect := map[string]interface{}{"1": "no object", "3": map[string]interface{}{"id": "3"}}
+	if !reflect.DeepEqual(values, expect) {
+		t.Errorf("wanted the transformed values 1 and 3 got %v", values)
+	}
+}
+
+func TestFilterErrorsLoggedOnce(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	putN(db, 20)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	failing := FilterFunc(func(key string, doc interface{}) (bool, error) {
+		return false, errors.New("broken filter")
+	})
+	if res := runQuery(t, db, &Query{Bucket: "test.bucket", Where: failing}); len(res) != 0 {
+		t.Errorf("wanted no results got %v", res)
+	}
+	if n, _ := db.CountWhere("test.bucket", failing); n != 0 {
+		t.Errorf("wanted count 0 got %v", n)
+	}
+	if lines := strings.Count(buf.String(), "broken filter (filters failed on 20 docs)"); lines != 2 {
+		t.Errorf("wanted one log line per run got %q", buf.String())
+	}
+}
@@ -0,0 +1,175 @@
+package boltplus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// VerifyBackup checks that a backup is a consistent bolt file and that all docs in it can be decoded
+// with the keys of this database
+func (db *DB) VerifyBackup(r io.Reader) error {
+	tmp, err := db.receiveBackup(r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return db.verifyFile(tmp)
+}
+
+// ErrSwapTimeout is returned by Restore and Compact if transactions stay open longer than the swap timeout,
+// e.g. because a stream was not drained
+var ErrSwapTimeout = errors.New("timeout waiting for open transactions")
+
+// Restore replaces the database with a backup. The backup is verified first, then Restore waits until
+// all open transactions are closed and atomically swaps the database file. It fails with ErrSwapTimeout
+// if transactions stay open longer than Options.SwapTimeout.
+// With OpLog the log continues after the latest sequence of both databases with an OpRestore entry,
+// so replicas notice the restore and restore a backup themselves.
+func (db *DB) Restore(r io.Reader) error {
+	tmp, err := db.receiveBackup(r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err = db.verifyFile(tmp); err != nil {
+		return err
+	}
+	db.writeMu.Lock()
+	last, err := db.LastSequence()
+	if err == nil {
+		err = db.swap(tmp)
+	}
+	if err != nil || !db.oplog {
+		db.writeMu.Unlock()
+		return err
+	}
+	return db.continueLog(last)
+}
+
+// continueLog drops the log of a restored backup and appends an OpRestore entry following the latest
+// sequence number of the replaced database, so the sequence never goes backwards. The caller holds writeMu,
+// the transaction releases it.
+func (db *DB) continueLog(last uint64) error {
+	tx, err := db.begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	if seq := tx.LastSequence(); seq > last {
+		last = seq
+	}
+	if meta := tx.getMetaBucket(); meta != nil && meta.Bucket([]byte("oplog")) != nil {
+		if err = meta.DeleteBucket([]byte("oplog")); err != nil {
+			return err
+		}
+	}
+	bucket, err := tx.getMetaBucketOrCreate("oplog")
+	if err != nil {
+		return err
+	}
+	if err = bucket.SetSequence(last); err != nil {
+		return err
+	}
+	if err = tx.appendLog(&LogEntry{Op: OpRestore}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// swap replaces the database file with another bolt file once all transactions are drained.
+// The memory backend loads the file instead.
+func (db *DB) swap(filename string) error {
+	if !db.lockForSwap() {
+		return ErrSwapTimeout
+	}
+	defer db.mu.Unlock()
+	if db.backend == BackendMemory {
+		loaded, err := loadMemoryBackend(filename)
+		if err != nil {
+			return err
+		}
+		db.db.Close()
+		db.db = loaded
+		os.Remove(filename)
+		return nil
+	}
+	if err := db.db.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(filename, db.path); err != nil {
+		// keep serving the old file
+		if e := db.open(db.path); e != nil {
+			return fmt.Errorf("%v (reopening failed too: %v)", err, e)
+		}
+		return err
+	}
+	return db.open(db.path)
+}
+
+// lockForSwap write-locks mu within the swap timeout. New transactions wait at the gate meanwhile,
+// so steady read traffic drains. It polls instead of waiting in Lock, after a timeout the gate opens
+// again and a transaction which is never closed does not block the database.
+func (db *DB) lockForSwap() bool {
+	db.gate.Lock()
+	defer db.gate.Unlock()
+	deadline := time.Now().Add(db.swapTimeout)
+	for !db.mu.TryLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// receiveBackup writes a backup to a temporary file next to the database, so it can be renamed over it
+func (db *DB) receiveBackup(r io.Reader) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(db.path), filepath.Base(db.path)+".restore")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, r); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err = f.Sync(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// verifyFile runs the bolt consistency check on a file and decodes all docs in it
+func (db *DB) verifyFile(filename string) error {
+	backup, err := bolt.Open(filename, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+	return backup.View(func(btx *bolt.Tx) error {
+		var checkErr error
+		for err := range btx.Check() {
+			if checkErr == nil {
+				checkErr = fmt.Errorf("inconsistent bolt file: %v", err)
+			}
+		}
+		if checkErr != nil {
+			return checkErr
+		}
+		tx := &Transaction{tx: &boltTx{btx}, db: db}
+		return tx.tx.ForEach(func(name []byte, bucket backendBucket) error {
+			if string(name) == metaBucket {
+				return nil
+			}
+			return tx.exportBucket(bucket, string(name), func(*Record) error { return nil })
+		})
+	})
+}
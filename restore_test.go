@@ -0,0 +1,138 @@
+package boltplus
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRestore(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	putN(db, 10)
+	var backup bytes.Buffer
+	if err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	db.Delete("test.bucket", "5")
+	db.Put("other", "key", Object{})
+
+	// an open read transaction must not see the swap
+	tx, _ := db.Tx(false)
+	done := make(chan error)
+	go func() { done <- db.Restore(bytes.NewReader(backup.Bytes())) }()
+	if _, err := tx.Get("other", "key"); err != nil {
+		t.Error("open transaction should still see the old data")
+	}
+	tx.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if result, err := db.Get("test.bucket", "5"); err != nil || !reflect.DeepEqual(result, Object{"key": 5.}) {
+		t.Errorf("wanted restored doc got %v (%v)", result, err)
+	}
+	if _, err := db.Get("other", "key"); err == nil {
+		t.Error("doc written after the backup should be gone")
+	}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	putN(db, 10)
+	var backup bytes.Buffer
+	if err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.VerifyBackup(bytes.NewReader(backup.Bytes())); err != nil {
+		t.Error(err)
+	}
+	if err := db.VerifyBackup(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Error("garbage should not verify")
+	}
+	if err := db.Restore(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Error("garbage should not be restored")
+	}
+	if _, err := db.Get("test.bucket", "1"); err != nil {
+		t.Error("failed restore should keep the database usable:", err)
+	}
+
+	db.keys = StaticKeys{testKey("k1", 1)}
+	db.Put("test.bucket", "encrypted", Object{})
+	backup.Reset()
+	db.Backup(&backup)
+	db.keys = StaticKeys{testKey("k1", 2)}
+	if err := db.VerifyBackup(bytes.NewReader(backup.Bytes())); err == nil {
+		t.Error("backup with undecryptable docs should not verify")
+	}
+}
+
+func TestRestoreTimeout(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.swapTimeout = 50 * time.Millisecond
+	putN(db, 200)
+	var backup bytes.Buffer
+	if err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	// a stream which is not drained keeps its transaction open
+	ch, _ := db.GetAll("test.bucket")
+	if err := db.Restore(bytes.NewReader(backup.Bytes())); err != ErrSwapTimeout {
+		t.Errorf("wanted ErrSwapTimeout got %v", err)
+	}
+	if _, err := db.Get("test.bucket", "1"); err != nil {
+		t.Error("the database should stay usable:", err)
+	}
+	for range ch {
+	}
+	if err := db.Restore(bytes.NewReader(backup.Bytes())); err != nil {
+		t.Errorf("wanted the restore to succeed once the stream is drained got %v", err)
+	}
+}
+
+func TestRestoreWithOverlappingReads(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.swapTimeout = 5 * time.Second
+	putN(db, 10)
+	var backup bytes.Buffer
+	if err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	// readers keep at least one transaction open all the time
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				tx, err := db.Tx(false)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				tx.Get("test.bucket", "1")
+				time.Sleep(5 * time.Millisecond)
+				tx.Close()
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := db.Restore(bytes.NewReader(backup.Bytes())); err != nil {
+			t.Errorf("restore %v failed: %v", i, err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,680 @@
+package boltplus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Violation describes a single way in which a doc does not match its bucket schema
+type Violation struct {
+	// Path is a JSON pointer to the offending value
+	Path    string `json:"path"`
+	Keyword string `json:"keyword"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when a doc does not match the schema of its bucket
+type ValidationError struct {
+	Bucket     string      `json:"bucket"`
+	Key        string      `json:"key"`
+	Violations []Violation `json:"violations"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = fmt.Sprintf("%v: %v", v.Path, v.Message)
+	}
+	return fmt.Sprintf("doc %v in bucket %v is invalid: %v", e.Key, e.Bucket, strings.Join(msgs, "; "))
+}
+
+// SetSchema attaches a JSON schema (a subset of draft 2020-12) to a bucket. Passing nil removes the schema.
+// Existing docs are not checked, use ValidateBucket for that.
+func (tx *Transaction) SetSchema(bucketPath string, schema map[string]interface{}) error {
+	tx.db.schemas.remove(bucketPath)
+	if schema == nil {
+		schemas := tx.getMetaBucket("schemas")
+		if schemas == nil {
+			return nil
+		}
+		if err := schemas.Delete([]byte(bucketPath)); err != nil {
+			return err
+		}
+		return tx.appendLog(&LogEntry{Op: OpSetSchema, Bucket: bucketPath})
+	}
+	if err := checkSchema(schema); err != nil {
+		return err
+	}
+	if err := checkRefCycles(schema); err != nil {
+		return err
+	}
+	bs, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+	schemas, err := tx.getMetaBucketOrCreate("schemas")
+	if err != nil {
+		return err
+	}
+	if err = schemas.Put([]byte(bucketPath), bs); err != nil {
+		return err
+	}
+	return tx.appendLog(&LogEntry{Op: OpSetSchema, Bucket: bucketPath, Value: schema})
+}
+
+// GetSchema returns the schema of a bucket or nil if there is none
+func (tx *Transaction) GetSchema(bucketPath string) (map[string]interface{}, error) {
+	schemas := tx.getMetaBucket("schemas")
+	if schemas == nil {
+		return nil, nil
+	}
+	bs := schemas.Get([]byte(bucketPath))
+	if bs == nil {
+		return nil, nil
+	}
+	schema := make(map[string]interface{})
+	if err := json.Unmarshal(bs, &schema); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// compiledSchema is a schema ready for validation
+type compiledSchema struct {
+	// raw is the stored schema it was compiled from
+	raw      []byte
+	root     map[string]interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// schemaCache keeps the compiled schemas of the buckets. Entries are only used while they match the
+// stored schema, so transactions which set a schema and roll back do not leave a wrong entry.
+type schemaCache struct {
+	mu      sync.Mutex
+	schemas map[string]*compiledSchema
+}
+
+func (c *schemaCache) get(bucketPath string, raw []byte) *compiledSchema {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if schema := c.schemas[bucketPath]; schema != nil && bytes.Equal(schema.raw, raw) {
+		return schema
+	}
+	return nil
+}
+
+func (c *schemaCache) put(bucketPath string, schema *compiledSchema) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.schemas == nil {
+		c.schemas = make(map[string]*compiledSchema)
+	}
+	c.schemas[bucketPath] = schema
+}
+
+func (c *schemaCache) remove(bucketPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.schemas, bucketPath)
+}
+
+// schema returns the compiled schema of a bucket or nil if there is none
+func (tx *Transaction) schema(bucketPath string) (*compiledSchema, error) {
+	schemas := tx.getMetaBucket("schemas")
+	if schemas == nil {
+		return nil, nil
+	}
+	raw := schemas.Get([]byte(bucketPath))
+	if raw == nil {
+		return nil, nil
+	}
+	if schema := tx.db.schemas.get(bucketPath, raw); schema != nil {
+		return schema, nil
+	}
+	schema, err := compileSchema(append([]byte{}, raw...))
+	if err != nil {
+		return nil, err
+	}
+	tx.db.schemas.put(bucketPath, schema)
+	return schema, nil
+}
+
+// compileSchema decodes a stored schema and compiles the patterns of all its subschemas
+func compileSchema(raw []byte) (*compiledSchema, error) {
+	schema := &compiledSchema{raw: raw, patterns: make(map[string]*regexp.Regexp)}
+	if err := json.Unmarshal(raw, &schema.root); err != nil {
+		return nil, err
+	}
+	compile := func(pattern string) error {
+		if _, ok := schema.patterns[pattern]; ok {
+			return nil
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %v: %v", pattern, err)
+		}
+		schema.patterns[pattern] = re
+		return nil
+	}
+	seen := make(map[string]bool)
+	var walk func(pointer string, sub interface{}) error
+	walk = func(pointer string, sub interface{}) error {
+		s, ok := sub.(map[string]interface{})
+		if !ok || seen[pointer] {
+			return nil
+		}
+		seen[pointer] = true
+		if pattern, ok := s["pattern"].(string); ok {
+			if err := compile(pattern); err != nil {
+				return err
+			}
+		}
+		if patternProperties, ok := s["patternProperties"].(map[string]interface{}); ok {
+			for pattern := range patternProperties {
+				if err := compile(pattern); err != nil {
+					return err
+				}
+			}
+		}
+		for _, next := range subschemas(schema.root, pointer, s, true) {
+			if err := walk(next.pointer, next.schema); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk("", schema.root); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// ValidateBucket checks all docs of a bucket against its schema and returns the errors of the invalid ones
+func (tx *Transaction) ValidateBucket(bucketPath string) ([]*ValidationError, error) {
+	schema, err := tx.schema(bucketPath)
+	if err != nil {
+		return nil, err
+	}
+	if schema == nil {
+		return nil, errors.New("no schema on bucket")
+	}
+	bucket, err := tx.getBucket(bucketPath)
+	if err != nil {
+		return nil, err
+	}
+	var res []*ValidationError
+	err = bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		doc, e := tx.decodeValue(v)
+		if e != nil {
+			return e
+		}
+		if e := newValidationError(bucketPath, string(k), schema, doc); e != nil {
+			res = append(res, e)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// validate checks a doc against the schema of its bucket, if there is one
+func (tx *Transaction) validate(bucketPath, key string, doc interface{}) error {
+	schema, err := tx.schema(bucketPath)
+	if err != nil || schema == nil {
+		return err
+	}
+	// round trip through json to get the same types a stored doc would have
+	bs, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err = json.Unmarshal(bs, &value); err != nil {
+		return err
+	}
+	if e := newValidationError(bucketPath, key, schema, value); e != nil {
+		return e
+	}
+	return nil
+}
+
+// newValidationError validates a doc and returns nil if it is valid
+func newValidationError(bucketPath, key string, schema *compiledSchema, doc interface{}) *ValidationError {
+	violations := validateSchema(schema, schema.root, doc, "")
+	if len(violations) == 0 {
+		return nil
+	}
+	sort.SliceStable(violations, func(i, j int) bool { return violations[i].Path < violations[j].Path })
+	return &ValidationError{bucketPath, key, violations}
+}
+
+// checkSchema makes sure the schema can be used for validation
+func checkSchema(schema interface{}) error {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		if _, ok := schema.(bool); ok {
+			return nil
+		}
+		return errors.New("schema must be an object or a boolean")
+	}
+	if pattern, ok := s["pattern"].(string); ok {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return err
+		}
+	}
+	for _, keyword := range []string{"properties", "patternProperties", "$defs"} {
+		if sub, ok := s[keyword].(map[string]interface{}); ok {
+			for name, subSchema := range sub {
+				if keyword == "patternProperties" {
+					if _, err := regexp.Compile(name); err != nil {
+						return err
+					}
+				}
+				if err := checkSchema(subSchema); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, keyword := range []string{"items", "additionalProperties", "not", "contains", "if", "then", "else"} {
+		if sub, ok := s[keyword]; ok {
+			if err := checkSchema(sub); err != nil {
+				return err
+			}
+		}
+	}
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf", "prefixItems"} {
+		if sub, ok := s[keyword]; ok {
+			list, ok := sub.([]interface{})
+			if !ok {
+				return fmt.Errorf("%v must be an array", keyword)
+			}
+			for _, subSchema := range list {
+				if err := checkSchema(subSchema); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if ref, ok := s["$ref"].(string); ok && !strings.HasPrefix(ref, "#") {
+		return fmt.Errorf("only local $refs are supported: %v", ref)
+	}
+	return nil
+}
+
+// checkRefCycles rejects schemas whose $refs loop back without descending into the value, e.g. {"$ref": "#"},
+// validating a value against them would never end
+func checkRefCycles(root interface{}) error {
+	// state of the subschemas in the depth-first search over the keywords applying to the same value,
+	// 1 while in progress and 2 when done
+	state := make(map[string]int)
+	var samePlace func(pointer string, schema interface{}) error
+	samePlace = func(pointer string, schema interface{}) error {
+		switch state[pointer] {
+		case 1:
+			return fmt.Errorf("$ref cycle at #%v", pointer)
+		case 2:
+			return nil
+		}
+		state[pointer] = 1
+		for _, sub := range subschemas(root, pointer, schema, false) {
+			if err := samePlace(sub.pointer, sub.schema); err != nil {
+				return err
+			}
+		}
+		state[pointer] = 2
+		return nil
+	}
+	seen := make(map[string]bool)
+	var walk func(pointer string, schema interface{}) error
+	walk = func(pointer string, schema interface{}) error {
+		if seen[pointer] {
+			return nil
+		}
+		seen[pointer] = true
+		if err := samePlace(pointer, schema); err != nil {
+			return err
+		}
+		for _, sub := range subschemas(root, pointer, schema, true) {
+			if err := walk(sub.pointer, sub.schema); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk("", root)
+}
+
+type subschema struct {
+	pointer string
+	schema  interface{}
+}
+
+// subschemas returns the subschemas of a schema applying to the same value, including the target of its $ref.
+// With nested the subschemas of properties and items are returned too.
+func subschemas(root interface{}, pointer string, schema interface{}, nested bool) []subschema {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	var res []subschema
+	add := func(keywords []string) {
+		for _, keyword := range keywords {
+			switch sub := s[keyword].(type) {
+			case nil:
+			case []interface{}:
+				for i, elem := range sub {
+					res = append(res, subschema{pointer + "/" + keyword + "/" + strconv.Itoa(i), elem})
+				}
+			case map[string]interface{}:
+				if keyword == "properties" || keyword == "patternProperties" || keyword == "$defs" {
+					for name, elem := range sub {
+						res = append(res, subschema{pointer + "/" + keyword + "/" + escapePointer(name), elem})
+					}
+				} else {
+					res = append(res, subschema{pointer + "/" + keyword, sub})
+				}
+			default:
+				res = append(res, subschema{pointer + "/" + keyword, sub})
+			}
+		}
+	}
+	if ref, ok := s["$ref"].(string); ok {
+		if target := resolveRef(root, ref); target != nil {
+			res = append(res, subschema{refPointer(ref), target})
+		}
+	}
+	add([]string{"allOf", "anyOf", "oneOf", "not", "if", "then", "else"})
+	if nested {
+		add([]string{"properties", "patternProperties", "$defs", "items", "prefixItems", "additionalProperties", "contains"})
+	}
+	return res
+}
+
+// refPointer normalizes the JSON pointer of a local $ref, so it equals the pointers built by subschemas
+func refPointer(ref string) string {
+	pointer := ""
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part != "" {
+			pointer += "/" + part
+		}
+	}
+	return pointer
+}
+
+// validateSchema validates a value against a (sub)schema and returns all violations
+func validateSchema(c *compiledSchema, schema interface{}, value interface{}, path string) []Violation {
+	var res []Violation
+	fail := func(keyword, format string, args ...interface{}) {
+		p := path
+		if p == "" {
+			p = "/"
+		}
+		res = append(res, Violation{p, keyword, fmt.Sprintf(format, args...)})
+	}
+
+	if b, ok := schema.(bool); ok {
+		if !b {
+			fail("false", "no value allowed")
+		}
+		return res
+	}
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return res
+	}
+
+	if ref, ok := s["$ref"].(string); ok {
+		if target := resolveRef(c.root, ref); target != nil {
+			res = append(res, validateSchema(c, target, value, path)...)
+		} else {
+			fail("$ref", "unresolvable reference %v", ref)
+		}
+	}
+
+	if t, ok := s["type"]; ok && !matchesType(t, value) {
+		fail("type", "expected %v, got %v", t, jsonType(value))
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("enum", "value must be one of %v", enum)
+		}
+	}
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, value) {
+		fail("const", "value must be %v", c)
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if min, ok := s["minimum"].(float64); ok && v < min {
+			fail("minimum", "must be >= %v", min)
+		}
+		if max, ok := s["maximum"].(float64); ok && v > max {
+			fail("maximum", "must be <= %v", max)
+		}
+		if min, ok := s["exclusiveMinimum"].(float64); ok && v <= min {
+			fail("exclusiveMinimum", "must be > %v", min)
+		}
+		if max, ok := s["exclusiveMaximum"].(float64); ok && v >= max {
+			fail("exclusiveMaximum", "must be < %v", max)
+		}
+		if m, ok := s["multipleOf"].(float64); ok && m > 0 {
+			if q := v / m; math.Abs(q-math.Round(q)) > 1e-9 {
+				fail("multipleOf", "must be a multiple of %v", m)
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if min, ok := s["minLength"].(float64); ok && length < min {
+			fail("minLength", "must be at least %v characters long", min)
+		}
+		if max, ok := s["maxLength"].(float64); ok && length > max {
+			fail("maxLength", "must be at most %v characters long", max)
+		}
+		if pattern, ok := s["pattern"].(string); ok {
+			if re := c.patterns[pattern]; re == nil {
+				fail("pattern", "invalid pattern %v", pattern)
+			} else if !re.MatchString(v) {
+				fail("pattern", "must match %v", pattern)
+			}
+		}
+	case []interface{}:
+		length := float64(len(v))
+		if min, ok := s["minItems"].(float64); ok && length < min {
+			fail("minItems", "must have at least %v items", min)
+		}
+		if max, ok := s["maxItems"].(float64); ok && length > max {
+			fail("maxItems", "must have at most %v items", max)
+		}
+		if unique, ok := s["uniqueItems"].(bool); ok && unique {
+			for i := range v {
+				for j := i + 1; j < len(v); j++ {
+					if reflect.DeepEqual(v[i], v[j]) {
+						fail("uniqueItems", "items %v and %v are equal", i, j)
+					}
+				}
+			}
+		}
+		prefix, _ := s["prefixItems"].([]interface{})
+		for i, item := range v {
+			itemPath := path + "/" + strconv.Itoa(i)
+			if i < len(prefix) {
+				res = append(res, validateSchema(c, prefix[i], item, itemPath)...)
+			} else if items, ok := s["items"]; ok {
+				res = append(res, validateSchema(c, items, item, itemPath)...)
+			}
+		}
+		if contains, ok := s["contains"]; ok {
+			found := false
+			for _, item := range v {
+				if len(validateSchema(c, contains, item, path)) == 0 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				fail("contains", "no item matches the contains schema")
+			}
+		}
+	case map[string]interface{}:
+		length := float64(len(v))
+		if min, ok := s["minProperties"].(float64); ok && length < min {
+			fail("minProperties", "must have at least %v properties", min)
+		}
+		if max, ok := s["maxProperties"].(float64); ok && length > max {
+			fail("maxProperties", "must have at most %v properties", max)
+		}
+		if required, ok := s["required"].([]interface{}); ok {
+			for _, name := range required {
+				if n, ok := name.(string); ok {
+					if _, ok := v[n]; !ok {
+						fail("required", "property %v is missing", n)
+					}
+				}
+			}
+		}
+		properties, _ := s["properties"].(map[string]interface{})
+		patternProperties, _ := s["patternProperties"].(map[string]interface{})
+		for name, prop := range v {
+			propPath := path + "/" + escapePointer(name)
+			matched := false
+			if sub, ok := properties[name]; ok {
+				matched = true
+				res = append(res, validateSchema(c, sub, prop, propPath)...)
+			}
+			for pattern, sub := range patternProperties {
+				if re := c.patterns[pattern]; re == nil {
+					res = append(res, Violation{propPath, "patternProperties", "invalid pattern " + pattern})
+				} else if re.MatchString(name) {
+					matched = true
+					res = append(res, validateSchema(c, sub, prop, propPath)...)
+				}
+			}
+			if additional, ok := s["additionalProperties"]; ok && !matched {
+				if b, ok := additional.(bool); ok && !b {
+					res = append(res, Violation{propPath, "additionalProperties", "property is not allowed"})
+				} else {
+					res = append(res, validateSchema(c, additional, prop, propPath)...)
+				}
+			}
+		}
+	}
+
+	if allOf, ok := s["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			res = append(res, validateSchema(c, sub, value, path)...)
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]interface{}); ok {
+		matches := 0
+		for _, sub := range anyOf {
+			if len(validateSchema(c, sub, value, path)) == 0 {
+				matches++
+			}
+		}
+		if matches == 0 {
+			fail("anyOf", "value matches none of the schemas")
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, sub := range oneOf {
+			if len(validateSchema(c, sub, value, path)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			fail("oneOf", "value must match exactly one schema, matches %v", matches)
+		}
+	}
+	if not, ok := s["not"]; ok && len(validateSchema(c, not, value, path)) == 0 {
+		fail("not", "value must not match the schema")
+	}
+	if cond, ok := s["if"]; ok {
+		if len(validateSchema(c, cond, value, path)) == 0 {
+			if then, ok := s["then"]; ok {
+				res = append(res, validateSchema(c, then, value, path)...)
+			}
+		} else if otherwise, ok := s["else"]; ok {
+			res = append(res, validateSchema(c, otherwise, value, path)...)
+		}
+	}
+	return res
+}
+
+func resolveRef(root interface{}, ref string) interface{} {
+	current := root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		part = strings.Replace(strings.Replace(part, "~1", "/", -1), "~0", "~", -1)
+		if current, ok = obj[part]; !ok {
+			return nil
+		}
+	}
+	return current
+}
+
+func escapePointer(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
+
+func matchesType(t interface{}, value interface{}) bool {
+	switch expected := t.(type) {
+	case string:
+		actual := jsonType(value)
+		return actual == expected || (expected == "number" && actual == "integer")
+	case []interface{}:
+		for _, e := range expected {
+			if matchesType(e, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
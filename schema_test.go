@@ -0,0 +1,153 @@
+package boltplus
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const personSchema = `{
+	"type": "object",
+	"required": ["name"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "uniqueItems": true}
+	},
+	"additionalProperties": false,
+	"$defs": {
+		"tag": {"type": "string", "enum": ["a", "b"]}
+	}
+}`
+
+func setupSchema(db *DB) error {
+	schema := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(personSchema), &schema); err != nil {
+		return err
+	}
+	return db.SetSchema("people", schema)
+}
+
+func TestSchemaValidDoc(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	if err := setupSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("people", "1", Object{"name": "alice", "age": 42, "tags": []interface{}{"a", "b"}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSchemaInvalidDoc(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	if err := setupSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	err := db.Put("people", "1", Object{"age": -1.5, "tags": []interface{}{"a", "a", "c"}, "foo": true})
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("wanted validation error got %v", err)
+	}
+	expect := map[string]bool{
+		"/:required":                true,
+		"/age:type":                 true,
+		"/age:minimum":              true,
+		"/tags:uniqueItems":         true,
+		"/tags/2:enum":              true,
+		"/foo:additionalProperties": true,
+	}
+	if len(validationErr.Violations) != len(expect) {
+		t.Errorf("wanted %v violations got %v", len(expect), validationErr.Violations)
+	}
+	for _, v := range validationErr.Violations {
+		if !expect[v.Path+":"+v.Keyword] {
+			t.Errorf("unexpected violation %v", v)
+		}
+	}
+	if _, err := db.Get("people", "1"); err == nil {
+		t.Error("invalid doc should not be stored")
+	}
+}
+
+func TestValidateBucket(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.Put("people", "1", Object{"name": "alice"})
+	db.Put("people", "2", Object{"name": 42})
+	if err := setupSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	errs, err := db.ValidateBucket("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 || errs[0].Key != "2" {
+		t.Errorf("wanted doc 2 to be invalid got %v", errs)
+	}
+}
+
+func TestSchemaRefCycles(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	for _, bad := range []string{
+		`{"$ref": "#"}`,
+		`{"definitions": {"a": {"$ref": "#/definitions/a"}}, "$ref": "#/definitions/a"}`,
+		`{"properties": {"x": {"$ref": "#/$defs/a"}}, "$defs": {"a": {"anyOf": [{"$ref": "#/$defs/b"}]}, "b": {"not": {"$ref": "#/$defs/a"}}}}`,
+	} {
+		schema := make(map[string]interface{})
+		json.Unmarshal([]byte(bad), &schema)
+		if err := db.SetSchema("cycles", schema); err == nil {
+			t.Errorf("wanted error for %v", bad)
+		}
+	}
+
+	// recursion descending into the value is fine
+	schema := make(map[string]interface{})
+	json.Unmarshal([]byte(`{"type": "object", "properties": {"children": {"type": "array", "items": {"$ref": "#"}}}}`), &schema)
+	if err := db.SetSchema("tree", schema); err != nil {
+		t.Fatal(err)
+	}
+	leaf := map[string]interface{}{"children": []interface{}{}}
+	if err := db.Put("tree", "1", Object{"children": []interface{}{leaf}}); err != nil {
+		t.Error(err)
+	}
+	if err := db.Put("tree", "2", Object{"children": []interface{}{42.}}); err == nil {
+		t.Error("wanted validation error for a child which is no object")
+	}
+}
+
+func TestSchemaCache(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.SetSchema("codes", map[string]interface{}{
+		"properties": map[string]interface{}{"code": map[string]interface{}{"type": "string", "pattern": "^[a-z]+$"}},
+	})
+	if err := db.Put("codes", "1", Object{"code": "abc"}); err != nil {
+		t.Error(err)
+	}
+	if err := db.Put("codes", "2", Object{"code": "ABC"}); err == nil {
+		t.Error("wanted pattern violation")
+	}
+
+	// a schema set in a transaction which rolls back must not stay in effect
+	tx, _ := db.Tx(true)
+	tx.SetSchema("codes", map[string]interface{}{"required": []interface{}{"name"}})
+	if err := tx.Put("codes", "3", Object{"code": "abc"}); err == nil {
+		t.Error("wanted the new schema to apply in the transaction")
+	}
+	tx.Rollback()
+	if err := db.Put("codes", "3", Object{"code": "abc"}); err != nil {
+		t.Errorf("wanted the old schema after the rollback got %v", err)
+	}
+
+	// invalid patterns are errors, not skipped
+	tx, _ = db.Tx(true)
+	schemas, _ := tx.getMetaBucketOrCreate("schemas")
+	schemas.Put([]byte("broken"), []byte(`{"properties": {"code": {"pattern": "["}}}`))
+	tx.Commit()
+	if err := db.Put("broken", "1", Object{"code": "abc"}); err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Errorf("wanted invalid pattern error got %v", err)
+	}
+}
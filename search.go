@@ -0,0 +1,377 @@
+package boltplus
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// SearchIndex describes a full-text index over some fields of the docs in a bucket
+type SearchIndex struct {
+	// Fields are the (dotted) paths of the string fields to index
+	Fields []string `json:"fields"`
+	// Language selects stopwords and stemming, "en" and "de" are supported
+	Language string `json:"language"`
+}
+
+// BM25 parameters
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+var (
+	searchConfigKey = []byte("config")
+	searchStatsKey  = []byte("stats")
+	searchTermsKey  = []byte("terms")
+	searchDocsKey   = []byte("docs")
+	// searchKeyIDKey holds the id of the key hashing the terms of indexes in encrypted databases
+	searchKeyIDKey = []byte("keyId")
+)
+
+// CreateSearchIndex creates (or recreates) a full-text index on a bucket and indexes all existing docs
+func (tx *Transaction) CreateSearchIndex(bucketPath string, index *SearchIndex) error {
+	if index == nil || len(index.Fields) == 0 {
+		return errors.New("search index needs at least one field")
+	}
+	if err := tx.dropSearchIndex(bucketPath); err != nil {
+		return err
+	}
+	idx, err := tx.getMetaBucketOrCreate("search", bucketPath)
+	if err != nil {
+		return err
+	}
+	bs, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err = idx.Put(searchConfigKey, bs); err != nil {
+		return err
+	}
+	if tx.db.keys != nil {
+		id, _, e := tx.db.keys.CurrentKey()
+		if e != nil {
+			return e
+		}
+		if err = idx.Put(searchKeyIDKey, []byte(id)); err != nil {
+			return err
+		}
+	}
+	config := map[string]interface{}{"fields": index.Fields, "language": index.Language}
+	if err = tx.appendLog(&LogEntry{Op: OpCreateSearchIndex, Bucket: bucketPath, Value: config}); err != nil {
+		return err
+	}
+	bucket, err := tx.getBucket(bucketPath)
+	if err != nil {
+		// nothing to index yet
+		return nil
+	}
+	return bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		doc, e := tx.bytesToData(v)
+		if e == ErrNotObject {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		return tx.indexSearch(bucketPath, string(k), doc)
+	})
+}
+
+// DropSearchIndex removes the full-text index of a bucket
+func (tx *Transaction) DropSearchIndex(bucketPath string) error {
+	if err := tx.dropSearchIndex(bucketPath); err != nil {
+		return err
+	}
+	return tx.appendLog(&LogEntry{Op: OpDropSearchIndex, Bucket: bucketPath})
+}
+
+func (tx *Transaction) dropSearchIndex(bucketPath string) error {
+	search := tx.getMetaBucket("search")
+	if search == nil || search.Bucket([]byte(bucketPath)) == nil {
+		return nil
+	}
+	return search.DeleteBucket([]byte(bucketPath))
+}
+
+// GetSearchIndex returns the full-text index configuration of a bucket or nil if there is none
+func (tx *Transaction) GetSearchIndex(bucketPath string) (*SearchIndex, error) {
+	idx := tx.getMetaBucket("search", bucketPath)
+	if idx == nil {
+		return nil, nil
+	}
+	index := &SearchIndex{}
+	if err := json.Unmarshal(idx.Get(searchConfigKey), index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Search returns the docs of a bucket matching the query ranked by BM25. A limit <= 0 returns all matches.
+func (tx *Transaction) Search(bucketPath, query string, limit int) (res chan *Pair, err error) {
+	defer tx.db.observe("search", time.Now(), &err)
+	index, err := tx.GetSearchIndex(bucketPath)
+	if err != nil {
+		return nil, err
+	}
+	if index == nil {
+		return nil, errors.New("no search index on bucket")
+	}
+	bucket, err := tx.getBucket(bucketPath)
+	if err != nil {
+		return nil, err
+	}
+	idx := tx.getMetaBucket("search", bucketPath)
+	terms, docs := idx.Bucket(searchTermsKey), idx.Bucket(searchDocsKey)
+	encodeTerm, err := tx.searchTermEncoder(idx)
+	if err != nil {
+		return nil, err
+	}
+	numDocs, totalLength := decodeSearchStats(idx.Get(searchStatsKey))
+	avgLength := float64(totalLength) / math.Max(float64(numDocs), 1)
+
+	scores := make(map[string]float64)
+	seen := make(map[string]bool)
+	for _, term := range tokenize(query, index.Language) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		if terms == nil {
+			break
+		}
+		postings := terms.Bucket(encodeTerm(term))
+		if postings == nil {
+			continue
+		}
+		df := float64(postings.Stats().KeyN)
+		idf := math.Log(1 + (float64(numDocs)-df+0.5)/(df+0.5))
+		postings.ForEach(func(k, v []byte) error {
+			tf, _ := binary.Uvarint(v)
+			docLength, _ := binary.Uvarint(docs.Get(k))
+			norm := bm25K1 * (1 - bm25B + bm25B*float64(docLength)/math.Max(avgLength, 1))
+			scores[string(k)] += idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + norm)
+			return nil
+		})
+	}
+
+	ranked := make([]string, 0, len(scores))
+	for key := range scores {
+		ranked = append(ranked, key)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if scores[ranked[i]] != scores[ranked[j]] {
+			return scores[ranked[i]] > scores[ranked[j]]
+		}
+		return ranked[i] < ranked[j]
+	})
+	if limit > 0 && len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	returnChannel := make(chan *Pair, 64)
+	go func() {
+		defer close(returnChannel)
+		defer tx.Close()
+		for _, key := range ranked {
+			value, e := tx.bytesToData(bucket.Get([]byte(key)))
+			if e != nil {
+				continue
+			}
+			returnChannel <- &Pair{key, value}
+		}
+	}()
+	return returnChannel, nil
+}
+
+// indexSearch (re)indexes a doc if its bucket has a search index
+func (tx *Transaction) indexSearch(bucketPath, key string, doc map[string]interface{}) error {
+	index, err := tx.GetSearchIndex(bucketPath)
+	if err != nil || index == nil {
+		return err
+	}
+	if err = tx.unindexSearch(bucketPath, key); err != nil {
+		return err
+	}
+	idx := tx.getMetaBucket("search", bucketPath)
+	encodeTerm, err := tx.searchTermEncoder(idx)
+	if err != nil {
+		return err
+	}
+	terms, err := idx.CreateBucketIfNotExists(searchTermsKey)
+	if err != nil {
+		return err
+	}
+	docs, err := idx.CreateBucketIfNotExists(searchDocsKey)
+	if err != nil {
+		return err
+	}
+
+	frequencies := make(map[string]uint64)
+	var tokens []string
+	for _, field := range index.Fields {
+		for _, text := range searchableStrings(valueAt(doc, field)) {
+			tokens = append(tokens, tokenize(text, index.Language)...)
+		}
+	}
+	for _, token := range tokens {
+		frequencies[token]++
+	}
+
+	// the docs entry holds the doc length followed by the \x00 separated stored terms
+	entry := encodeUvarint(uint64(len(tokens)))
+	for token, tf := range frequencies {
+		term := encodeTerm(token)
+		postings, e := terms.CreateBucketIfNotExists(term)
+		if e != nil {
+			return e
+		}
+		if e = postings.Put([]byte(key), encodeUvarint(tf)); e != nil {
+			return e
+		}
+		entry = append(append(entry, term...), 0)
+	}
+	if err = docs.Put([]byte(key), entry); err != nil {
+		return err
+	}
+	numDocs, totalLength := decodeSearchStats(idx.Get(searchStatsKey))
+	return idx.Put(searchStatsKey, encodeSearchStats(numDocs+1, totalLength+uint64(len(tokens))))
+}
+
+// searchTermEncoder returns how the terms of an index are stored. Indexes created in encrypted databases
+// store the hex encoded HMAC of a term, so the index does not reveal the words of the docs.
+func (tx *Transaction) searchTermEncoder(idx backendBucket) (func(term string) []byte, error) {
+	id := idx.Get(searchKeyIDKey)
+	if id == nil {
+		return func(term string) []byte { return []byte(term) }, nil
+	}
+	if tx.db.keys == nil {
+		return nil, errors.New("the search index is encrypted but no keys are configured")
+	}
+	key, err := tx.db.keys.Key(string(id))
+	if err != nil {
+		return nil, err
+	}
+	// derive a separate key instead of using the encryption key for the hashes
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("boltplus search terms"))
+	termKey := mac.Sum(nil)
+	return func(term string) []byte {
+		mac := hmac.New(sha256.New, termKey)
+		mac.Write([]byte(term))
+		sum := mac.Sum(nil)
+		return []byte(hex.EncodeToString(sum[:16]))
+	}, nil
+}
+
+// rekeySearchIndexes rebuilds the search indexes whose terms are not hashed with the current key
+func (tx *Transaction) rekeySearchIndexes(currentID string) error {
+	search := tx.getMetaBucket("search")
+	if search == nil {
+		return nil
+	}
+	var stale []string
+	err := search.ForEach(func(name, v []byte) error {
+		if idx := search.Bucket(name); v == nil && idx != nil && string(idx.Get(searchKeyIDKey)) != currentID {
+			stale = append(stale, string(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, bucketPath := range stale {
+		index, err := tx.GetSearchIndex(bucketPath)
+		if err != nil {
+			return err
+		}
+		if err = tx.CreateSearchIndex(bucketPath, index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexSearch removes a doc from the search index of its bucket
+func (tx *Transaction) unindexSearch(bucketPath, key string) error {
+	idx := tx.getMetaBucket("search", bucketPath)
+	if idx == nil || idx.Bucket(searchDocsKey) == nil {
+		return nil
+	}
+	docs, terms := idx.Bucket(searchDocsKey), idx.Bucket(searchTermsKey)
+	entry := docs.Get([]byte(key))
+	if entry == nil {
+		return nil
+	}
+	length, n := binary.Uvarint(entry)
+	for _, term := range bytes.Split(entry[n:], []byte{0}) {
+		if len(term) == 0 {
+			continue
+		}
+		if err := removePosting(terms, term, []byte(key)); err != nil {
+			return err
+		}
+	}
+	if err := docs.Delete([]byte(key)); err != nil {
+		return err
+	}
+	numDocs, totalLength := decodeSearchStats(idx.Get(searchStatsKey))
+	return idx.Put(searchStatsKey, encodeSearchStats(numDocs-1, totalLength-length))
+}
+
+func removePosting(terms backendBucket, term, key []byte) error {
+	postings := terms.Bucket(term)
+	if postings == nil {
+		return nil
+	}
+	if err := postings.Delete(key); err != nil {
+		return err
+	}
+	if k, _ := postings.Cursor().First(); k == nil {
+		return terms.DeleteBucket(term)
+	}
+	return nil
+}
+
+func searchableStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var res []string
+		for _, elem := range v {
+			res = append(res, searchableStrings(elem)...)
+		}
+		return res
+	}
+	return nil
+}
+
+func encodeUvarint(n uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, n)]
+}
+
+func encodeSearchStats(numDocs, totalLength uint64) []byte {
+	bs := make([]byte, 16)
+	binary.BigEndian.PutUint64(bs, numDocs)
+	binary.BigEndian.PutUint64(bs[8:], totalLength)
+	return bs
+}
+
+func decodeSearchStats(bs []byte) (numDocs, totalLength uint64) {
+	if len(bs) != 16 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint64(bs), binary.BigEndian.Uint64(bs[8:])
+}
@@ -0,0 +1,73 @@
+package boltplus
+
+import (
+	"reflect"
+	"testing"
+)
+
+func collectKeys(ch chan *Pair) []string {
+	res := []string{}
+	for pair := range ch {
+		res = append(res, pair.Key)
+	}
+	return res
+}
+
+func TestTokenize(t *testing.T) {
+	cases := []struct {
+		text, language string
+		expect         []string
+	}{
+		{"The Runners were running happily", "en", []string{"runner", "run", "happili"}},
+		{"Die Häuser und die Katzen", "de", []string{"haus", "katz"}},
+		{"Hello, World!", "", []string{"hello", "world"}},
+	}
+	for _, c := range cases {
+		if res := tokenize(c.text, c.language); !reflect.DeepEqual(res, c.expect) {
+			t.Errorf("tokenize(%q): wanted %v got %v", c.text, c.expect, res)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.Put("notes", "1", Object{"title": "Shopping", "text": "buy apples and bananas"})
+	db.Put("notes", "2", Object{"title": "Apples", "text": "apple pie needs apples"})
+	if err := db.CreateSearchIndex("notes", &SearchIndex{Fields: []string{"title", "text"}, Language: "en"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("notes", "3", Object{"title": "Cars", "text": "my car is red"})
+
+	result, err := db.Search("notes", "apple", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := collectKeys(result); !reflect.DeepEqual(keys, []string{"2", "1"}) {
+		t.Errorf("wanted [2 1] got %v", keys)
+	}
+
+	db.Delete("notes", "2")
+	db.Put("notes", "1", Object{"title": "Driving", "text": "cars everywhere"})
+	result, _ = db.Search("notes", "apple", 0)
+	if keys := collectKeys(result); len(keys) != 0 {
+		t.Errorf("wanted no results got %v", keys)
+	}
+	result, _ = db.Search("notes", "car", 1)
+	if keys := collectKeys(result); !reflect.DeepEqual(keys, []string{"3"}) {
+		t.Errorf("wanted [3] got %v", keys)
+	}
+	result, _ = db.Search("notes", "drives", 0)
+	if keys := collectKeys(result); !reflect.DeepEqual(keys, []string{"1"}) {
+		t.Errorf("wanted [1] got %v", keys)
+	}
+}
+
+func TestSearchWithoutIndex(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	putN(db, 1)
+	if _, err := db.Search("test.bucket", "foo", 0); err == nil {
+		t.Error("should fail without index")
+	}
+}
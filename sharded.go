@@ -0,0 +1,319 @@
+package boltplus
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ShardBy selects what decides the shard of a doc
+type ShardBy string
+
+// Supported sharding schemes
+const (
+	// ShardByKey spreads the docs of every bucket over all shards, iterations merge all shards
+	ShardByKey ShardBy = "key"
+	// ShardByBucket keeps all docs below a top-level bucket in one shard, iterations read only that one
+	ShardByBucket ShardBy = "bucket"
+)
+
+var shardLayoutKey = []byte("layout")
+
+// ShardedOptions configures a sharded database
+type ShardedOptions struct {
+	// Shards is the number of files, it can not be changed once the database is created
+	Shards int
+	// By is the sharding scheme, the default is ShardByKey
+	By ShardBy
+	// Options are the options of every shard
+	Options *Options
+}
+
+// ShardedDB spreads docs over several database files by the hash of their key or top-level bucket.
+// Each shard has its own writer, so writes to different shards run in parallel. Writes are atomic
+// per shard only and iterations over several shards do not see one consistent snapshot.
+type ShardedDB struct {
+	shards []*DB
+	by     ShardBy
+}
+
+// NewSharded opens the shards in a directory, creating it if needed
+func NewSharded(dir string, opts *ShardedOptions) (*ShardedDB, error) {
+	if opts == nil || opts.Shards <= 0 {
+		return nil, errors.New("the number of shards must be positive")
+	}
+	by := opts.By
+	switch by {
+	case "":
+		by = ShardByKey
+	case ShardByKey, ShardByBucket:
+	default:
+		return nil, fmt.Errorf("unknown sharding scheme %v", by)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	db := &ShardedDB{by: by}
+	for i := 0; i < opts.Shards; i++ {
+		shard, err := NewWithOptions(filepath.Join(dir, shardFilename(i)), opts.Options)
+		if err == nil {
+			db.shards = append(db.shards, shard)
+			err = shard.checkShardLayout(fmt.Sprintf("%v/%v/%v", i, opts.Shards, by))
+		}
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("shard %v: %v", i, err)
+		}
+	}
+	return db, nil
+}
+
+func shardFilename(i int) string {
+	return fmt.Sprintf("shard-%03d.db", i)
+}
+
+// checkShardLayout records the position of a new shard and refuses shards of another layout
+func (db *DB) checkShardLayout(layout string) error {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	bucket, err := tx.getMetaBucketOrCreate("sharding")
+	if err != nil {
+		return err
+	}
+	if stored := bucket.Get(shardLayoutKey); stored != nil {
+		if string(stored) != layout {
+			return fmt.Errorf("created as shard %v, opened as %v", string(stored), layout)
+		}
+		return nil
+	}
+	if err = bucket.Put(shardLayoutKey, []byte(layout)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close closes all shards
+func (db *ShardedDB) Close() {
+	for _, shard := range db.shards {
+		shard.Close()
+	}
+}
+
+// Shards returns the databases of the shards, e.g. to query or restore them one by one
+func (db *ShardedDB) Shards() []*DB {
+	return db.shards
+}
+
+// shard returns the shard of a doc
+func (db *ShardedDB) shard(bucketPath, key string) *DB {
+	h := fnv.New32a()
+	if db.by == ShardByBucket {
+		h.Write([]byte(strings.SplitN(bucketPath, ".", 2)[0]))
+	} else {
+		h.Write([]byte(key))
+	}
+	return db.shards[h.Sum32()%uint32(len(db.shards))]
+}
+
+// Put inserts a doc into a bucket
+func (db *ShardedDB) Put(bucketPath, key string, val Object) error {
+	return db.shard(bucketPath, key).Put(bucketPath, key, val)
+}
+
+// Get returns a doc from a bucket
+func (db *ShardedDB) Get(bucketPath, key string) (Object, error) {
+	return db.shard(bucketPath, key).Get(bucketPath, key)
+}
+
+// Delete removes a doc from a bucket
+func (db *ShardedDB) Delete(bucketPath, key string) error {
+	return db.shard(bucketPath, key).Delete(bucketPath, key)
+}
+
+// GetAll returns all docs in a bucket ordered by key
+func (db *ShardedDB) GetAll(bucketPath string) (chan *Pair, error) {
+	return db.scan(bucketPath, func(shard *DB) (chan *Pair, error) {
+		return shard.GetAll(bucketPath)
+	})
+}
+
+// Find returns all docs in a bucket matching a gojee filter expression ordered by key
+func (db *ShardedDB) Find(bucketPath, filterExpression string) (chan *Pair, error) {
+	return db.scan(bucketPath, func(shard *DB) (chan *Pair, error) {
+		return shard.Find(bucketPath, filterExpression)
+	})
+}
+
+// GetPrefix returns all docs in a bucket with a key prefix ordered by key
+func (db *ShardedDB) GetPrefix(bucketPath, prefix string) (chan *Pair, error) {
+	return db.scan(bucketPath, func(shard *DB) (chan *Pair, error) {
+		return shard.GetPrefix(bucketPath, prefix)
+	})
+}
+
+// GetRange returns all docs in a bucket in a key range ordered by key
+func (db *ShardedDB) GetRange(bucketPath, start, end string) (chan *Pair, error) {
+	return db.scan(bucketPath, func(shard *DB) (chan *Pair, error) {
+		return shard.GetRange(bucketPath, start, end)
+	})
+}
+
+// FindPrefix returns the docs with a key prefix matching a gojee filter expression ordered by key
+func (db *ShardedDB) FindPrefix(bucketPath, prefix, filterExpression string) (chan *Pair, error) {
+	return db.scan(bucketPath, func(shard *DB) (chan *Pair, error) {
+		return shard.FindPrefix(bucketPath, prefix, filterExpression)
+	})
+}
+
+// FindRange returns the docs in a key range matching a gojee filter expression ordered by key
+func (db *ShardedDB) FindRange(bucketPath, start, end, filterExpression string) (chan *Pair, error) {
+	return db.scan(bucketPath, func(shard *DB) (chan *Pair, error) {
+		return shard.FindRange(bucketPath, start, end, filterExpression)
+	})
+}
+
+// FindFilter returns all docs in a bucket matching a Filter ordered by key
+func (db *ShardedDB) FindFilter(bucketPath string, filter Filter) (chan *Pair, error) {
+	return db.scan(bucketPath, func(shard *DB) (chan *Pair, error) {
+		return shard.FindFilter(bucketPath, filter)
+	})
+}
+
+// FindPrefixFilter returns the docs with a key prefix matching a Filter ordered by key
+func (db *ShardedDB) FindPrefixFilter(bucketPath, prefix string, filter Filter) (chan *Pair, error) {
+	return db.scan(bucketPath, func(shard *DB) (chan *Pair, error) {
+		return shard.FindPrefixFilter(bucketPath, prefix, filter)
+	})
+}
+
+// FindRangeFilter returns the docs in a key range matching a Filter ordered by key
+func (db *ShardedDB) FindRangeFilter(bucketPath, start, end string, filter Filter) (chan *Pair, error) {
+	return db.scan(bucketPath, func(shard *DB) (chan *Pair, error) {
+		return shard.FindRangeFilter(bucketPath, start, end, filter)
+	})
+}
+
+// scan runs a scan on the shards holding the bucket and merges the results
+func (db *ShardedDB) scan(bucketPath string, fn func(shard *DB) (chan *Pair, error)) (chan *Pair, error) {
+	if db.by == ShardByBucket {
+		return fn(db.shard(bucketPath, ""))
+	}
+	inputs := make([]chan *Pair, 0, len(db.shards))
+	for _, shard := range db.shards {
+		ch, err := fn(shard)
+		if err != nil {
+			// a bucket missing in some shards has no docs there
+			if err == errNoSuchBucket {
+				continue
+			}
+			for _, input := range inputs {
+				go drainPairs(input)
+			}
+			return nil, err
+		}
+		inputs = append(inputs, ch)
+	}
+	if len(inputs) == 0 {
+		return nil, errNoSuchBucket
+	}
+	return mergePairs(inputs), nil
+}
+
+// mergePairs merges channels ordered by key into one channel ordered by key
+func mergePairs(inputs []chan *Pair) chan *Pair {
+	returnChannel := make(chan *Pair, 64)
+	go func() {
+		defer close(returnChannel)
+		heads := make([]*Pair, len(inputs))
+		for i, input := range inputs {
+			heads[i] = <-input
+		}
+		for {
+			next := -1
+			for i, head := range heads {
+				if head != nil && (next < 0 || head.Key < heads[next].Key) {
+					next = i
+				}
+			}
+			if next < 0 {
+				return
+			}
+			returnChannel <- heads[next]
+			heads[next] = <-inputs[next]
+		}
+	}()
+	return returnChannel
+}
+
+func drainPairs(ch chan *Pair) {
+	for range ch {
+	}
+}
+
+// Buckets returns the sorted union of the buckets and subbuckets of all shards
+func (db *ShardedDB) Buckets() ([]string, error) {
+	seen := make(map[string]bool)
+	var res []string
+	for _, shard := range db.shards {
+		buckets, err := shard.Buckets()
+		if err != nil {
+			return nil, err
+		}
+		for _, bucket := range buckets {
+			if !seen[bucket] {
+				seen[bucket] = true
+				res = append(res, bucket)
+			}
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Backup performs hot backups of all shards in parallel, the backup of a shard is written to the
+// writer returned by target and closed afterwards
+func (db *ShardedDB) Backup(target func(shard int) (io.WriteCloser, error)) error {
+	errs := make([]error, len(db.shards))
+	var wg sync.WaitGroup
+	for i, shard := range db.shards {
+		w, err := target(i)
+		if err != nil {
+			wg.Wait()
+			return err
+		}
+		wg.Add(1)
+		go func(i int, shard *DB, w io.WriteCloser) {
+			defer wg.Done()
+			errs[i] = shard.Backup(w)
+			if err := w.Close(); errs[i] == nil {
+				errs[i] = err
+			}
+		}(i, shard, w)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("shard %v: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// BackupToDir writes the backups of all shards to a directory, it can be opened with NewSharded
+func (db *ShardedDB) BackupToDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return db.Backup(func(shard int) (io.WriteCloser, error) {
+		return os.Create(filepath.Join(dir, shardFilename(shard)))
+	})
+}
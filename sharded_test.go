@@ -0,0 +1,161 @@
+package boltplus
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func setupShardedDB(t *testing.T, by ShardBy) *ShardedDB {
+	os.RemoveAll("./shards")
+	db, err := NewSharded("./shards", &ShardedOptions{Shards: 4, By: by, Options: testOptions(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestShardedPutGetDelete(t *testing.T) {
+	db := setupShardedDB(t, ShardByKey)
+	defer os.RemoveAll("./shards")
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		if err := db.Put("docs", strconv.Itoa(i), Object{"n": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, shard := range db.Shards() {
+		if n, _ := shard.Count("docs"); n == 0 || n == 100 {
+			t.Errorf("wanted the docs to be spread over the shards, one has %v", n)
+		}
+	}
+	if doc, err := db.Get("docs", "42"); err != nil || doc["n"] != 42. {
+		t.Errorf("wanted doc 42 got %v (%v)", doc, err)
+	}
+	db.Delete("docs", "42")
+	if _, err := db.Get("docs", "42"); err == nil {
+		t.Error("wanted the doc to be deleted")
+	}
+}
+
+func TestShardedOrderedIteration(t *testing.T) {
+	db := setupShardedDB(t, ShardByKey)
+	defer os.RemoveAll("./shards")
+	defer db.Close()
+	var expect []string
+	for i := 0; i < 50; i++ {
+		db.Put("docs", strconv.Itoa(i), Object{"n": float64(i)})
+		expect = append(expect, strconv.Itoa(i))
+	}
+	sort.Strings(expect)
+	ch, err := db.GetAll("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := collectKeys(ch); !reflect.DeepEqual(keys, expect) {
+		t.Errorf("wanted %v got %v", expect, keys)
+	}
+	ch, err = db.Find("docs", ".n < 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := collectKeys(ch); !reflect.DeepEqual(keys, []string{"0", "1", "2"}) {
+		t.Errorf("wanted 0, 1 and 2 got %v", keys)
+	}
+	if _, err = db.GetAll("missing"); err == nil {
+		t.Error("wanted an error for a missing bucket")
+	}
+
+	even := FilterFunc(func(key string, doc interface{}) (bool, error) {
+		return int(doc.(map[string]interface{})["n"].(float64))%2 == 0, nil
+	})
+	for _, c := range []struct {
+		name   string
+		run    func() (chan *Pair, error)
+		expect []string
+	}{
+		{"GetPrefix", func() (chan *Pair, error) { return db.GetPrefix("docs", "1") }, []string{"1", "10", "11", "12", "13", "14", "15", "16", "17", "18", "19"}},
+		{"GetRange", func() (chan *Pair, error) { return db.GetRange("docs", "20", "23") }, []string{"20", "21", "22", "23"}},
+		{"FindPrefix", func() (chan *Pair, error) { return db.FindPrefix("docs", "1", ".n > 15") }, []string{"16", "17", "18", "19"}},
+		{"FindRange", func() (chan *Pair, error) { return db.FindRange("docs", "20", "30", ".n < 22") }, []string{"20", "21", "3"}},
+		{"FindFilter", func() (chan *Pair, error) { return db.FindFilter("docs", even) }, []string{"0", "10", "12", "14", "16", "18", "2", "20", "22", "24", "26", "28", "30", "32", "34", "36", "38", "4", "40", "42", "44", "46", "48", "6", "8"}},
+		{"FindPrefixFilter", func() (chan *Pair, error) { return db.FindPrefixFilter("docs", "3", even) }, []string{"30", "32", "34", "36", "38"}},
+		{"FindRangeFilter", func() (chan *Pair, error) { return db.FindRangeFilter("docs", "40", "45", even) }, []string{"40", "42", "44"}},
+	} {
+		ch, err := c.run()
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		if keys := collectKeys(ch); !reflect.DeepEqual(keys, c.expect) {
+			t.Errorf("%v: wanted %v got %v", c.name, c.expect, keys)
+		}
+	}
+}
+
+func TestShardedByBucket(t *testing.T) {
+	db := setupShardedDB(t, ShardByBucket)
+	defer os.RemoveAll("./shards")
+	defer db.Close()
+	for _, bucket := range []string{"alpha", "beta.sub", "gamma", "delta", "epsilon"} {
+		for i := 0; i < 10; i++ {
+			db.Put(bucket, strconv.Itoa(i), Object{})
+		}
+	}
+	for _, shard := range db.Shards() {
+		if n, _ := shard.Count("beta.sub"); n != 0 && n != 10 {
+			t.Errorf("wanted the bucket in one shard, found %v docs", n)
+		}
+	}
+	ch, err := db.GetAll("beta.sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := collectKeys(ch); len(keys) != 10 {
+		t.Errorf("wanted 10 docs got %v", keys)
+	}
+	buckets, err := db.Buckets()
+	if expect := []string{"alpha", "beta", "beta.sub", "delta", "epsilon", "gamma"}; err != nil || !reflect.DeepEqual(buckets, expect) {
+		t.Errorf("wanted %v got %v (%v)", expect, buckets, err)
+	}
+}
+
+func TestShardedLayout(t *testing.T) {
+	skipInMemory(t)
+	db := setupShardedDB(t, ShardByKey)
+	defer os.RemoveAll("./shards")
+	db.Close()
+	if _, err := NewSharded("./shards", &ShardedOptions{Shards: 2}); err == nil {
+		t.Error("wanted an error for another number of shards")
+	}
+	if _, err := NewSharded("./shards", &ShardedOptions{Shards: 4, By: ShardByBucket}); err == nil {
+		t.Error("wanted an error for another sharding scheme")
+	}
+}
+
+func TestShardedBackup(t *testing.T) {
+	db := setupShardedDB(t, ShardByKey)
+	defer os.RemoveAll("./shards")
+	defer os.RemoveAll("./shards-backup")
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		db.Put("docs", strconv.Itoa(i), Object{"n": float64(i)})
+	}
+	if err := db.BackupToDir("./shards-backup"); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := NewSharded("./shards-backup", &ShardedOptions{Shards: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	ch, err := backup.GetAll("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := collectKeys(ch); len(keys) != 20 {
+		t.Errorf("wanted 20 docs in the backup got %v", keys)
+	}
+}
@@ -13,18 +13,32 @@ var key = flag.String("key", "key.key", "susi key")
 var cert = flag.String("cert", "cert.crt", "susi cert")
 
 var dbPath = flag.String("db", "/usr/share/susi/boltplus.db", "db path")
+var keysFile = flag.String("keys-file", "", "file with encryption keys, one '<id> <base64 key>' per line, the first one is used for writing")
+var keysEnv = flag.String("keys-env", "", "environment variable with encryption keys formatted as '<id>:<base64 key>,...', the first one is used for writing")
+var stampUpdated = flag.String("stamp-updated", "", "comma separated bucket patterns (e.g. users.*) whose docs get an updatedAt timestamp on every write")
 
 var db *boltplus.DB
 
 func init() {
 	flag.Parse()
-	d, err := boltplus.New(*dbPath)
+	d, err := boltplus.NewWithOptions(*dbPath, dbOptions())
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err = boltplus.RegisterStandardHooks(d, *stampUpdated); err != nil {
+		log.Fatal(err)
+	}
 	db = d
 }
 
+func dbOptions() *boltplus.Options {
+	opts, err := boltplus.OptionsFromKeyFile(*keysFile, *keysEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return opts
+}
+
 func main() {
 	susi, err := susigo.NewSusi(*addr, *cert, *key)
 	if err != nil {
@@ -0,0 +1,406 @@
+package boltplus
+
+import (
+	"strings"
+	"unicode"
+)
+
+// tokenize splits a text into lowercased, stemmed terms and drops the stopwords of the given language.
+// Supported languages are "en" and "de", any other value only lowercases and splits.
+func tokenize(text, language string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	res := make([]string, 0, len(words))
+	for _, word := range words {
+		switch language {
+		case "en":
+			if englishStopwords[word] {
+				continue
+			}
+			word = stemEnglish(word)
+		case "de":
+			if germanStopwords[word] {
+				continue
+			}
+			word = stemGerman(word)
+		}
+		if word != "" {
+			res = append(res, word)
+		}
+	}
+	return res
+}
+
+func wordSet(words string) map[string]bool {
+	res := make(map[string]bool)
+	for _, w := range strings.Fields(words) {
+		res[w] = true
+	}
+	return res
+}
+
+var englishStopwords = wordSet(`
+a about above after again against all am an and any are as at be because been before being below
+between both but by can could did do does doing down during each few for from further had has have
+having he her here hers herself him himself his how i if in into is it its itself just me more most
+my myself no nor not now of off on once only or other our ours ourselves out over own same she should
+so some such than that the their theirs them themselves then there these they this those through to
+too under until up very was we were what when where which while who whom why will with would you
+your yours yourself yourselves`)
+
+var germanStopwords = wordSet(`
+aber alle allem allen aller alles als also am an ander andere anderem anderen anderer anderes auch
+auf aus bei bin bis bist da damit dann das dass dein deine deinem deinen deiner dem den denn der des
+dich die dies diese diesem diesen dieser dieses dir doch dort du durch ein eine einem einen einer
+eines er es etwas euch euer eure für gegen hat hatte hier hin hinter ich ihr ihre im in ins ist
+jede jedem jeden jeder jedes jetzt kann kein keine keinem keinen keiner man mein meine meinem meinen
+meiner mich mir mit nach nicht nichts noch nun nur ob oder ohne sehr sein seine seinem seinen seiner
+sich sie sind so solche soll sondern um und uns unser unsere unter viel vom von vor war waren warst
+was weil welche welchem welchen welcher welches wenn wer wie wir wird wo zu zum zur über`)
+
+// stemEnglish implements the original Porter stemming algorithm
+func stemEnglish(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	p := &porter{b: []byte(word), k: len(word) - 1}
+	p.step1ab()
+	if p.k > 0 {
+		p.step1c()
+		p.step2()
+		p.step3()
+		p.step4()
+		p.step5()
+	}
+	return string(p.b[:p.k+1])
+}
+
+type porter struct {
+	b    []byte
+	k, j int
+}
+
+type suffixRule struct {
+	suffix, replacement string
+}
+
+func (p *porter) cons(i int) bool {
+	switch p.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !p.cons(i-1)
+	}
+	return true
+}
+
+// m counts the consonant-vowel sequences in b[0..j]
+func (p *porter) m() int {
+	n, i := 0, 0
+	for ; i <= p.j && p.cons(i); i++ {
+	}
+	for i <= p.j {
+		for ; i <= p.j && !p.cons(i); i++ {
+		}
+		if i > p.j {
+			break
+		}
+		n++
+		for ; i <= p.j && p.cons(i); i++ {
+		}
+	}
+	return n
+}
+
+func (p *porter) vowelInStem() bool {
+	for i := 0; i <= p.j; i++ {
+		if !p.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *porter) doublec(j int) bool {
+	return j >= 1 && p.b[j] == p.b[j-1] && p.cons(j)
+}
+
+func (p *porter) cvc(i int) bool {
+	if i < 2 || !p.cons(i) || p.cons(i-1) || !p.cons(i-2) {
+		return false
+	}
+	switch p.b[i] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+func (p *porter) ends(s string) bool {
+	if len(s) > p.k+1 || string(p.b[p.k-len(s)+1:p.k+1]) != s {
+		return false
+	}
+	p.j = p.k - len(s)
+	return true
+}
+
+func (p *porter) setto(s string) {
+	p.b = append(p.b[:p.j+1], s...)
+	p.k = p.j + len(s)
+}
+
+func (p *porter) replace(rules []suffixRule) {
+	for _, rule := range rules {
+		if p.ends(rule.suffix) {
+			if p.m() > 0 {
+				p.setto(rule.replacement)
+			}
+			return
+		}
+	}
+}
+
+func (p *porter) step1ab() {
+	if p.b[p.k] == 's' {
+		if p.ends("sses") {
+			p.k -= 2
+		} else if p.ends("ies") {
+			p.setto("i")
+		} else if p.b[p.k-1] != 's' {
+			p.k--
+		}
+	}
+	if p.ends("eed") {
+		if p.m() > 0 {
+			p.k--
+		}
+	} else if (p.ends("ed") || p.ends("ing")) && p.vowelInStem() {
+		p.k = p.j
+		switch {
+		case p.ends("at"):
+			p.setto("ate")
+		case p.ends("bl"):
+			p.setto("ble")
+		case p.ends("iz"):
+			p.setto("ize")
+		case p.doublec(p.k):
+			switch p.b[p.k] {
+			case 'l', 's', 'z':
+			default:
+				p.k--
+			}
+		default:
+			p.j = p.k
+			if p.m() == 1 && p.cvc(p.k) {
+				p.setto("e")
+			}
+		}
+	}
+}
+
+func (p *porter) step1c() {
+	if p.ends("y") && p.vowelInStem() {
+		p.b[p.k] = 'i'
+	}
+}
+
+var porterStep2 = map[byte][]suffixRule{
+	'a': {{"ational", "ate"}, {"tional", "tion"}},
+	'c': {{"enci", "ence"}, {"anci", "ance"}},
+	'e': {{"izer", "ize"}},
+	'l': {{"bli", "ble"}, {"alli", "al"}, {"entli", "ent"}, {"eli", "e"}, {"ousli", "ous"}},
+	'o': {{"ization", "ize"}, {"ation", "ate"}, {"ator", "ate"}},
+	's': {{"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"}, {"ousness", "ous"}},
+	't': {{"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"}},
+	'g': {{"logi", "log"}},
+}
+
+func (p *porter) step2() {
+	p.replace(porterStep2[p.b[p.k-1]])
+}
+
+var porterStep3 = map[byte][]suffixRule{
+	'e': {{"icate", "ic"}, {"ative", ""}, {"alize", "al"}},
+	'i': {{"iciti", "ic"}},
+	'l': {{"ical", "ic"}, {"ful", ""}},
+	's': {{"ness", ""}},
+}
+
+func (p *porter) step3() {
+	p.replace(porterStep3[p.b[p.k]])
+}
+
+var porterStep4 = map[byte][]string{
+	'a': {"al"},
+	'c': {"ance", "ence"},
+	'e': {"er"},
+	'i': {"ic"},
+	'l': {"able", "ible"},
+	'n': {"ant", "ement", "ment", "ent"},
+	'o': {"ion", "ou"},
+	's': {"ism"},
+	't': {"ate", "iti"},
+	'u': {"ous"},
+	'v': {"ive"},
+	'z': {"ize"},
+}
+
+func (p *porter) step4() {
+	for _, suffix := range porterStep4[p.b[p.k-1]] {
+		if !p.ends(suffix) {
+			continue
+		}
+		if suffix == "ion" && (p.j < 0 || (p.b[p.j] != 's' && p.b[p.j] != 't')) {
+			continue
+		}
+		if p.m() > 1 {
+			p.k = p.j
+		}
+		return
+	}
+}
+
+func (p *porter) step5() {
+	p.j = p.k
+	if p.b[p.k] == 'e' {
+		a := p.m()
+		if a > 1 || a == 1 && !p.cvc(p.k-1) {
+			p.k--
+		}
+	}
+	if p.b[p.k] == 'l' && p.doublec(p.k) && p.m() > 1 {
+		p.k--
+	}
+}
+
+// stemGerman implements the snowball german stemming algorithm
+func stemGerman(word string) string {
+	w := []rune(strings.Replace(word, "ß", "ss", -1))
+	isVowel := func(r rune) bool { return strings.ContainsRune("aeiouyäöü", r) }
+	for i := 1; i < len(w)-1; i++ {
+		if isVowel(w[i-1]) && isVowel(w[i+1]) {
+			switch w[i] {
+			case 'u':
+				w[i] = 'U'
+			case 'y':
+				w[i] = 'Y'
+			}
+		}
+	}
+	region := func(start int) int {
+		for i := start + 1; i < len(w); i++ {
+			if !isVowel(w[i]) && isVowel(w[i-1]) {
+				return i + 1
+			}
+		}
+		return len(w)
+	}
+	r1 := region(0)
+	r2 := region(r1)
+	if r1 < 3 {
+		r1 = 3
+	}
+	hasSuffix := func(s string, region int) bool {
+		suffix := []rune(s)
+		n := len(w) - len(suffix)
+		return n >= 0 && n >= region && string(w[n:]) == s
+	}
+	precededBy := func(suffixLen int, chars string) bool {
+		n := len(w) - suffixLen - 1
+		return n >= 0 && strings.ContainsRune(chars, w[n])
+	}
+	trim := func(s string) { w = w[:len(w)-len([]rune(s))] }
+
+	// step 1
+	switch {
+	case hasSuffix("ern", 0) || hasSuffix("em", 0) || hasSuffix("er", 0):
+		for _, s := range []string{"ern", "em", "er"} {
+			if hasSuffix(s, 0) {
+				if hasSuffix(s, r1) {
+					trim(s)
+				}
+				break
+			}
+		}
+	case hasSuffix("en", 0) || hasSuffix("es", 0) || hasSuffix("e", 0):
+		for _, s := range []string{"en", "es", "e"} {
+			if hasSuffix(s, 0) {
+				if hasSuffix(s, r1) {
+					trim(s)
+					if hasSuffix("niss", 0) {
+						trim("s")
+					}
+				}
+				break
+			}
+		}
+	case hasSuffix("s", r1) && precededBy(1, "bdfghklmnrt"):
+		trim("s")
+	}
+
+	// step 2
+	switch {
+	case hasSuffix("est", 0) || hasSuffix("en", 0) || hasSuffix("er", 0):
+		for _, s := range []string{"est", "en", "er"} {
+			if hasSuffix(s, 0) {
+				if hasSuffix(s, r1) {
+					trim(s)
+				}
+				break
+			}
+		}
+	case hasSuffix("st", r1) && precededBy(2, "bdfghklmnt") && len(w) >= 6:
+		trim("st")
+	}
+
+	// step 3
+	notPrecededByE := func(suffixLen int) bool { return !precededBy(suffixLen, "e") }
+	switch {
+	case hasSuffix("end", 0) || hasSuffix("ung", 0):
+		s := "end"
+		if hasSuffix("ung", 0) {
+			s = "ung"
+		}
+		if hasSuffix(s, r2) {
+			trim(s)
+			if hasSuffix("ig", r2) && notPrecededByE(2) {
+				trim("ig")
+			}
+		}
+	case hasSuffix("isch", 0) || hasSuffix("ig", 0) || hasSuffix("ik", 0):
+		for _, s := range []string{"isch", "ig", "ik"} {
+			if hasSuffix(s, 0) {
+				if hasSuffix(s, r2) && notPrecededByE(len(s)) {
+					trim(s)
+				}
+				break
+			}
+		}
+	case hasSuffix("lich", 0) || hasSuffix("heit", 0):
+		s := "lich"
+		if hasSuffix("heit", 0) {
+			s = "heit"
+		}
+		if hasSuffix(s, r2) {
+			trim(s)
+			for _, s := range []string{"er", "en"} {
+				if hasSuffix(s, r1) {
+					trim(s)
+					break
+				}
+			}
+		}
+	case hasSuffix("keit", 0):
+		if hasSuffix("keit", r2) {
+			trim("keit")
+			if hasSuffix("lich", r2) {
+				trim("lich")
+			} else if hasSuffix("ig", r2) {
+				trim("ig")
+			}
+		}
+	}
+
+	return strings.NewReplacer("ä", "a", "ö", "o", "ü", "u", "U", "u", "Y", "y").Replace(string(w))
+}
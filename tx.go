@@ -7,10 +7,11 @@ import (
 	"io"
 	"log"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/golang/snappy"
-	"github.com/nytlabs/gojee"
+	bolt "go.etcd.io/bbolt"
 )
 
 // Transaction represents represents a bold db transaction and exposes the query and update routines
@@ -24,33 +25,79 @@ import (
 // tx.Commit()
 // ```
 type Transaction struct {
-	tx         *bolt.Tx
-	isFinished bool
+	tx         backendTx
+	db         *DB
+	isFinished int32
+	started    time.Time
+	// applying is set while log entries of another database are applied, they are not logged again
+	applying bool
+	// recording is set while writes are recorded by DB.Record, their log entries are collected in recorded
+	recording bool
+	recorded  []*LogEntry
 }
 
 // Commit commits and closes the transaction
 func (tx *Transaction) Commit() error {
-	tx.isFinished = true
-	return tx.tx.Commit()
+	if !tx.finish() {
+		return bolt.ErrTxClosed
+	}
+	writable := tx.tx.Writable()
+	defer tx.db.release(writable)
+	defer tx.db.observeTx(writable, tx.started)
+	var size int64
+	if writable {
+		size = tx.tx.Size()
+	}
+	if err := tx.tx.Commit(); err != nil {
+		return err
+	}
+	if writable {
+		tx.db.observeSize(size)
+	}
+	return nil
 }
 
 // Rollback discards all changes and closes the transaction
 func (tx *Transaction) Rollback() error {
-	tx.isFinished = true
+	if !tx.finish() {
+		return bolt.ErrTxClosed
+	}
+	defer tx.db.release(tx.tx.Writable())
+	defer tx.db.observeTx(tx.tx.Writable(), tx.started)
 	return tx.tx.Rollback()
 }
 
 // Close closes the transaction. If neither Commit nor Rollback were called before,
 // it rollbacks the transaction
 func (tx *Transaction) Close() error {
-	if !tx.isFinished {
-		return tx.Rollback()
+	if err := tx.Rollback(); err != bolt.ErrTxClosed {
+		return err
 	}
 	return nil
 }
 
+// finish marks the transaction as finished, it returns false if it already was
+func (tx *Transaction) finish() bool {
+	return atomic.CompareAndSwapInt32(&tx.isFinished, 0, 1)
+}
+
 // Put inserts a doc into a bucket
-func (tx *Transaction) Put(bucketPath, key string, val map[string]interface{}) error {
+func (tx *Transaction) Put(bucketPath, key string, val map[string]interface{}) (err error) {
+	defer tx.db.observe("put", time.Now(), &err)
+	if val, err = tx.beforePutDoc(bucketPath, key, val); err != nil {
+		return err
+	}
+	if err = tx.validate(bucketPath, key, val); err != nil {
+		return err
+	}
+	if err = tx.put(bucketPath, key, val); err != nil {
+		return err
+	}
+	return tx.runPutHooks(afterPut, bucketPath, key, val)
+}
+
+// put stores a doc without running hooks and validation
+func (tx *Transaction) put(bucketPath, key string, val map[string]interface{}) error {
 	bucket, err := tx.getBucketOrCreate(bucketPath)
 	if err != nil {
 		log.Print("bucket err:", err)
@@ -60,11 +107,21 @@ func (tx *Transaction) Put(bucketPath, key string, val map[string]interface{}) e
 	if err != nil {
 		return err
 	}
-	return bucket.Put([]byte(key), bs)
+	if err = bucket.Put([]byte(key), bs); err != nil {
+		return err
+	}
+	if err = tx.indexSearch(bucketPath, key, val); err != nil {
+		return err
+	}
+	if err = tx.indexGeo(bucketPath, key, val); err != nil {
+		return err
+	}
+	return tx.appendLog(&LogEntry{Op: OpPut, Bucket: bucketPath, Key: key, Value: val})
 }
 
 // Get retrieves a doc from a bucket
-func (tx *Transaction) Get(bucketPath, key string) (map[string]interface{}, error) {
+func (tx *Transaction) Get(bucketPath, key string) (doc map[string]interface{}, err error) {
+	defer tx.db.observe("get", time.Now(), &err)
 	bucket, err := tx.getBucket(bucketPath)
 	if err != nil {
 		return nil, err
@@ -74,132 +131,99 @@ func (tx *Transaction) Get(bucketPath, key string) (map[string]interface{}, erro
 }
 
 // Delete deletes a doc from a bucket
-func (tx *Transaction) Delete(bucketPath, key string) error {
-	bucket, err := tx.getBucket(bucketPath)
-	if err != nil {
+func (tx *Transaction) Delete(bucketPath, key string) (err error) {
+	defer tx.db.observe("delete", time.Now(), &err)
+	if err = tx.runDeleteHooks(beforeDelete, bucketPath, key); err != nil {
 		return err
 	}
-	return bucket.Delete([]byte(key))
+	if err = tx.delete(bucketPath, key); err != nil {
+		return err
+	}
+	return tx.runDeleteHooks(afterDelete, bucketPath, key)
 }
 
-// GetAll returns all docs in a bucket
-func (tx *Transaction) GetAll(bucketPath string) (chan *Pair, error) {
-	returnChannel := make(chan *Pair, 64)
+// delete removes a doc without running hooks
+func (tx *Transaction) delete(bucketPath, key string) error {
 	bucket, err := tx.getBucket(bucketPath)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	if err = bucket.Delete([]byte(key)); err != nil {
+		return err
+	}
+	if err = tx.unindexSearch(bucketPath, key); err != nil {
+		return err
+	}
+	if err = tx.unindexGeo(bucketPath, key); err != nil {
+		return err
+	}
+	if err = tx.deleteAttachments(bucketPath, key); err != nil {
+		return err
+	}
+	return tx.appendLog(&LogEntry{Op: OpDelete, Bucket: bucketPath, Key: key})
+}
 
-	go func() {
-		defer close(returnChannel)
-		defer tx.Close()
-		e := bucket.ForEach(func(k, v []byte) error {
-			if v != nil {
-				value, e := tx.bytesToData(v)
-				if e != nil {
-					return e
-				}
-				returnChannel <- &Pair{string(k), value}
-			}
-			return nil
-		})
-		if e != nil {
-			log.Print(e)
-		}
-	}()
-
-	return returnChannel, nil
+// GetAll returns all docs in a bucket
+func (tx *Transaction) GetAll(bucketPath string) (chan *Pair, error) {
+	return tx.query(&Query{Bucket: bucketPath}, "getAll")
 }
 
 // GetPrefix returns all docs in a bucket matching a prefix
 func (tx *Transaction) GetPrefix(bucketPath, prefix string) (chan *Pair, error) {
-	returnChannel := make(chan *Pair, 64)
-
 	if prefix == "" {
 		return nil, errors.New("empty prefix")
 	}
-
-	bucket, err := tx.getBucket(bucketPath)
-	if err != nil {
-		return nil, err
-	}
-
-	go func() {
-		defer close(returnChannel)
-		defer tx.Close()
-		c := bucket.Cursor()
-		for k, v := c.Seek([]byte(prefix)); bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
-			if v != nil {
-				value, e := tx.bytesToData(v)
-				if e != nil {
-					log.Print(e)
-					continue
-				}
-				returnChannel <- &Pair{string(k), value}
-			}
-		}
-	}()
-
-	return returnChannel, nil
+	return tx.query(&Query{Bucket: bucketPath, Prefix: prefix}, "getPrefix")
 }
 
 // GetRange returns all docs in a bucket matching a prefix
 func (tx *Transaction) GetRange(bucketPath, start, end string) (chan *Pair, error) {
-	returnChannel := make(chan *Pair, 64)
-
-	bucket, err := tx.getBucket(bucketPath)
-	if err != nil {
-		return nil, err
-	}
-
 	if start == "" || end == "" {
 		return nil, errors.New("empty start/end")
 	}
-
-	go func() {
-		defer close(returnChannel)
-		defer tx.Close()
-		c := bucket.Cursor()
-		for k, v := c.Seek([]byte(start)); k != nil && bytes.Compare(k, []byte(end)) <= 0; k, v = c.Next() {
-			if v != nil {
-				value, e := tx.bytesToData(v)
-				if e != nil {
-					log.Print(e)
-					continue
-				}
-				returnChannel <- &Pair{string(k), value}
-			}
-		}
-	}()
-
-	return returnChannel, nil
+	return tx.query(&Query{Bucket: bucketPath, Start: start, End: end}, "getRange")
 }
 
 // Find searches a bucket for documents
 func (tx *Transaction) Find(bucketPath, filterExpression string) (chan *Pair, error) {
-	stream, err := tx.GetAll(bucketPath)
-	if err != nil {
-		return nil, err
-	}
-	return tx.findFromStream(stream, filterExpression)
+	return tx.query(&Query{Bucket: bucketPath, Filter: filterExpression}, "find")
 }
 
 // FindPrefix searches a bucket for documents
 func (tx *Transaction) FindPrefix(bucketPath, prefix, filterExpression string) (chan *Pair, error) {
-	stream, err := tx.GetPrefix(bucketPath, prefix)
-	if err != nil {
-		return nil, err
+	if prefix == "" {
+		return nil, errors.New("empty prefix")
 	}
-	return tx.findFromStream(stream, filterExpression)
+	return tx.query(&Query{Bucket: bucketPath, Prefix: prefix, Filter: filterExpression}, "findPrefix")
 }
 
 // FindRange searches a bucket for documents
 func (tx *Transaction) FindRange(bucketPath, start, end, filterExpression string) (chan *Pair, error) {
-	stream, err := tx.GetRange(bucketPath, start, end)
-	if err != nil {
-		return nil, err
+	if start == "" || end == "" {
+		return nil, errors.New("empty start/end")
+	}
+	return tx.query(&Query{Bucket: bucketPath, Start: start, End: end, Filter: filterExpression}, "findRange")
+}
+
+// FindFilter searches a bucket for documents matching a Filter
+func (tx *Transaction) FindFilter(bucketPath string, filter Filter) (chan *Pair, error) {
+	return tx.query(&Query{Bucket: bucketPath, Where: filter}, "find")
+}
+
+// FindPrefixFilter searches the documents with a key prefix for documents matching a Filter
+func (tx *Transaction) FindPrefixFilter(bucketPath, prefix string, filter Filter) (chan *Pair, error) {
+	if prefix == "" {
+		return nil, errors.New("empty prefix")
+	}
+	return tx.query(&Query{Bucket: bucketPath, Prefix: prefix, Where: filter}, "findPrefix")
+}
+
+// FindRangeFilter searches the documents in a key range for documents matching a Filter
+func (tx *Transaction) FindRangeFilter(bucketPath, start, end string, filter Filter) (chan *Pair, error) {
+	if start == "" || end == "" {
+		return nil, errors.New("empty start/end")
 	}
-	return tx.findFromStream(stream, filterExpression)
+	return tx.query(&Query{Bucket: bucketPath, Start: start, End: end, Where: filter}, "findRange")
 }
 
 // Backup performs a hot backup of the whole database
@@ -211,17 +235,20 @@ func (tx *Transaction) Backup(target io.Writer) error {
 // Buckets returns a list of all buckets and subbuckets
 func (tx *Transaction) Buckets() ([]string, error) {
 	var res []string
-	err := tx.tx.ForEach(func(k []byte, bucket *bolt.Bucket) error {
+	err := tx.tx.ForEach(func(k []byte, bucket backendBucket) error {
+		if string(k) == metaBucket {
+			return nil
+		}
 		res = append(res, searchSubbuckets(bucket, "")...)
 		return nil
 	})
 	return res, err
 }
 
-func searchSubbuckets(bucket *bolt.Bucket, prefix string) []string {
+func searchSubbuckets(bucket backendBucket, prefix string) []string {
 	var res []string
 	bucket.ForEach(func(k, v []byte) error {
-		if v == nil {
+		if v == nil && string(k) != attachmentsBucket {
 			key := string(k)
 			if prefix != "" {
 				key = prefix + "." + key
@@ -234,7 +261,7 @@ func searchSubbuckets(bucket *bolt.Bucket, prefix string) []string {
 	return res
 }
 
-func (tx *Transaction) getBucketOrCreate(bucketPath string) (*bolt.Bucket, error) {
+func (tx *Transaction) getBucketOrCreate(bucketPath string) (backendBucket, error) {
 	buckets := strings.Split(bucketPath, ".")
 	bucket, err := tx.tx.CreateBucketIfNotExists([]byte(buckets[0]))
 	if err != nil {
@@ -251,24 +278,48 @@ func (tx *Transaction) getBucketOrCreate(bucketPath string) (*bolt.Bucket, error
 	return bucket, nil
 }
 
-func (tx *Transaction) getBucket(bucketPath string) (*bolt.Bucket, error) {
+var errNoSuchBucket = errors.New("no such bucket")
+
+func (tx *Transaction) getBucket(bucketPath string) (backendBucket, error) {
 	buckets := strings.Split(bucketPath, ".")
 	bucket := tx.tx.Bucket([]byte(buckets[0]))
 	if bucket == nil {
-		return nil, errors.New("no such bucket")
+		return nil, errNoSuchBucket
 	}
 	if len(bucketPath) > 1 {
 		for _, id := range buckets {
 			bucket = bucket.Bucket([]byte(id))
 			if bucket == nil {
-				return nil, errors.New("no such bucket")
+				return nil, errNoSuchBucket
 			}
 		}
 	}
 	return bucket, nil
 }
 
-func (tx *Transaction) dataToBytes(data map[string]interface{}) ([]byte, error) {
+// valueAt resolves a dotted field path inside a doc, it returns nil if the path does not exist
+func valueAt(doc map[string]interface{}, path string) interface{} {
+	var value interface{} = doc
+	for _, field := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = obj[field]
+	}
+	return value
+}
+
+func (tx *Transaction) dataToBytes(data interface{}) ([]byte, error) {
+	body, err := compressJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return tx.seal(kindObject, body)
+}
+
+// compressJSON encodes a value as JSON into a snappy stream
+func compressJSON(data interface{}) ([]byte, error) {
 	var buff bytes.Buffer
 	encoder := json.NewEncoder(snappy.NewWriter(&buff))
 	if err := encoder.Encode(data); err != nil {
@@ -277,38 +328,55 @@ func (tx *Transaction) dataToBytes(data map[string]interface{}) ([]byte, error)
 	return buff.Bytes(), nil
 }
 
+// seal adds the header of its kind to the body of a value and encrypts it if keys are configured.
+// Unencrypted objects are stored without header.
+func (tx *Transaction) seal(kind byte, body []byte) ([]byte, error) {
+	tx.db.observeBytes(MetricBytesEncoded, len(body))
+	if tx.db.keys != nil {
+		return encrypt(tx.db.keys, kind, body)
+	}
+	if kind == kindObject {
+		return body, nil
+	}
+	return append([]byte{valueMagic, kind}, body...), nil
+}
+
 func (tx *Transaction) bytesToData(data []byte) (map[string]interface{}, error) {
-	buff := bytes.NewBuffer(data)
-	decoder := json.NewDecoder(snappy.NewReader(buff))
 	value := make(map[string]interface{})
-	err := decoder.Decode(&value)
-	if err != nil {
+	if err := tx.decodeBytes(data, &value); err != nil {
 		return nil, err
 	}
 	return value, nil
 }
 
-func (tx *Transaction) findFromStream(stream chan *Pair, filterExpression string) (chan *Pair, error) {
-	res := make(chan *Pair, 64)
-	tokens, err := jee.Lexer(filterExpression)
+// decodeBytes decrypts and decompresses a stored object into v
+func (tx *Transaction) decodeBytes(data []byte, v interface{}) error {
+	kind, body, err := openValue(tx.db.keys, data)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if kind != kindObject {
+		return ErrNotObject
 	}
-	tree, err := jee.Parser(tokens)
+	tx.db.observeBytes(MetricBytesDecoded, len(body))
+	decoder := json.NewDecoder(snappy.NewReader(bytes.NewReader(body)))
+	return decoder.Decode(v)
+}
+
+// decodeValue decodes a stored value of any kind, raw values are returned as a copy of their bytes
+func (tx *Transaction) decodeValue(data []byte) (interface{}, error) {
+	kind, body, err := openValue(tx.db.keys, data)
 	if err != nil {
 		return nil, err
 	}
-	go func() {
-		defer close(res)
-		for pair := range stream {
-			if val, err := jee.Eval(tree, pair.Value); err == nil {
-				if match, ok := val.(bool); ok && match {
-					res <- pair
-				}
-			} else {
-				log.Print(err)
-			}
-		}
-	}()
-	return res, nil
+	tx.db.observeBytes(MetricBytesDecoded, len(body))
+	if kind == kindRaw {
+		return append([]byte{}, body...), nil
+	}
+	var value interface{}
+	decoder := json.NewDecoder(snappy.NewReader(bytes.NewReader(body)))
+	if err = decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
 }
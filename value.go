@@ -0,0 +1,180 @@
+package boltplus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// ErrNotObject is returned by the doc APIs like Get for values which are no JSON objects,
+// GetValue and GetRaw read them
+var ErrNotObject = errors.New("value is not an object")
+
+// PutValue stores any JSON value. Objects are stored like Put does, arrays, strings, numbers, booleans and null
+// are stored as they are. Hooks and search and geo indexes only see objects, schemas validate all values.
+func (tx *Transaction) PutValue(bucketPath, key string, value interface{}) (err error) {
+	switch doc := value.(type) {
+	case map[string]interface{}:
+		return tx.Put(bucketPath, key, doc)
+	case Object:
+		return tx.Put(bucketPath, key, doc)
+	}
+	bs, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	var normalized interface{}
+	if err = json.Unmarshal(bs, &normalized); err != nil {
+		return err
+	}
+	if doc, ok := normalized.(map[string]interface{}); ok {
+		return tx.Put(bucketPath, key, doc)
+	}
+	defer tx.db.observe("putValue", time.Now(), &err)
+	if err = tx.validate(bucketPath, key, normalized); err != nil {
+		return err
+	}
+	return tx.putValue(bucketPath, key, kindJSON, bs)
+}
+
+// PutRaw stores bytes as they are, bypassing the JSON codec and the compression. They are still encrypted
+// if keys are configured. Buckets with a schema do not accept raw values.
+func (tx *Transaction) PutRaw(bucketPath, key string, data []byte) (err error) {
+	defer tx.db.observe("putRaw", time.Now(), &err)
+	schema, err := tx.schema(bucketPath)
+	if err != nil {
+		return err
+	}
+	if schema != nil {
+		return fmt.Errorf("bucket %v has a schema, raw values can not be validated", bucketPath)
+	}
+	return tx.putValue(bucketPath, key, kindRaw, data)
+}
+
+// putValue stores the JSON encoding or the bytes of a value which is no object without validation
+func (tx *Transaction) putValue(bucketPath, key string, kind byte, data []byte) error {
+	bucket, err := tx.getBucketOrCreate(bucketPath)
+	if err != nil {
+		return err
+	}
+	body := data
+	if kind == kindJSON {
+		if body, err = compressJSON(json.RawMessage(data)); err != nil {
+			return err
+		}
+	}
+	bs, err := tx.seal(kind, body)
+	if err != nil {
+		return err
+	}
+	if err = bucket.Put([]byte(key), bs); err != nil {
+		return err
+	}
+	// an object stored under the key before is not indexed anymore
+	if err = tx.unindexSearch(bucketPath, key); err != nil {
+		return err
+	}
+	if err = tx.unindexGeo(bucketPath, key); err != nil {
+		return err
+	}
+	op := OpPutValue
+	if kind == kindRaw {
+		op = OpPutRaw
+	}
+	return tx.appendLog(&LogEntry{Op: op, Bucket: bucketPath, Key: key, Data: data})
+}
+
+// GetValue retrieves a value of any kind from a bucket, raw values are returned as []byte
+func (tx *Transaction) GetValue(bucketPath, key string) (value interface{}, err error) {
+	defer tx.db.observe("getValue", time.Now(), &err)
+	data, err := tx.getStored(bucketPath, key)
+	if err != nil {
+		return nil, err
+	}
+	return tx.decodeValue(data)
+}
+
+// GetRaw retrieves the bytes of a raw value, other values are returned as their JSON encoding
+func (tx *Transaction) GetRaw(bucketPath, key string) (data []byte, err error) {
+	defer tx.db.observe("getRaw", time.Now(), &err)
+	stored, err := tx.getStored(bucketPath, key)
+	if err != nil {
+		return nil, err
+	}
+	kind, body, err := openValue(tx.db.keys, stored)
+	if err != nil {
+		return nil, err
+	}
+	tx.db.observeBytes(MetricBytesDecoded, len(body))
+	if kind == kindRaw {
+		return append([]byte{}, body...), nil
+	}
+	data, err = ioutil.ReadAll(snappy.NewReader(bytes.NewReader(body)))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(data, []byte("\n")), nil
+}
+
+func (tx *Transaction) getStored(bucketPath, key string) ([]byte, error) {
+	bucket, err := tx.getBucket(bucketPath)
+	if err != nil {
+		return nil, err
+	}
+	data := bucket.Get([]byte(key))
+	if data == nil {
+		return nil, fmt.Errorf("no such key %v", key)
+	}
+	return data, nil
+}
+
+// PutValue stores any JSON value
+func (db *DB) PutValue(bucketPath, key string, value interface{}) error {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	if err = tx.PutValue(bucketPath, key, value); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PutRaw stores bytes as they are
+func (db *DB) PutRaw(bucketPath, key string, data []byte) error {
+	tx, err := db.Tx(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	if err = tx.PutRaw(bucketPath, key, data); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetValue retrieves a value of any kind from a bucket
+func (db *DB) GetValue(bucketPath, key string) (interface{}, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	return tx.GetValue(bucketPath, key)
+}
+
+// GetRaw retrieves the bytes of a raw value
+func (db *DB) GetRaw(bucketPath, key string) ([]byte, error) {
+	tx, err := db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	return tx.GetRaw(bucketPath, key)
+}
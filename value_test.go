@@ -0,0 +1,216 @@
+package boltplus
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestPutGetValue(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	values := map[string]interface{}{
+		"array":  []interface{}{1., "two", nil},
+		"string": "hello",
+		"number": 42.5,
+		"bool":   true,
+		"null":   nil,
+		"object": Object{"a": 1.},
+	}
+	for key, value := range values {
+		if err := db.PutValue("values", key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, value := range values {
+		got, err := db.GetValue("values", key)
+		if doc, ok := got.(map[string]interface{}); ok {
+			got = Object(doc)
+		}
+		if err != nil || !reflect.DeepEqual(got, value) {
+			t.Errorf("%v: wanted %v got %v (%v)", key, value, got, err)
+		}
+	}
+	if _, err := db.Get("values", "array"); err != ErrNotObject {
+		t.Errorf("wanted ErrNotObject got %v", err)
+	}
+	if doc, err := db.Get("values", "object"); err != nil || doc["a"] != 1. {
+		t.Errorf("objects stored with PutValue are docs, got %v (%v)", doc, err)
+	}
+	if _, err := db.GetValue("values", "missing"); err == nil {
+		t.Error("wanted an error for a missing key")
+	}
+}
+
+func TestPutGetRaw(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	data := []byte{0xff, 0xb7, 0x00, 'r', 'a', 'w'}
+	if err := db.PutRaw("files", "blob", data); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.GetRaw("files", "blob"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("wanted %v got %v (%v)", data, got, err)
+	}
+	if got, err := db.GetValue("files", "blob"); err != nil || !reflect.DeepEqual(got, data) {
+		t.Errorf("wanted the bytes got %v (%v)", got, err)
+	}
+	if err := db.PutRaw("files", "empty", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.GetRaw("files", "empty"); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("wanted an empty value got %v (%v)", got, err)
+	}
+	db.PutValue("files", "list", []interface{}{"a", 1})
+	if got, err := db.GetRaw("files", "list"); err != nil || string(got) != `["a",1]` {
+		t.Errorf("wanted the json encoding got %q (%v)", got, err)
+	}
+	db.SetSchema("files", map[string]interface{}{"type": "object"})
+	if err := db.PutRaw("files", "other", data); err == nil {
+		t.Error("wanted raw values to be rejected by buckets with a schema")
+	}
+	if err := db.PutValue("files", "other", "text"); err == nil {
+		t.Error("wanted the schema to reject a string")
+	}
+}
+
+func TestEncryptedValues(t *testing.T) {
+	db, err := setupEncryptedDB(StaticKeys{testKey("k1", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.PutRaw("files", "blob", []byte("secret bytes"))
+	db.PutValue("files", "list", []interface{}{"secret"})
+	if got, err := db.GetRaw("files", "blob"); err != nil || string(got) != "secret bytes" {
+		t.Errorf("wanted the raw value got %q (%v)", got, err)
+	}
+	if got, err := db.GetValue("files", "list"); err != nil || !reflect.DeepEqual(got, []interface{}{"secret"}) {
+		t.Errorf("wanted the array got %v (%v)", got, err)
+	}
+	// the kind is authenticated, flipping it makes the value undecryptable
+	tx, _ := db.Tx(true)
+	defer tx.Close()
+	bucket, _ := tx.getBucket("files")
+	stored := append([]byte{}, bucket.Get([]byte("blob"))...)
+	if bytes.Contains(stored, []byte("secret")) {
+		t.Error("raw value is stored in plain text")
+	}
+	stored[1] = valueEncrypted | kindJSON
+	bucket.Put([]byte("blob"), stored)
+	if _, err := tx.GetValue("files", "blob"); err == nil {
+		t.Error("wanted an error for a tampered kind")
+	}
+}
+
+func TestScanValues(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.Put("mixed", "a", Object{"n": 1.})
+	db.PutValue("mixed", "b", 2.)
+	db.PutRaw("mixed", "c", []byte("raw"))
+	// the object streams skip the other values
+	if keys := collectKeys(mustQuery(t, db, &Query{Bucket: "mixed"})); !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Errorf("wanted only the object a got %v", keys)
+	}
+	ch, err := db.QueryValues(&Query{Bucket: "mixed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []interface{}
+	for pair := range ch {
+		values = append(values, pair.Value)
+	}
+	expect := []interface{}{map[string]interface{}{"n": 1.}, 2., []byte("raw")}
+	if !reflect.DeepEqual(values, expect) {
+		t.Errorf("wanted %v got %v", expect, values)
+	}
+	filter := FilterFunc(func(key string, doc interface{}) (bool, error) {
+		n, ok := doc.(float64)
+		return ok && n == 2, nil
+	})
+	ch, err = db.QueryValues(&Query{Bucket: "mixed", Where: filter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair := <-ch; pair == nil || pair.Key != "b" || <-ch != nil {
+		t.Errorf("wanted the scalar b got %v", pair)
+	}
+	if n, err := db.Count("mixed"); err != nil || n != 3 {
+		t.Errorf("wanted 3 values got %v (%v)", n, err)
+	}
+}
+
+func mustQuery(t *testing.T, db *DB, q *Query) chan *Pair {
+	ch, err := db.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func TestValueUnindexes(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.CreateSearchIndex("texts", &SearchIndex{Fields: []string{"text"}, Language: "en"})
+	db.Put("texts", "a", Object{"text": "hello world"})
+	db.PutValue("texts", "a", "hello world")
+	ch, err := db.Search("texts", "hello", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := collectKeys(ch); len(keys) != 0 {
+		t.Errorf("wanted the replaced doc to be unindexed got %v", keys)
+	}
+	// indexes created later skip the values
+	if err := db.CreateSearchIndex("texts", &SearchIndex{Fields: []string{"text"}, Language: "en"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReplicateValues(t *testing.T) {
+	primary, replica := setupLoggedDB(t)
+	defer primary.Close()
+	defer replica.Close()
+	defer os.Remove("./replica.db")
+	primary.PutValue("values", "list", []interface{}{"a"})
+	primary.PutRaw("values", "blob", []byte("raw"))
+	entries := readLog(t, primary, 0)
+	if len(entries) != 2 || entries[0].Op != OpPutValue || entries[1].Op != OpPutRaw {
+		t.Fatalf("unexpected log %v", entries)
+	}
+	if _, err := replica.ApplyLog(entries); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := replica.GetValue("values", "list"); err != nil || !reflect.DeepEqual(got, []interface{}{"a"}) {
+		t.Errorf("wanted the array got %v (%v)", got, err)
+	}
+	if got, err := replica.GetRaw("values", "blob"); err != nil || string(got) != "raw" {
+		t.Errorf("wanted the raw value got %q (%v)", got, err)
+	}
+}
+
+func TestExportImportValues(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	db.Put("src", "a", Object{"n": 1.})
+	db.PutValue("src", "b", []interface{}{"x"})
+	db.PutRaw("src", "c", []byte{0, 1, 2})
+	var buf bytes.Buffer
+	if err := db.Export("src", &buf, FormatNDJSON); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Import("dst", &buf, FormatNDJSON); err != nil || n != 3 {
+		t.Fatalf("wanted 3 imported values got %v (%v)", n, err)
+	}
+	if got, err := db.GetValue("dst", "b"); err != nil || !reflect.DeepEqual(got, []interface{}{"x"}) {
+		t.Errorf("wanted the array got %v (%v)", got, err)
+	}
+	if got, err := db.GetRaw("dst", "c"); err != nil || !bytes.Equal(got, []byte{0, 1, 2}) {
+		t.Errorf("wanted the raw value got %v (%v)", got, err)
+	}
+	if err := db.Export("src", &buf, FormatCSV); err == nil {
+		t.Error("wanted csv exports of values to fail")
+	}
+}
@@ -0,0 +1,422 @@
+package boltplus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Filter decides which docs a query returns. Implementations must be safe for concurrent use,
+// parallel queries and prepared queries share them.
+type Filter interface {
+	// Match reports whether the doc stored under key matches
+	Match(key string, doc interface{}) (bool, error)
+}
+
+// FilterFunc adapts a function to the Filter interface
+type FilterFunc func(key string, doc interface{}) (bool, error)
+
+// Match calls f(key, doc)
+func (f FilterFunc) Match(key string, doc interface{}) (bool, error) {
+	return f(key, doc)
+}
+
+// GojeeFilter compiles a gojee expression into a Filter, syntax errors are returned as *FilterError
+func GojeeFilter(expression string) (Filter, error) {
+	p, err := Prepare(&Query{Filter: expression})
+	if err != nil {
+		return nil, err
+	}
+	return p.filters[0], nil
+}
+
+// ParseWhere parses a JSON query document, see CompileWhere
+func ParseWhere(data []byte) (Filter, error) {
+	var query map[string]interface{}
+	if err := json.Unmarshal(data, &query); err != nil {
+		return nil, fmt.Errorf("where: %v", err)
+	}
+	return CompileWhere(query)
+}
+
+// CompileWhere compiles a MongoDB style query document like
+//
+//	{"age": {"$gt": 30}, "tags": {"$in": ["a", "b"]}, "$or": [{"name": "foo"}, {"address.city": "Berlin"}]}
+//
+// into a Filter. Fields are dotted paths, arrays on the way are searched element by element and numeric path
+// segments index into arrays. A field compared to a plain value has to equal it or, if the field is an array,
+// contain it. Supported operators are $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists, $regex (with
+// $options), $size, $elemMatch and $not on fields and $and, $or and $nor on documents.
+func CompileWhere(query map[string]interface{}) (Filter, error) {
+	// numbers of Go maps are turned into float64 like the ones of decoded docs
+	bs, err := json.Marshal(query)
+	if err != nil {
+		return nil, fmt.Errorf("where: %v", err)
+	}
+	var normalized map[string]interface{}
+	if err = json.Unmarshal(bs, &normalized); err != nil {
+		return nil, fmt.Errorf("where: %v", err)
+	}
+	match, err := compileWhereDoc(normalized)
+	if err != nil {
+		return nil, fmt.Errorf("where: %v", err)
+	}
+	return FilterFunc(func(key string, doc interface{}) (bool, error) {
+		return match(doc), nil
+	}), nil
+}
+
+// docMatcher matches a document, valuesMatcher the values found at a field path
+type docMatcher func(doc interface{}) bool
+type valuesMatcher func(values []interface{}) bool
+
+func compileWhereDoc(query map[string]interface{}) (docMatcher, error) {
+	var matchers []docMatcher
+	for field, spec := range query {
+		var m docMatcher
+		var err error
+		switch field {
+		case "$and", "$or", "$nor":
+			m, err = compileLogical(field, spec)
+		default:
+			if strings.HasPrefix(field, "$") {
+				return nil, fmt.Errorf("unknown operator %v", field)
+			}
+			m, err = compileField(field, spec)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return func(doc interface{}) bool {
+		for _, m := range matchers {
+			if !m(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileLogical(op string, spec interface{}) (docMatcher, error) {
+	clauses, ok := spec.([]interface{})
+	if !ok || len(clauses) == 0 {
+		return nil, fmt.Errorf("%v needs a non-empty array", op)
+	}
+	matchers := make([]docMatcher, len(clauses))
+	for i, clause := range clauses {
+		query, ok := clause.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v needs an array of documents", op)
+		}
+		m, err := compileWhereDoc(query)
+		if err != nil {
+			return nil, err
+		}
+		matchers[i] = m
+	}
+	return func(doc interface{}) bool {
+		for _, m := range matchers {
+			switch matched := m(doc); {
+			case matched && op == "$or":
+				return true
+			case matched && op == "$nor", !matched && op == "$and":
+				return false
+			}
+		}
+		return op != "$or"
+	}, nil
+}
+
+func compileField(field string, spec interface{}) (docMatcher, error) {
+	path := strings.Split(field, ".")
+	m, err := compileValues(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", field, err)
+	}
+	return func(doc interface{}) bool {
+		return m(resolvePath(doc, path))
+	}, nil
+}
+
+// compileValues compiles an operator document or a plain value to compare with
+func compileValues(spec interface{}) (valuesMatcher, error) {
+	ops, ok := spec.(map[string]interface{})
+	if !ok || !isOperatorDoc(ops) {
+		return eqMatcher(spec), nil
+	}
+	var matchers []valuesMatcher
+	for op, arg := range ops {
+		if op == "$options" {
+			if _, ok := ops["$regex"]; !ok {
+				return nil, errors.New("$options without $regex")
+			}
+			continue
+		}
+		m, err := compileOperator(op, arg, ops)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return func(values []interface{}) bool {
+		for _, m := range matchers {
+			if !m(values) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileOperator(op string, arg interface{}, ops map[string]interface{}) (valuesMatcher, error) {
+	switch op {
+	case "$eq":
+		return eqMatcher(arg), nil
+	case "$ne":
+		eq := eqMatcher(arg)
+		return func(values []interface{}) bool { return !eq(values) }, nil
+	case "$gt", "$gte", "$lt", "$lte":
+		return compareMatcher(op, arg), nil
+	case "$in", "$nin":
+		candidates, ok := arg.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v needs an array", op)
+		}
+		matchers := make([]valuesMatcher, len(candidates))
+		for i, c := range candidates {
+			matchers[i] = eqMatcher(c)
+		}
+		return func(values []interface{}) bool {
+			for _, m := range matchers {
+				if m(values) {
+					return op == "$in"
+				}
+			}
+			return op == "$nin"
+		}, nil
+	case "$exists":
+		exists, ok := arg.(bool)
+		if !ok {
+			return nil, errors.New("$exists needs a boolean")
+		}
+		return func(values []interface{}) bool { return (len(values) > 0) == exists }, nil
+	case "$regex":
+		options, _ := ops["$options"].(string)
+		return regexMatcher(arg, options)
+	case "$size":
+		size, ok := arg.(float64)
+		if !ok {
+			return nil, errors.New("$size needs a number")
+		}
+		return func(values []interface{}) bool {
+			for _, v := range values {
+				if arr, ok := v.([]interface{}); ok && float64(len(arr)) == size {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "$elemMatch":
+		return compileElemMatch(arg)
+	case "$not":
+		var m valuesMatcher
+		var err error
+		if pattern, ok := arg.(string); ok {
+			m, err = regexMatcher(pattern, "")
+		} else if ops, ok := arg.(map[string]interface{}); ok && isOperatorDoc(ops) {
+			m, err = compileValues(ops)
+		} else {
+			err = errors.New("$not needs an operator document or a regular expression")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return func(values []interface{}) bool { return !m(values) }, nil
+	}
+	return nil, fmt.Errorf("unknown operator %v", op)
+}
+
+// compileElemMatch matches arrays containing an element matching all conditions. Conditions are an
+// operator document applied to the elements themselves or a query document applied to object elements.
+func compileElemMatch(arg interface{}) (valuesMatcher, error) {
+	spec, ok := arg.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("$elemMatch needs a document")
+	}
+	var match func(elem interface{}) bool
+	if isOperatorDoc(spec) {
+		m, err := compileValues(spec)
+		if err != nil {
+			return nil, err
+		}
+		match = func(elem interface{}) bool { return m([]interface{}{elem}) }
+	} else {
+		m, err := compileWhereDoc(spec)
+		if err != nil {
+			return nil, err
+		}
+		match = func(elem interface{}) bool {
+			_, ok := elem.(map[string]interface{})
+			return ok && m(elem)
+		}
+	}
+	return func(values []interface{}) bool {
+		for _, v := range values {
+			arr, _ := v.([]interface{})
+			for _, elem := range arr {
+				if match(elem) {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+func isOperatorDoc(spec map[string]interface{}) bool {
+	if len(spec) == 0 {
+		return false
+	}
+	for k := range spec {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// eqMatcher matches values equal to arg or arrays containing it, null also matches missing fields
+func eqMatcher(arg interface{}) valuesMatcher {
+	return func(values []interface{}) bool {
+		if arg == nil && len(values) == 0 {
+			return true
+		}
+		for _, v := range values {
+			if reflect.DeepEqual(v, arg) {
+				return true
+			}
+			if arr, ok := v.([]interface{}); ok {
+				for _, elem := range arr {
+					if reflect.DeepEqual(elem, arg) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+}
+
+// compareMatcher compares numbers with numbers and strings with strings, other values never match
+func compareMatcher(op string, arg interface{}) valuesMatcher {
+	return func(values []interface{}) bool {
+		for _, v := range expandArrays(values) {
+			c, ok := compareValues(v, arg)
+			if !ok {
+				continue
+			}
+			switch {
+			case op == "$gt" && c > 0, op == "$gte" && c >= 0, op == "$lt" && c < 0, op == "$lte" && c <= 0:
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func compareValues(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		switch {
+		case !ok:
+			return 0, false
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	}
+	return 0, false
+}
+
+func regexMatcher(arg interface{}, options string) (valuesMatcher, error) {
+	pattern, ok := arg.(string)
+	if !ok {
+		return nil, errors.New("$regex needs a string")
+	}
+	for _, o := range options {
+		if !strings.ContainsRune("imsU", o) {
+			return nil, fmt.Errorf("unsupported $options %q", o)
+		}
+	}
+	if options != "" {
+		pattern = "(?" + options + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return func(values []interface{}) bool {
+		for _, v := range expandArrays(values) {
+			if s, ok := v.(string); ok && re.MatchString(s) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// expandArrays adds the elements of array values to the values
+func expandArrays(values []interface{}) []interface{} {
+	res := values
+	for _, v := range values {
+		if arr, ok := v.([]interface{}); ok {
+			res = append(res[:len(res):len(res)], arr...)
+		}
+	}
+	return res
+}
+
+// resolvePath returns all values found at a path, arrays on the way are searched element by element
+func resolvePath(v interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{v}
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		child, ok := x[path[0]]
+		if !ok {
+			return nil
+		}
+		return resolvePath(child, path[1:])
+	case []interface{}:
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i < 0 || i >= len(x) {
+				return nil
+			}
+			return resolvePath(x[i], path[1:])
+		}
+		var res []interface{}
+		for _, elem := range x {
+			if _, ok := elem.(map[string]interface{}); ok {
+				res = append(res, resolvePath(elem, path)...)
+			}
+		}
+		return res
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package boltplus
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWhere(t *testing.T) {
+	docs := map[string]map[string]interface{}{
+		"alice": {"name": "Alice", "age": 34.0, "tags": []interface{}{"a", "b"}, "address": map[string]interface{}{"city": "Berlin"},
+			"scores": []interface{}{map[string]interface{}{"game": "chess", "points": 10.0}}},
+		"bob":   {"name": "Bob", "age": 28.0, "tags": []interface{}{"c"}, "address": map[string]interface{}{"city": "Paris"}},
+		"carol": {"name": "carol", "age": 41.0, "scores": []interface{}{map[string]interface{}{"game": "go", "points": 3.0}}},
+	}
+	cases := []struct {
+		query  string
+		expect []string
+	}{
+		{`{"age": {"$gt": 30}}`, []string{"alice", "carol"}},
+		{`{"age": {"$gte": 28, "$lt": 40}}`, []string{"alice", "bob"}},
+		{`{"name": "Bob"}`, []string{"bob"}},
+		{`{"tags": "b"}`, []string{"alice"}},
+		{`{"tags": ["c"]}`, []string{"bob"}},
+		{`{"tags": {"$in": ["a", "c"]}}`, []string{"alice", "bob"}},
+		{`{"tags": {"$nin": ["a"]}}`, []string{"bob", "carol"}},
+		{`{"tags": {"$exists": false}}`, []string{"carol"}},
+		{`{"tags": {"$size": 2}}`, []string{"alice"}},
+		{`{"address.city": {"$ne": "Berlin"}}`, []string{"bob", "carol"}},
+		{`{"name": {"$regex": "^c", "$options": "i"}}`, []string{"carol"}},
+		{`{"name": {"$not": {"$regex": "^[A-Z]"}}}`, []string{"carol"}},
+		{`{"scores": {"$elemMatch": {"game": "chess", "points": {"$gte": 5}}}}`, []string{"alice"}},
+		{`{"scores.points": {"$lt": 5}}`, []string{"carol"}},
+		{`{"scores.0.game": "go"}`, []string{"carol"}},
+		{`{"$or": [{"age": {"$lt": 30}}, {"address.city": "Berlin"}]}`, []string{"alice", "bob"}},
+		{`{"$nor": [{"age": {"$lt": 30}}, {"address.city": "Berlin"}]}`, []string{"carol"}},
+		{`{"$and": [{"age": {"$gt": 30}}, {"name": {"$eq": "Alice"}}]}`, []string{"alice"}},
+		{`{"age": {"$gt": "30"}}`, []string{}},
+		{`{}`, []string{"alice", "bob", "carol"}},
+	}
+	for _, c := range cases {
+		filter, err := ParseWhere([]byte(c.query))
+		if err != nil {
+			t.Errorf("%v: %v", c.query, err)
+			continue
+		}
+		res := []string{}
+		for key, doc := range docs {
+			if match, _ := filter.Match(key, doc); match {
+				res = append(res, key)
+			}
+		}
+		sort.Strings(res)
+		if !reflect.DeepEqual(res, c.expect) {
+			t.Errorf("%v: wanted %v got %v", c.query, c.expect, res)
+		}
+	}
+	for _, query := range []string{`{"$foo": 1}`, `{"a": {"$foo": 1}}`, `{"$or": {}}`, `{"a": {"$in": 1}}`, `{"a": {"$regex": "("}}`, `[1]`} {
+		if _, err := ParseWhere([]byte(query)); err == nil {
+			t.Errorf("%v: wanted error", query)
+		}
+	}
+}
+
+func TestFindFilter(t *testing.T) {
+	db, _ := setupCleanDB()
+	defer db.Close()
+	putN(db, 10)
+	filter, err := CompileWhere(map[string]interface{}{"key": map[string]interface{}{"$gte": 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := db.FindFilter("test.bucket", filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := collectKeys(ch); len(keys) != 5 {
+		t.Errorf("wanted 5 docs got %v", keys)
+	}
+	ch, err = db.FindRangeFilter("test.bucket", "3", "7", filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := collectKeys(ch); !reflect.DeepEqual(keys, []string{"5", "6", "7"}) {
+		t.Errorf("wanted docs 5-7 got %v", keys)
+	}
+	odd := FilterFunc(func(key string, doc interface{}) (bool, error) {
+		return key == "1" || key == "3", nil
+	})
+	ch, err = db.FindPrefixFilter("test.bucket", "1", odd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := collectKeys(ch); !reflect.DeepEqual(keys, []string{"1"}) {
+		t.Errorf("wanted doc 1 got %v", keys)
+	}
+	// gojee and query documents are combined
+	res := runQuery(t, db, &Query{Bucket: "test.bucket", Filter: ".key < 7", Where: filter})
+	if len(res) != 2 {
+		t.Errorf("wanted docs 5 and 6 got %v", res)
+	}
+}